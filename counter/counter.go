@@ -8,19 +8,30 @@ import (
 
 type Counter struct {
 	*redis.Client
+	mem *memStore // EmptyCounter时不为nil，Counter自己的方法在内存中执行
 }
 
 func (c *Counter) IsExist(req interface{}) bool {
-	ok, err := c.SetNX(fmt.Sprintf("%v", req), time.Now().Unix(), time.Hour*24*7).Result()
+	key, ttl := fmt.Sprintf("%v", req), time.Hour*24*7
+	if c.mem != nil {
+		c.mem.lock.Lock()
+		defer c.mem.lock.Unlock()
+		resp, _ := c.mem.call("SET", key, fmt.Sprintf("%v", time.Now().Unix()), "PX", ms(ttl), "NX")
+		return resp == nil
+	}
+	ok, err := c.SetNX(key, time.Now().Unix(), ttl).Result()
 	if err != nil {
 		return false
 	}
 	return !ok //设置成功->不存在->exist=false
 }
 
+// EmptyCounter 不连接redis，IsExist/Incr/Allow等方法在进程内存中执行，用于离线运行。
+// 直接调用内嵌的redis.Client仍然会访问默认地址
 func EmptyCounter() *Counter {
 	return &Counter{
 		Client: redis.NewClient(&redis.Options{}),
+		mem:    newMemStore(),
 	}
 }
 
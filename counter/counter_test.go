@@ -1,8 +1,14 @@
 package counter_test
 
 import (
+	"context"
 	"github.com/logxxx/utils/counter"
+	"github.com/logxxx/utils/counter/redistest"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -36,3 +42,297 @@ func TestEmptyCounter(t *testing.T) {
 	t.Logf("err:%v", err)
 
 }
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// realRedis 设置了REDIS_ADDR时连接真实的redis，用于验证lua脚本本身。
+// 使用REDIS_DB(默认15)，测试前后会清空该db；REDIS_PASSWORD为密码
+func realRedis(t *testing.T) *counter.Counter {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		return nil
+	}
+	db := int64(15)
+	if v := os.Getenv("REDIS_DB"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			t.Fatalf("invalid REDIS_DB:%v", v)
+		}
+		db = n
+	}
+	c, err := counter.NewCounter(addr, os.Getenv("REDIS_PASSWORD"), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.FlushDb().Err(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.FlushDb()
+		c.Close()
+	})
+	return c
+}
+
+// testCounters 返回连接redis替身的Counter和内存中的Counter，两者的行为应当一致。
+// redis替身执行的是脚本的go实现，设置了REDIS_ADDR时还会返回连接真实redis的Counter，执行lua脚本
+func testCounters(t *testing.T) map[string]*counter.Counter {
+	s, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	counter.RegisterScripts(s)
+
+	c, err := counter.NewCounter(s.Addr(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	counters := map[string]*counter.Counter{
+		"redis":  c,
+		"memory": counter.EmptyCounter(),
+	}
+	if lua := realRedis(t); lua != nil {
+		counters["lua"] = lua
+	}
+	return counters
+}
+
+func TestCounter_Incr(t *testing.T) {
+
+	clock := &fakeClock{now: time.Now()}
+	defer counter.SetTimeNow(clock.Now)()
+
+	for name, c := range testCounters(t) {
+		n, err := c.Incr("incr", time.Hour)
+		assert.Nil(t, err, name)
+		assert.Equal(t, int64(1), n, name)
+
+		n, err = c.IncrBy("incr", 10, time.Hour)
+		assert.Nil(t, err, name)
+		assert.Equal(t, int64(11), n, name)
+
+		n, err = c.IncrBy("incr", -5, 0)
+		assert.Nil(t, err, name)
+		assert.Equal(t, int64(6), n, name)
+	}
+
+	//内存中的计数按ttl过期
+	c := counter.EmptyCounter()
+	_, err := c.Incr("ttl", time.Minute)
+	assert.Nil(t, err)
+	clock.Add(2 * time.Minute)
+	n, err := c.Incr("ttl", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+
+	assert.False(t, c.IsExist("exist"))
+	assert.True(t, c.IsExist("exist"))
+}
+
+func TestCounter_Window(t *testing.T) {
+
+	//对齐到窗口开始，便于计算
+	clock := &fakeClock{now: time.Unix(1699999980, 0)}
+	defer counter.SetTimeNow(clock.Now)()
+
+	for name, c := range testCounters(t) {
+		for i := 0; i < 10; i++ {
+			_, err := c.WindowIncr("window", time.Minute)
+			assert.Nil(t, err, name)
+		}
+		n, err := c.WindowCount("window", time.Minute)
+		assert.Nil(t, err, name)
+		assert.Equal(t, int64(10), n, name)
+
+		//进入下一个窗口的1/4，上一个窗口的事件还有3/4在滑动窗口内
+		clock.Add(time.Minute + 15*time.Second)
+		n, err = c.WindowIncrBy("window", 2, time.Minute)
+		assert.Nil(t, err, name)
+		assert.Equal(t, int64(2+7), n, name)
+
+		clock.Add(2 * time.Minute)
+		n, err = c.WindowCount("window", time.Minute)
+		assert.Nil(t, err, name)
+		assert.Equal(t, int64(0), n, name)
+
+		clock.Add(-(3*time.Minute + 15*time.Second))
+	}
+}
+
+func TestCounter_Allow(t *testing.T) {
+
+	clock := &fakeClock{now: time.Now()}
+	defer counter.SetTimeNow(clock.Now)()
+
+	for name, c := range testCounters(t) {
+		key := "allow_" + name
+
+		//突发5次
+		for i := 0; i < 5; i++ {
+			ok, err := c.Allow(key, 10, 5)
+			assert.Nil(t, err, name)
+			assert.True(t, ok, name)
+		}
+		result, err := c.AllowN(key, 10, 5, 1)
+		assert.Nil(t, err, name)
+		assert.False(t, result.Allowed, name)
+		assert.Equal(t, 100*time.Millisecond, result.RetryAfter, name)
+
+		//每秒10次，100ms恢复一次
+		clock.Add(100 * time.Millisecond)
+		result, err = c.AllowN(key, 10, 5, 1)
+		assert.Nil(t, err, name)
+		assert.True(t, result.Allowed, name)
+		assert.Equal(t, int64(0), result.Remaining, name)
+
+		clock.Add(time.Second)
+		result, err = c.AllowN(key, 10, 5, 3)
+		assert.Nil(t, err, name)
+		assert.True(t, result.Allowed, name)
+		assert.Equal(t, int64(2), result.Remaining, name)
+
+		_, err = c.AllowN(key, 10, 5, 6)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestCounter_Lock(t *testing.T) {
+
+	for name, c := range testCounters(t) {
+		key := "lock_" + name
+
+		//并发加锁互斥，fence递增
+		wg := sync.WaitGroup{}
+		running := int32(0)
+		fences := make(chan int64, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				lease, err := c.Lock(ctx, key, time.Second)
+				if !assert.Nil(t, err, name) {
+					return
+				}
+				assert.Equal(t, int32(1), atomic.AddInt32(&running, 1), name)
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				fences <- lease.Fence
+				assert.Nil(t, lease.Unlock(), name)
+			}()
+		}
+		wg.Wait()
+		close(fences)
+		seen := make(map[int64]bool)
+		for fence := range fences {
+			seen[fence] = true
+		}
+		assert.Equal(t, 10, len(seen), name)
+
+		//自动续期，超过ttl后仍然持有
+		lease, err := c.TryLock(key, 150*time.Millisecond)
+		assert.Nil(t, err, name)
+		assert.Equal(t, int64(11), lease.Fence, name)
+		time.Sleep(400 * time.Millisecond)
+		_, err = c.TryLock(key, time.Second)
+		assert.Equal(t, counter.ErrLockHeld, err, name)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err = c.Lock(ctx, key, time.Second)
+		cancel()
+		assert.Equal(t, context.DeadlineExceeded, err, name)
+
+		assert.Nil(t, lease.Refresh(time.Second), name)
+		assert.Nil(t, lease.Unlock(), name)
+		assert.Nil(t, lease.Unlock(), name)
+		<-lease.Done()
+	}
+}
+
+func TestCounter_LockLost(t *testing.T) {
+
+	s, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	counter.RegisterScripts(s)
+	c, err := counter.NewCounter(s.Addr(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	lease, err := c.TryLock("lost", 300*time.Millisecond)
+	assert.Nil(t, err)
+
+	//锁过期(例如进程卡住)后被其他人持有
+	s.FastForward(time.Second)
+	other, err := c.TryLock("lost", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, other.Fence > lease.Fence)
+
+	select {
+	case <-lease.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease not lost")
+	}
+	assert.Equal(t, counter.ErrLockLost, lease.Refresh(time.Second))
+	assert.Equal(t, counter.ErrLockLost, lease.Unlock())
+
+	//旧持有者不能释放新持有者的锁
+	_, err = c.TryLock("lost", time.Minute)
+	assert.Equal(t, counter.ErrLockHeld, err)
+	assert.Nil(t, other.Unlock())
+}
+
+func TestCounter_LockLostLua(t *testing.T) {
+
+	c := realRedis(t)
+	if c == nil {
+		t.Skip("REDIS_ADDR not set")
+	}
+
+	lease, err := c.TryLock("lost", 300*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), lease.Fence)
+
+	//真实redis不能快进时间，直接删除锁模拟过期
+	assert.Nil(t, c.Del("lock:lost").Err())
+	other, err := c.TryLock("lost", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), other.Fence)
+
+	select {
+	case <-lease.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease not lost")
+	}
+	assert.Equal(t, counter.ErrLockLost, lease.Refresh(time.Second))
+	assert.Equal(t, counter.ErrLockLost, lease.Unlock())
+
+	//旧持有者不能释放、续期新持有者的锁
+	_, err = c.TryLock("lost", time.Minute)
+	assert.Equal(t, counter.ErrLockHeld, err)
+	ttl, err := c.PTTL("lock:lost").Result()
+	assert.Nil(t, err)
+	assert.True(t, ttl > 30*time.Second, "%v", ttl)
+
+	assert.Nil(t, other.Unlock())
+	_, err = c.TryLock("lost", time.Minute)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,20 @@
+package counter
+
+import (
+	"github.com/logxxx/utils/counter/redistest"
+	"time"
+)
+
+// RegisterScripts 在redis替身中注册所有lua脚本的go实现，替身不执行lua，lua本身只在设置了REDIS_ADDR时测试
+func RegisterScripts(s *redistest.Server) {
+	for _, sc := range []*script{incrByScript, windowScript, allowScript, acquireScript, releaseScript, refreshScript} {
+		s.RegisterScript(sc.src, redistest.ScriptFunc(sc.local))
+	}
+}
+
+// SetTimeNow 替换当前时间，返回恢复函数
+func SetTimeNow(fn func() time.Time) func() {
+	old := timeNow
+	timeNow = fn
+	return func() { timeNow = old }
+}
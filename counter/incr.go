@@ -0,0 +1,131 @@
+package counter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var incrByScript = newScript(`
+local v = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call('PTTL', KEYS[1]) == -1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return v
+`, func(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error) {
+	v, err := call("INCRBY", keys[0], args[0])
+	if err != nil {
+		return nil, err
+	}
+	if argInt(args, 1) > 0 {
+		pttl, err := call("PTTL", keys[0])
+		if err != nil {
+			return nil, err
+		}
+		if toInt(pttl) == -1 {
+			if _, err = call("PEXPIRE", keys[0], args[1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+})
+
+// 滑动窗口用相邻两个固定窗口近似：count = 当前窗口 + 上一个窗口 * 上一个窗口仍在滑动窗口内的比例
+var windowScript = newScript(`
+local cur = tonumber(redis.call('GET', KEYS[1]) or '0')
+if tonumber(ARGV[1]) > 0 then
+	cur = redis.call('INCRBY', KEYS[1], ARGV[1])
+	redis.call('PEXPIRE', KEYS[1], ARGV[2] * 2)
+end
+local prev = tonumber(redis.call('GET', KEYS[2]) or '0')
+return cur + math.floor(prev * (ARGV[2] - ARGV[3]) / ARGV[2])
+`, func(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error) {
+	v, err := call("GET", keys[0])
+	if err != nil {
+		return nil, err
+	}
+	cur := toInt(v)
+	window := argInt(args, 1)
+	if argInt(args, 0) > 0 {
+		v, err = call("INCRBY", keys[0], args[0])
+		if err != nil {
+			return nil, err
+		}
+		cur = toInt(v)
+		if _, err = call("PEXPIRE", keys[0], strconv.FormatInt(window*2, 10)); err != nil {
+			return nil, err
+		}
+	}
+	v, err = call("GET", keys[1])
+	if err != nil {
+		return nil, err
+	}
+	prev := toInt(v)
+	return cur + prev*(window-argInt(args, 2))/window, nil
+})
+
+// Incr 加1并返回新值，key第一次创建时设置过期时间，ttl<=0时不过期
+func (c *Counter) Incr(key string, ttl time.Duration) (int64, error) {
+	return c.IncrBy(key, 1, ttl)
+}
+
+// IncrBy 加n并返回新值，key第一次创建(或之前没有过期时间)时设置过期时间，ttl<=0时不过期
+func (c *Counter) IncrBy(key string, n int64, ttl time.Duration) (int64, error) {
+	if ttl < 0 {
+		ttl = 0
+	}
+	resp, err := c.run(incrByScript, []string{key}, []string{strconv.FormatInt(n, 10), ms(ttl)})
+	if err != nil {
+		return 0, err
+	}
+	return toResultInt(resp)
+}
+
+// WindowIncr 记录一次事件，返回最近window内的事件数
+func (c *Counter) WindowIncr(key string, window time.Duration) (int64, error) {
+	return c.WindowIncrBy(key, 1, window)
+}
+
+// WindowIncrBy 记录n次事件，返回最近window内的事件数(近似值)。
+// 用两个固定窗口近似滑动窗口，每个key只占两个计数器
+func (c *Counter) WindowIncrBy(key string, n int64, window time.Duration) (int64, error) {
+	if window < time.Millisecond {
+		return 0, errors.New("window too small")
+	}
+	if n < 0 {
+		return 0, errors.New("n must not be negative")
+	}
+	windowMs := int64(window / time.Millisecond)
+	nowMs := timeNow().UnixNano() / 1e6
+	idx := nowMs / windowMs
+
+	keys := []string{
+		fmt.Sprintf("%v:%v:%v", key, windowMs, idx),
+		fmt.Sprintf("%v:%v:%v", key, windowMs, idx-1),
+	}
+	args := []string{
+		strconv.FormatInt(n, 10),
+		strconv.FormatInt(windowMs, 10),
+		strconv.FormatInt(nowMs-idx*windowMs, 10),
+	}
+	resp, err := c.run(windowScript, keys, args)
+	if err != nil {
+		return 0, err
+	}
+	return toResultInt(resp)
+}
+
+// WindowCount 返回最近window内的事件数，不记录
+func (c *Counter) WindowCount(key string, window time.Duration) (int64, error) {
+	return c.WindowIncrBy(key, 0, window)
+}
+
+func toResultInt(resp interface{}) (int64, error) {
+	v, ok := resp.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected script result:%v", resp)
+	}
+	return v, nil
+}
@@ -0,0 +1,269 @@
+package counter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/logxxx/utils/runutil"
+	log "github.com/sirupsen/logrus"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// 分布式锁：SET key token PX ttl NX加锁，只有持有token的才能续期和释放。
+// 每次加锁成功时key的fence计数加1作为fencing token，
+// 下游存储可以拒绝比已见过的fence更小的写入，避免锁过期后旧持有者的写入覆盖新持有者。
+// EmptyCounter时锁在进程内存中，只能互斥同一进程内的调用方。
+// 三个lua脚本在设置REDIS_ADDR时由测试对真实redis执行，见counter_test.go。
+
+var (
+	ErrLockHeld = errors.New("lock held by others")
+	ErrLockLost = errors.New("lock lost")
+)
+
+const (
+	minLockRetry = 10 * time.Millisecond
+	maxLockRetry = 500 * time.Millisecond
+)
+
+var acquireScript = newScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2], 'NX') then
+	return redis.call('INCRBY', KEYS[2], 1)
+end
+return 0
+`, func(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error) {
+	ok, err := call("SET", keys[0], args[0], "PX", args[1], "NX")
+	if err != nil {
+		return nil, err
+	}
+	if ok == nil {
+		return int64(0), nil
+	}
+	return call("INCRBY", keys[1], "1")
+})
+
+var releaseScript = newScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`, func(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error) {
+	v, err := call("GET", keys[0])
+	if err != nil {
+		return nil, err
+	}
+	if v != args[0] {
+		return int64(0), nil
+	}
+	return call("DEL", keys[0])
+})
+
+var refreshScript = newScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`, func(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error) {
+	v, err := call("GET", keys[0])
+	if err != nil {
+		return nil, err
+	}
+	if v != args[0] {
+		return int64(0), nil
+	}
+	return call("PEXPIRE", keys[0], args[1])
+})
+
+// Lease 一次加锁的租约。加锁后自动每ttl/3续期一次，直到Unlock或续期失败
+type Lease struct {
+	c     *Counter
+	key   string
+	token string
+	ttl   time.Duration
+	Fence int64 // fencing token，同一个key每次加锁成功递增
+
+	lock     sync.Mutex
+	released bool
+	done     chan struct{}
+	stopCh   chan struct{}
+}
+
+func lockKey(key string) string {
+	return "lock:" + key
+}
+
+func fenceKey(key string) string {
+	return "lock:" + key + ":fence"
+}
+
+// Lock 加锁，锁被占用时等待直到加锁成功或ctx结束
+func (c *Counter) Lock(ctx context.Context, key string, ttl time.Duration) (*Lease, error) {
+	retry := minLockRetry
+	for {
+		lease, err := c.TryLock(key, ttl)
+		if err != ErrLockHeld {
+			return lease, err
+		}
+
+		timer := time.NewTimer(jitter(retry))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		retry *= 2
+		if retry > maxLockRetry {
+			retry = maxLockRetry
+		}
+	}
+}
+
+// TryLock 加锁，锁被占用时返回ErrLockHeld
+func (c *Counter) TryLock(key string, ttl time.Duration) (*Lease, error) {
+	if ttl < time.Millisecond {
+		return nil, errors.New("ttl too small")
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.run(acquireScript, []string{lockKey(key), fenceKey(key)}, []string{token, ms(ttl)})
+	if err != nil {
+		return nil, err
+	}
+	fence, err := toResultInt(resp)
+	if err != nil {
+		return nil, err
+	}
+	if fence == 0 {
+		return nil, ErrLockHeld
+	}
+
+	lease := &Lease{
+		c:      c,
+		key:    key,
+		token:  token,
+		ttl:    ttl,
+		Fence:  fence,
+		done:   make(chan struct{}),
+		stopCh: make(chan struct{}),
+	}
+	runutil.GoRunSafe(lease.renewLoop)
+
+	return lease, nil
+}
+
+// Refresh 续期为ttl，锁已经被其他人持有时返回ErrLockLost
+func (l *Lease) Refresh(ttl time.Duration) error {
+	resp, err := l.c.run(refreshScript, []string{lockKey(l.key)}, []string{l.token, ms(ttl)})
+	if err != nil {
+		return err
+	}
+	n, err := toResultInt(resp)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		l.finish()
+		return ErrLockLost
+	}
+	return nil
+}
+
+// Unlock 释放锁，锁已经过期并被其他人持有时返回ErrLockLost
+func (l *Lease) Unlock() error {
+	l.lock.Lock()
+	if l.released {
+		l.lock.Unlock()
+		return nil
+	}
+	l.released = true
+	close(l.stopCh)
+	l.lock.Unlock()
+
+	defer l.finish()
+
+	resp, err := l.c.run(releaseScript, []string{lockKey(l.key)}, []string{l.token})
+	if err != nil {
+		return err
+	}
+	n, err := toResultInt(resp)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// Done 锁被释放或丢失(续期失败)时关闭
+func (l *Lease) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *Lease) finish() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+}
+
+func (l *Lease) renewLoop() {
+	interval := l.ttl / 3
+	//最后一次续期成功后，锁在expireAt过期
+	expireAt := time.Now().Add(l.ttl)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopCh:
+			return
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+
+		err := l.Refresh(l.ttl)
+		if err == nil {
+			expireAt = time.Now().Add(l.ttl)
+			continue
+		}
+		if err == ErrLockLost {
+			log.Warnf("Lease renew lock lost. key:%v fence:%v", l.key, l.Fence)
+			return
+		}
+		log.Errorf("Lease renew err:%v key:%v fence:%v", err, l.key, l.Fence)
+		if time.Now().After(expireAt) {
+			l.finish()
+			return
+		}
+	}
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// jitter 返回[d/2, d)之间的随机时间，避免多个等待者同时重试
+func jitter(d time.Duration) time.Duration {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(d/2)+1))
+	if err != nil {
+		return d
+	}
+	return d/2 + time.Duration(n.Int64())
+}
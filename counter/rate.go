@@ -0,0 +1,112 @@
+package counter
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// GCRA(通用信元速率算法)：每个key只保存一个理论到达时间(tat，微秒)。
+// 每个请求让tat前进interval，tat超出当前时间不多于burst个interval时允许通过
+var allowScript = newScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local tolerance = interval * tonumber(ARGV[3])
+local tat = tonumber(redis.call('GET', KEYS[1]) or ARGV[1])
+if tat < now then
+	tat = now
+end
+local newTat = tat + interval * tonumber(ARGV[4])
+local allowAt = newTat - tolerance
+if now < allowAt then
+	return {0, math.floor((now - (tat - tolerance)) / interval), allowAt - now}
+end
+redis.call('SET', KEYS[1], string.format('%.0f', newTat), 'PX', math.ceil((newTat - now) / 1000))
+return {1, math.floor((now - allowAt) / interval), 0}
+`, func(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error) {
+	now := argInt(args, 0)
+	interval := argInt(args, 1)
+	tolerance := interval * argInt(args, 2)
+	v, err := call("GET", keys[0])
+	if err != nil {
+		return nil, err
+	}
+	tat := now
+	if v != nil {
+		tat = toInt(v)
+	}
+	if tat < now {
+		tat = now
+	}
+	newTat := tat + interval*argInt(args, 3)
+	allowAt := newTat - tolerance
+	if now < allowAt {
+		return []interface{}{int64(0), (now - (tat - tolerance)) / interval, allowAt - now}, nil
+	}
+	_, err = call("SET", keys[0], strconv.FormatInt(newTat, 10), "PX", strconv.FormatInt((newTat-now+999)/1000, 10))
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{int64(1), (now - allowAt) / interval, int64(0)}, nil
+})
+
+type RateResult struct {
+	Allowed    bool
+	Remaining  int64         // 现在还能通过的请求数
+	RetryAfter time.Duration // 不允许时，需要等待多久才能通过
+}
+
+// Allow 限流：平均每秒允许rate次，最多允许burst次突发
+func (c *Counter) Allow(key string, rate float64, burst int) (bool, error) {
+	result, err := c.AllowN(key, rate, burst, 1)
+	if err != nil {
+		return false, err
+	}
+	return result.Allowed, nil
+}
+
+// AllowN 一次请求n个配额，不允许时不消耗配额
+func (c *Counter) AllowN(key string, rate float64, burst int, n int) (*RateResult, error) {
+	if rate <= 0 {
+		return nil, errors.New("rate must be positive")
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	if n < 1 || n > burst {
+		return nil, fmt.Errorf("n:%v must be in [1, burst:%v]", n, burst)
+	}
+
+	interval := int64(math.Ceil(1e6 / rate))
+	args := []string{
+		strconv.FormatInt(timeNow().UnixNano()/1e3, 10),
+		strconv.FormatInt(interval, 10),
+		strconv.Itoa(burst),
+		strconv.Itoa(n),
+	}
+	resp, err := c.run(allowScript, []string{key}, args)
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := resp.([]interface{})
+	if !ok || len(values) != 3 {
+		return nil, fmt.Errorf("unexpected script result:%v", resp)
+	}
+	ints := make([]int64, 0, len(values))
+	for _, v := range values {
+		i, err := toResultInt(v)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, i)
+	}
+
+	return &RateResult{
+		Allowed:    ints[0] == 1,
+		Remaining:  ints[1],
+		RetryAfter: time.Duration(ints[2]) * time.Microsecond,
+	}, nil
+}
@@ -0,0 +1,534 @@
+// Package redistest 进程内的redis替身，实现了本仓库用到的RESP命令，
+// 用于在没有redis的环境下测试counter及依赖它的包。
+package redistest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	value    string
+	expireAt time.Time // 为0表示不过期
+}
+
+// ScriptFunc lua脚本在替身中的等价实现。call执行一条redis命令，
+// 返回值与lua中redis.call的结果对应：整数为int64，字符串为string，不存在为nil
+type ScriptFunc func(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error)
+
+type Server struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	lock    sync.Mutex
+	dbs     map[int64]map[string]*entry
+	offset  time.Duration // FastForward累计的时间
+	conns   map[net.Conn]bool
+	isClose bool
+
+	scripts map[string]ScriptFunc // k:sha1
+	loaded  map[string]bool       // 已经EVAL或SCRIPT LOAD过的sha1
+}
+
+// NewServer 在127.0.0.1的随机端口上启动
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener: l,
+		dbs:      make(map[int64]map[string]*entry),
+		conns:    make(map[net.Conn]bool),
+		scripts:  make(map[string]ScriptFunc),
+		loaded:   make(map[string]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Close() error {
+	s.lock.Lock()
+	s.isClose = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+// FastForward 让所有key的过期时间提前d，用于测试过期
+func (s *Server) FastForward(d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.offset += d
+}
+
+// RegisterScript 替身不能执行lua，EVAL/EVALSHA时执行src对应的fn
+func (s *Server) RegisterScript(src string, fn ScriptFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.scripts[scriptSha(src)] = fn
+}
+
+func scriptSha(src string) string {
+	h := sha1.Sum([]byte(src))
+	return hex.EncodeToString(h[:])
+}
+
+// Keys 返回db中所有未过期的key
+func (s *Server) Keys(db int64) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := make([]string, 0)
+	for k := range s.db(db) {
+		if s.get(db, k) != nil {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		if s.isClose {
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.lock.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	c := &client{}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		reply := s.exec(c, args)
+		writeReply(w, reply)
+		if err = w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// client 连接的状态
+type client struct {
+	db int64
+}
+
+type statusReply string
+
+type errorReply string
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		//inline命令
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("bad bulk:%v", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case statusReply:
+		w.WriteString("+" + string(v) + "\r\n")
+	case errorReply:
+		w.WriteString("-" + string(v) + "\r\n")
+	case error:
+		w.WriteString("-ERR " + v.Error() + "\r\n")
+	case int:
+		w.WriteString(":" + strconv.Itoa(v) + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case bool:
+		if v {
+			w.WriteString(":1\r\n")
+		} else {
+			w.WriteString(":0\r\n")
+		}
+	case string:
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n")
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, elem := range v {
+			writeReply(w, elem)
+		}
+	case []string:
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, elem := range v {
+			writeReply(w, elem)
+		}
+	default:
+		w.WriteString("-ERR unsupported reply type\r\n")
+	}
+}
+
+var (
+	errWrongArgs = errors.New("wrong number of arguments")
+	errNotInt    = errors.New("value is not an integer or out of range")
+	errSyntax    = errors.New("syntax error")
+)
+
+func (s *Server) exec(c *client, args []string) interface{} {
+	if len(args) == 0 {
+		return errors.New("empty command")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.execLocked(c, args)
+}
+
+func (s *Server) execLocked(c *client, args []string) interface{} {
+
+	cmd := strings.ToUpper(args[0])
+	args = args[1:]
+
+	switch cmd {
+	case "PING":
+		return statusReply("PONG")
+	case "AUTH":
+		return statusReply("OK")
+	case "SELECT":
+		if len(args) != 1 {
+			return errWrongArgs
+		}
+		db, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return errNotInt
+		}
+		c.db = db
+		return statusReply("OK")
+	case "FLUSHDB":
+		delete(s.dbs, c.db)
+		return statusReply("OK")
+	case "FLUSHALL":
+		s.dbs = make(map[int64]map[string]*entry)
+		return statusReply("OK")
+	}
+
+	if len(args) == 0 {
+		return errWrongArgs
+	}
+
+	switch cmd {
+	case "GET":
+		e := s.get(c.db, args[0])
+		if e == nil {
+			return nil
+		}
+		return e.value
+	case "SET":
+		return s.cmdSet(c.db, args)
+	case "SETNX":
+		if len(args) != 2 {
+			return errWrongArgs
+		}
+		if s.get(c.db, args[0]) != nil {
+			return 0
+		}
+		s.db(c.db)[args[0]] = &entry{value: args[1]}
+		return 1
+	case "DEL":
+		count := 0
+		for _, key := range args {
+			if s.get(c.db, key) != nil {
+				count++
+			}
+			delete(s.db(c.db), key)
+		}
+		return count
+	case "EXISTS":
+		count := 0
+		for _, key := range args {
+			if s.get(c.db, key) != nil {
+				count++
+			}
+		}
+		return count
+	case "EXPIRE", "PEXPIRE":
+		if len(args) != 2 {
+			return errWrongArgs
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errNotInt
+		}
+		e := s.get(c.db, args[0])
+		if e == nil {
+			return 0
+		}
+		unit := time.Second
+		if cmd == "PEXPIRE" {
+			unit = time.Millisecond
+		}
+		e.expireAt = s.now().Add(time.Duration(n) * unit)
+		return 1
+	case "TTL", "PTTL":
+		e := s.get(c.db, args[0])
+		if e == nil {
+			return -2
+		}
+		if e.expireAt.IsZero() {
+			return -1
+		}
+		d := e.expireAt.Sub(s.now())
+		if cmd == "PTTL" {
+			return int64(d / time.Millisecond)
+		}
+		return int64((d + time.Second - 1) / time.Second)
+	case "EVAL", "EVALSHA":
+		sha := args[0]
+		if cmd == "EVAL" {
+			sha = scriptSha(args[0])
+			s.loaded[sha] = true
+		}
+		return s.evalSha(c, sha, args[1:])
+	case "SCRIPT":
+		switch strings.ToUpper(args[0]) {
+		case "LOAD":
+			if len(args) != 2 {
+				return errWrongArgs
+			}
+			sha := scriptSha(args[1])
+			s.loaded[sha] = true
+			return sha
+		case "EXISTS":
+			result := make([]interface{}, 0, len(args)-1)
+			for _, sha := range args[1:] {
+				result = append(result, s.loaded[sha])
+			}
+			return result
+		case "FLUSH":
+			s.loaded = make(map[string]bool)
+			return statusReply("OK")
+		}
+		return errSyntax
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		by := int64(1)
+		if cmd == "INCRBY" || cmd == "DECRBY" {
+			if len(args) != 2 {
+				return errWrongArgs
+			}
+			n, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return errNotInt
+			}
+			by = n
+		}
+		if strings.HasPrefix(cmd, "DECR") {
+			by = -by
+		}
+		return s.incrBy(c.db, args[0], by)
+	}
+
+	return fmt.Errorf("unknown command '%v'", strings.ToLower(cmd))
+}
+
+func (s *Server) evalSha(c *client, sha string, args []string) interface{} {
+	if !s.loaded[sha] {
+		return errorReply("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	fn, ok := s.scripts[sha]
+	if !ok {
+		return fmt.Errorf("script %v not registered in stand-in", sha)
+	}
+	if len(args) == 0 {
+		return errWrongArgs
+	}
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil || numKeys < 0 || numKeys > len(args)-1 {
+		return errors.New("number of keys can't be greater than number of args")
+	}
+	keys, argv := args[1:1+numKeys], args[1+numKeys:]
+
+	//脚本中的命令与脚本在同一个锁内执行，与redis一样是原子的
+	call := func(cmdArgs ...string) (interface{}, error) {
+		if len(cmdArgs) == 0 {
+			return nil, errWrongArgs
+		}
+		switch v := s.execLocked(c, cmdArgs).(type) {
+		case int:
+			return int64(v), nil
+		case bool:
+			if v {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		case statusReply:
+			return string(v), nil
+		case errorReply:
+			return nil, errors.New(string(v))
+		case error:
+			return nil, v
+		default:
+			return v, nil
+		}
+	}
+
+	result, err := fn(call, keys, argv)
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+func (s *Server) cmdSet(db int64, args []string) interface{} {
+	if len(args) < 2 {
+		return errWrongArgs
+	}
+	key, value := args[0], args[1]
+	var expireAt time.Time
+	nx, xx := false, false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return errNotInt
+			}
+			unit := time.Second
+			if strings.ToUpper(args[i]) == "PX" {
+				unit = time.Millisecond
+			}
+			expireAt = s.now().Add(time.Duration(n) * unit)
+			i++
+		default:
+			return errSyntax
+		}
+	}
+
+	exists := s.get(db, key) != nil
+	if (nx && exists) || (xx && !exists) {
+		return nil
+	}
+	s.db(db)[key] = &entry{value: value, expireAt: expireAt}
+	return statusReply("OK")
+}
+
+func (s *Server) incrBy(db int64, key string, by int64) interface{} {
+	e := s.get(db, key)
+	if e == nil {
+		e = &entry{value: "0"}
+		s.db(db)[key] = e
+	}
+	n, err := strconv.ParseInt(e.value, 10, 64)
+	if err != nil {
+		return errNotInt
+	}
+	n += by
+	e.value = strconv.FormatInt(n, 10)
+	return n
+}
+
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.offset)
+}
+
+func (s *Server) db(db int64) map[string]*entry {
+	m, ok := s.dbs[db]
+	if !ok {
+		m = make(map[string]*entry)
+		s.dbs[db] = m
+	}
+	return m
+}
+
+// get 返回未过期的entry，已过期的顺便删除
+func (s *Server) get(db int64, key string) *entry {
+	m := s.db(db)
+	e, ok := m[key]
+	if !ok {
+		return nil
+	}
+	if !e.expireAt.IsZero() && !e.expireAt.After(s.now()) {
+		delete(m, key)
+		return nil
+	}
+	return e
+}
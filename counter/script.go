@@ -0,0 +1,199 @@
+package counter
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/redis.v3"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 计数、窗口、限流都由lua脚本在redis中原子地完成。
+// 每个脚本都有一个go实现(local)，EmptyCounter时在内存中执行，用于离线运行。
+// 两者的一致性只靠测试保证：redis替身执行的是go实现，
+// 设置REDIS_ADDR后测试会对真实redis执行lua脚本，修改脚本时两边都要跑。
+
+var timeNow = time.Now
+
+type script struct {
+	src string
+	lua *redis.Script
+	// local 离线时代替lua执行的go实现，call对应redis.call，返回值的约定见memStore.call
+	local func(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error)
+}
+
+func newScript(src string, local func(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error)) *script {
+	return &script{src: src, lua: redis.NewScript(src), local: local}
+}
+
+// run 执行脚本，返回值为int64或[]interface{}
+func (c *Counter) run(s *script, keys, args []string) (interface{}, error) {
+	if c.mem != nil {
+		return c.mem.run(s, keys, args)
+	}
+	return s.lua.Run(c.Client, keys, args).Result()
+}
+
+type memEntry struct {
+	value    string
+	expireAt time.Time
+}
+
+// memStore 内存中的redis子集，只实现脚本用到的命令
+type memStore struct {
+	lock sync.Mutex
+	data map[string]*memEntry
+	runs int
+}
+
+func newMemStore() *memStore {
+	return &memStore{data: make(map[string]*memEntry)}
+}
+
+func (m *memStore) run(s *script, keys, args []string) (interface{}, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	//定期清理过期的key，避免不再访问的窗口计数一直占用内存
+	m.runs++
+	if m.runs%1024 == 0 {
+		for key := range m.data {
+			m.get(key)
+		}
+	}
+
+	return s.local(m.call, keys, args)
+}
+
+func (m *memStore) get(key string) *memEntry {
+	e, ok := m.data[key]
+	if !ok {
+		return nil
+	}
+	if !e.expireAt.IsZero() && !e.expireAt.After(timeNow()) {
+		delete(m.data, key)
+		return nil
+	}
+	return e
+}
+
+// call 执行一条命令，需要持有lock。
+// 返回值与lua中redis.call一致：整数为int64，字符串为string，不存在为nil
+func (m *memStore) call(args ...string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, errors.New("wrong number of arguments")
+	}
+	cmd, key := strings.ToUpper(args[0]), args[1]
+	switch cmd {
+	case "GET":
+		e := m.get(key)
+		if e == nil {
+			return nil, nil
+		}
+		return e.value, nil
+	case "SET":
+		// SET key value [PX ms] [NX]
+		if len(args) < 3 {
+			return nil, errors.New("wrong number of arguments")
+		}
+		e := &memEntry{value: args[2]}
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if m.get(key) != nil {
+					return nil, nil
+				}
+			case "PX":
+				if i+1 >= len(args) {
+					return nil, errors.New("syntax error")
+				}
+				ms, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				e.expireAt = timeNow().Add(time.Duration(ms) * time.Millisecond)
+				i++
+			default:
+				return nil, errors.New("syntax error")
+			}
+		}
+		m.data[key] = e
+		return "OK", nil
+	case "INCRBY":
+		if len(args) != 3 {
+			return nil, errors.New("wrong number of arguments")
+		}
+		by, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		e := m.get(key)
+		if e == nil {
+			e = &memEntry{value: "0"}
+			m.data[key] = e
+		}
+		n, err := strconv.ParseInt(e.value, 10, 64)
+		if err != nil {
+			return nil, errors.New("value is not an integer or out of range")
+		}
+		n += by
+		e.value = strconv.FormatInt(n, 10)
+		return n, nil
+	case "PEXPIRE":
+		if len(args) != 3 {
+			return nil, errors.New("wrong number of arguments")
+		}
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		e := m.get(key)
+		if e == nil {
+			return int64(0), nil
+		}
+		e.expireAt = timeNow().Add(time.Duration(ms) * time.Millisecond)
+		return int64(1), nil
+	case "PTTL":
+		e := m.get(key)
+		if e == nil {
+			return int64(-2), nil
+		}
+		if e.expireAt.IsZero() {
+			return int64(-1), nil
+		}
+		return int64(e.expireAt.Sub(timeNow()) / time.Millisecond), nil
+	case "DEL":
+		count := int64(0)
+		for _, k := range args[1:] {
+			if m.get(k) != nil {
+				count++
+			}
+			delete(m.data, k)
+		}
+		return count, nil
+	}
+	return nil, fmt.Errorf("unknown command '%v'", strings.ToLower(cmd))
+}
+
+// toInt 与lua中的tonumber(x or '0')一致
+func toInt(v interface{}) int64 {
+	switch vv := v.(type) {
+	case int64:
+		return vv
+	case string:
+		n, _ := strconv.ParseInt(vv, 10, 64)
+		return n
+	}
+	return 0
+}
+
+func argInt(args []string, i int) int64 {
+	n, _ := strconv.ParseInt(args[i], 10, 64)
+	return n
+}
+
+func ms(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
+}
@@ -0,0 +1,197 @@
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"github.com/logxxx/utils/counter"
+	"github.com/logxxx/utils/exist"
+	"github.com/logxxx/utils/filekv"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// Deduper 判断key是否出现过。
+// counter.Counter.IsExist和exist.Exister.Has是同一个语义(SeenOrMark)，这里统一成一个接口
+type Deduper interface {
+	// SeenOrMark 返回key是否出现过，没出现过时标记为出现过
+	SeenOrMark(key string) (bool, error)
+	// Seen 返回key是否出现过，不标记
+	Seen(key string) (bool, error)
+	// Forget 取消标记，key没出现过时忽略
+	Forget(key string) error
+}
+
+var ErrNotSupported = errors.New("not supported")
+
+// DefaultTTL 与counter.Counter.IsExist一致
+const DefaultTTL = 7 * 24 * time.Hour
+
+type redisDeduper struct {
+	counter *counter.Counter
+	prefix  string
+	ttl     time.Duration
+}
+
+// NewRedisDeduper 用redis的SET NX实现，key为prefix+key，ttl<=0时不过期
+func NewRedisDeduper(c *counter.Counter, prefix string, ttl time.Duration) Deduper {
+	return &redisDeduper{counter: c, prefix: prefix, ttl: ttl}
+}
+
+func (d *redisDeduper) SeenOrMark(key string) (bool, error) {
+	ttl := d.ttl
+	if ttl < 0 {
+		ttl = 0
+	}
+	ok, err := d.counter.SetNX(d.prefix+key, time.Now().Unix(), ttl).Result()
+	if err != nil {
+		return false, err
+	}
+	return !ok, nil //设置成功->不存在
+}
+
+func (d *redisDeduper) Seen(key string) (bool, error) {
+	return d.counter.Exists(d.prefix + key).Result()
+}
+
+func (d *redisDeduper) Forget(key string) error {
+	return d.counter.Del(d.prefix + key).Err()
+}
+
+type existDeduper struct {
+	exister exist.IExister
+	ttl     time.Duration
+}
+
+// NewExistDeduper 用本地文件实现。
+// exister为exist.Exister时支持ttl和Forget，为BloomExister时Forget返回ErrNotSupported
+func NewExistDeduper(exister exist.IExister, ttl time.Duration) Deduper {
+	return &existDeduper{exister: exister, ttl: ttl}
+}
+
+func (d *existDeduper) SeenOrMark(key string) (bool, error) {
+	if e, ok := d.exister.(interface {
+		Mark(key string, ttl time.Duration) (bool, error)
+	}); ok {
+		return e.Mark(key, d.ttl)
+	}
+	return d.exister.Has(key), nil
+}
+
+func (d *existDeduper) Seen(key string) (bool, error) {
+	return d.exister.Peek(key), nil
+}
+
+func (d *existDeduper) Forget(key string) error {
+	if e, ok := d.exister.(interface {
+		Remove(key string) error
+	}); ok {
+		return e.Remove(key)
+	}
+	return ErrNotSupported
+}
+
+type fileKVDeduper struct {
+	kv       *filekv.FileKV
+	fileName string
+	ttl      time.Duration
+}
+
+// NewFileKVDeduper 用FileKV.SetNX实现，可以多进程共享fileName
+func NewFileKVDeduper(kv *filekv.FileKV, fileName string, ttl time.Duration) Deduper {
+	return &fileKVDeduper{kv: kv, fileName: fileName, ttl: ttl}
+}
+
+func (d *fileKVDeduper) SeenOrMark(key string) (bool, error) {
+	ok, err := d.kv.SetNX(d.fileName, key, time.Now().Unix(), d.ttl)
+	if err != nil {
+		return false, err
+	}
+	return !ok, nil
+}
+
+func (d *fileKVDeduper) Seen(key string) (bool, error) {
+	var markTime int64
+	err := d.kv.MustGet(d.fileName, key, &markTime)
+	if err == filekv.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *fileKVDeduper) Forget(key string) error {
+	return d.kv.Delete(d.fileName, key)
+}
+
+type tieredDeduper struct {
+	local  Deduper
+	remote Deduper
+}
+
+// NewTieredDeduper 先查本地，本地没有时再查远端(一般是redis)。
+// 本地只是远端的缓存：远端出错时不会标记本地，避免远端漏记
+func NewTieredDeduper(local, remote Deduper) Deduper {
+	return &tieredDeduper{local: local, remote: remote}
+}
+
+func (d *tieredDeduper) SeenOrMark(key string) (bool, error) {
+	seen, err := d.local.Seen(key)
+	if err != nil {
+		log.Errorf("tieredDeduper.SeenOrMark local Seen err:%v key:%v", err, key)
+	}
+	if seen {
+		return true, nil
+	}
+
+	seen, err = d.remote.SeenOrMark(key)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = d.local.SeenOrMark(key)
+	if err != nil {
+		log.Errorf("tieredDeduper.SeenOrMark local SeenOrMark err:%v key:%v", err, key)
+	}
+
+	return seen, nil
+}
+
+func (d *tieredDeduper) Seen(key string) (bool, error) {
+	seen, err := d.local.Seen(key)
+	if err != nil {
+		log.Errorf("tieredDeduper.Seen local Seen err:%v key:%v", err, key)
+	}
+	if seen {
+		return true, nil
+	}
+
+	seen, err = d.remote.Seen(key)
+	if err != nil || !seen {
+		return false, err
+	}
+
+	//远端有本地没有，补到本地
+	_, err = d.local.SeenOrMark(key)
+	if err != nil {
+		log.Errorf("tieredDeduper.Seen local SeenOrMark err:%v key:%v", err, key)
+	}
+	return true, nil
+}
+
+// Forget 先取消远端的标记(以远端为准)，再取消本地的标记。
+// 本地不支持Forget时(如BloomExister)远端已经取消，返回包装了ErrNotSupported的错误，
+// 此时这个进程的Seen/SeenOrMark仍然会因为本地的标记返回true
+func (d *tieredDeduper) Forget(key string) error {
+	err := d.remote.Forget(key)
+	if err != nil {
+		return err
+	}
+
+	err = d.local.Forget(key)
+	if err != nil {
+		return fmt.Errorf("remote forgotten, but local: %w", err)
+	}
+	return nil
+}
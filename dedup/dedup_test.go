@@ -0,0 +1,144 @@
+package dedup_test
+
+import (
+	"errors"
+	"github.com/logxxx/utils/counter"
+	"github.com/logxxx/utils/counter/redistest"
+	"github.com/logxxx/utils/dedup"
+	"github.com/logxxx/utils/exist"
+	"github.com/logxxx/utils/filekv"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newRedis(t *testing.T) (*redistest.Server, *counter.Counter) {
+	s, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	c, err := counter.NewCounter(s.Addr(), "pwd", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return s, c
+}
+
+func testDeduper(t *testing.T, name string, d dedup.Deduper) {
+
+	seen, err := d.Seen("a")
+	assert.Nil(t, err, name)
+	assert.False(t, seen, name)
+
+	seen, err = d.SeenOrMark("a")
+	assert.Nil(t, err, name)
+	assert.False(t, seen, name)
+
+	seen, err = d.SeenOrMark("a")
+	assert.Nil(t, err, name)
+	assert.True(t, seen, name)
+
+	seen, err = d.Seen("a")
+	assert.Nil(t, err, name)
+	assert.True(t, seen, name)
+
+	assert.Nil(t, d.Forget("a"), name)
+	assert.Nil(t, d.Forget("missing"), name)
+
+	seen, err = d.Seen("a")
+	assert.Nil(t, err, name)
+	assert.False(t, seen, name)
+}
+
+func TestDeduper(t *testing.T) {
+
+	dir := t.TempDir()
+	_, c := newRedis(t)
+
+	exister, err := exist.OpenExister(filepath.Join(dir, "exist.txt"))
+	assert.Nil(t, err)
+	defer exister.Close()
+
+	testDeduper(t, "redis", dedup.NewRedisDeduper(c, "dedup:", dedup.DefaultTTL))
+	testDeduper(t, "exist", dedup.NewExistDeduper(exister, 0))
+	testDeduper(t, "filekv", dedup.NewFileKVDeduper(filekv.NewFileKV(), filepath.Join(dir, "kv.json"), time.Hour))
+
+	local, err := exist.OpenExister(filepath.Join(dir, "local.txt"))
+	assert.Nil(t, err)
+	defer local.Close()
+	testDeduper(t, "tiered", dedup.NewTieredDeduper(dedup.NewExistDeduper(local, 0), dedup.NewRedisDeduper(c, "tiered:", 0)))
+}
+
+func TestRedisDeduper_TTL(t *testing.T) {
+
+	s, c := newRedis(t)
+	d := dedup.NewRedisDeduper(c, "ttl:", time.Minute)
+
+	seen, err := d.SeenOrMark("a")
+	assert.Nil(t, err)
+	assert.False(t, seen)
+	assert.Equal(t, []string{"ttl:a"}, s.Keys(1))
+
+	s.FastForward(2 * time.Minute)
+	seen, err = d.SeenOrMark("a")
+	assert.Nil(t, err)
+	assert.False(t, seen)
+}
+
+func TestTieredDeduper(t *testing.T) {
+
+	dir := t.TempDir()
+	s, c := newRedis(t)
+
+	newLocal := func(name string) dedup.Deduper {
+		e, err := exist.OpenExister(filepath.Join(dir, name))
+		assert.Nil(t, err)
+		t.Cleanup(func() { e.Close() })
+		return dedup.NewExistDeduper(e, 0)
+	}
+
+	//两个进程各自有本地缓存，共享redis
+	remote := dedup.NewRedisDeduper(c, "tiered:", 0)
+	d1 := dedup.NewTieredDeduper(newLocal("1.txt"), remote)
+	d2 := dedup.NewTieredDeduper(newLocal("2.txt"), remote)
+
+	seen, err := d1.SeenOrMark("a")
+	assert.Nil(t, err)
+	assert.False(t, seen)
+
+	seen, err = d2.SeenOrMark("a")
+	assert.Nil(t, err)
+	assert.True(t, seen)
+
+	//本地命中时不再访问redis
+	s.Close()
+	seen, err = d1.SeenOrMark("a")
+	assert.Nil(t, err)
+	assert.True(t, seen)
+
+	//redis不可用时返回错误，且不标记本地
+	_, err = d1.SeenOrMark("b")
+	assert.NotNil(t, err)
+	seen, err = newLocal("1.txt").Seen("b")
+	assert.Nil(t, err)
+	assert.False(t, seen)
+
+	//本地不支持Forget时仍然取消远端的标记
+	_, c2 := newRedis(t)
+	remote2 := dedup.NewRedisDeduper(c2, "tiered:", 0)
+	bloom, err := exist.NewBloomExister(filepath.Join(dir, "bloom.bin"), 100, 0.01)
+	assert.Nil(t, err)
+	defer bloom.Close()
+	d3 := dedup.NewTieredDeduper(dedup.NewExistDeduper(bloom, 0), remote2)
+	_, err = d3.SeenOrMark("a")
+	assert.Nil(t, err)
+	err = d3.Forget("a")
+	assert.True(t, errors.Is(err, dedup.ErrNotSupported), "%v", err)
+	seen, err = remote2.Seen("a")
+	assert.Nil(t, err)
+	assert.False(t, seen)
+}
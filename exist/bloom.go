@@ -0,0 +1,398 @@
+package exist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/logxxx/utils/fileutil"
+	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BloomExister 用可扩展的布隆过滤器判断key是否存在，内存只与key的数量和误判率有关，与key的长度无关。
+// 不存在的key可能被误判为存在(概率约为fpRate)，存在的key不会被误判为不存在；不支持删除和过期。
+//
+// 持久化：
+//
+//	filePath      过滤器的快照
+//	filePath.log  快照之后新增的key，每行一个，加载时重放
+//
+// key中有\r、\n或以"开头时，log中的key用strconv.Quote转义，与Exister一致。空key不记录。
+//
+// 新增的key达到snapshotEvery条或Sync/Close时写入快照并清空log。
+//
+// 可扩展：当前过滤器写满后新建一个容量翻倍、误判率减半的过滤器，
+// 总误判率不超过fpRate。
+
+const (
+	bloomMagic           = "BLM1"
+	bloomGrowth          = 2
+	bloomTightening      = 0.5
+	defaultSnapshotEvery = 100000
+)
+
+var ErrBloomFile = errors.New("invalid bloom file")
+
+type BloomExister struct {
+	FilePath string
+
+	lock          sync.Mutex
+	capacity      uint64  // 第一个过滤器的容量
+	fpRate        float64 // 总误判率
+	filters       []*bloomFilter
+	logFile       *os.File
+	logLines      int
+	snapshotEvery int
+	isClosed      bool
+}
+
+type bloomFilter struct {
+	k        uint32
+	m        uint64 // bit数
+	count    uint64
+	capacity uint64
+	bits     []uint64
+}
+
+// NewBloomExister 打开或创建filePath，capacity为预计的key数量，超过后自动扩展。
+// 文件已存在时使用文件中记录的capacity和fpRate
+func NewBloomExister(filePath string, capacity int, fpRate float64) (*BloomExister, error) {
+
+	if capacity <= 0 {
+		capacity = 1000000
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		return nil, fmt.Errorf("invalid fpRate:%v", fpRate)
+	}
+
+	e := &BloomExister{
+		FilePath:      filePath,
+		capacity:      uint64(capacity),
+		fpRate:        fpRate,
+		snapshotEvery: defaultSnapshotEvery,
+	}
+
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.replayLog()
+	if err != nil {
+		return nil, err
+	}
+
+	e.logFile, err = os.OpenFile(e.logName(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// SetSnapshotEvery 设置新增多少个key后写一次快照
+func (e *BloomExister) SetSnapshotEvery(n int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if n <= 0 {
+		n = defaultSnapshotEvery
+	}
+	e.snapshotEvery = n
+}
+
+func (e *BloomExister) logName() string {
+	return e.FilePath + ".log"
+}
+
+// Has 返回key是否已存在，不存在时写入
+func (e *BloomExister) Has(key string) bool {
+	if key == "" {
+		return false
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	h1, h2 := bloomHash(key)
+	if e.test(h1, h2) {
+		return true
+	}
+	e.add(h1, h2)
+
+	err := e.writeLog(key)
+	if err != nil {
+		log.Errorf("BloomExister.Has writeLog err:%v key:%v filePath:%v", err, key, e.FilePath)
+	}
+	return false
+}
+
+// Peek 返回key是否存在，不写入
+func (e *BloomExister) Peek(key string) bool {
+	if key == "" {
+		return false
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	h1, h2 := bloomHash(key)
+	return e.test(h1, h2)
+}
+
+// Len 返回写入过的key数量(不包括被误判为已存在的)
+func (e *BloomExister) Len() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	count := uint64(0)
+	for _, f := range e.filters {
+		count += f.count
+	}
+	return int(count)
+}
+
+// MemBytes 返回过滤器占用的内存
+func (e *BloomExister) MemBytes() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	size := 0
+	for _, f := range e.filters {
+		size += len(f.bits) * 8
+	}
+	return size
+}
+
+// Sync 写入快照并清空log
+func (e *BloomExister) Sync() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.isClosed {
+		return ErrClosed
+	}
+	return e.snapshot()
+}
+
+func (e *BloomExister) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.isClosed {
+		return nil
+	}
+	err := e.snapshot()
+	e.isClosed = true
+	e.logFile.Close()
+	return err
+}
+
+func (e *BloomExister) test(h1, h2 uint64) bool {
+	for _, f := range e.filters {
+		if f.test(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *BloomExister) add(h1, h2 uint64) {
+	if len(e.filters) == 0 || e.filters[len(e.filters)-1].count >= e.filters[len(e.filters)-1].capacity {
+		i := len(e.filters)
+		capacity := e.capacity * uint64(math.Pow(bloomGrowth, float64(i)))
+		fpRate := e.fpRate * (1 - bloomTightening) * math.Pow(bloomTightening, float64(i))
+		e.filters = append(e.filters, newBloomFilter(capacity, fpRate))
+	}
+	e.filters[len(e.filters)-1].add(h1, h2)
+}
+
+func (e *BloomExister) writeLog(key string) error {
+	if e.isClosed {
+		return ErrClosed
+	}
+	if strings.ContainsAny(key, "\r\n") || strings.HasPrefix(key, `"`) {
+		key = strconv.Quote(key)
+	}
+	_, err := e.logFile.WriteString(key + "\n")
+	if err != nil {
+		return err
+	}
+	e.logLines++
+	if e.logLines >= e.snapshotEvery {
+		return e.snapshot()
+	}
+	return nil
+}
+
+func (e *BloomExister) replayLog() error {
+	f, err := os.Open(e.logName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		key := line[:len(line)-1]
+		if key == "" {
+			continue
+		}
+		if strings.HasPrefix(key, `"`) {
+			//旧版本未转义的key无法解析时按原样使用
+			if unquoted, err := strconv.Unquote(key); err == nil {
+				key = unquoted
+			}
+		}
+		h1, h2 := bloomHash(key)
+		if !e.test(h1, h2) {
+			e.add(h1, h2)
+		}
+		e.logLines++
+	}
+	return nil
+}
+
+// snapshot 原子地写入快照后清空log。快照写入后、清空log前崩溃时，重放log是幂等的
+func (e *BloomExister) snapshot() error {
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(bloomMagic)
+	binary.Write(buf, binary.LittleEndian, e.fpRate)
+	binary.Write(buf, binary.LittleEndian, e.capacity)
+	binary.Write(buf, binary.LittleEndian, uint32(len(e.filters)))
+	for _, f := range e.filters {
+		binary.Write(buf, binary.LittleEndian, f.k)
+		binary.Write(buf, binary.LittleEndian, f.m)
+		binary.Write(buf, binary.LittleEndian, f.count)
+		binary.Write(buf, binary.LittleEndian, f.capacity)
+		binary.Write(buf, binary.LittleEndian, f.bits)
+	}
+
+	err := fileutil.WriteToFileAtomic(buf.Bytes(), e.FilePath, true)
+	if err != nil {
+		log.Errorf("BloomExister.snapshot WriteToFileAtomic err:%v filePath:%v", err, e.FilePath)
+		return err
+	}
+
+	err = e.logFile.Truncate(0)
+	if err != nil {
+		log.Errorf("BloomExister.snapshot Truncate log err:%v filePath:%v", err, e.FilePath)
+		return err
+	}
+	e.logLines = 0
+
+	return nil
+}
+
+func (e *BloomExister) loadSnapshot() error {
+
+	content, err := ioutil.ReadFile(e.FilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	r := bytes.NewReader(content)
+	magic := make([]byte, len(bloomMagic))
+	if _, err = io.ReadFull(r, magic); err != nil || string(magic) != bloomMagic {
+		return fmt.Errorf("%w: bad magic filePath:%v", ErrBloomFile, e.FilePath)
+	}
+
+	var fpRate float64
+	var capacity uint64
+	var count uint32
+	for _, v := range []interface{}{&fpRate, &capacity, &count} {
+		if err = binary.Read(r, binary.LittleEndian, v); err != nil {
+			return fmt.Errorf("%w: read header err:%v filePath:%v", ErrBloomFile, err, e.FilePath)
+		}
+	}
+	if fpRate != e.fpRate || capacity != e.capacity {
+		log.Infof("BloomExister use params in file. filePath:%v fpRate:%v capacity:%v", e.FilePath, fpRate, capacity)
+	}
+	e.fpRate = fpRate
+	e.capacity = capacity
+
+	filters := make([]*bloomFilter, 0, count)
+	for i := uint32(0); i < count; i++ {
+		f := &bloomFilter{}
+		for _, v := range []interface{}{&f.k, &f.m, &f.count, &f.capacity} {
+			if err = binary.Read(r, binary.LittleEndian, v); err != nil {
+				return fmt.Errorf("%w: read filter err:%v filePath:%v", ErrBloomFile, err, e.FilePath)
+			}
+		}
+		words := (f.m + 63) / 64
+		if f.k == 0 || f.m == 0 || words*8 > uint64(r.Len()) {
+			return fmt.Errorf("%w: bad filter k:%v m:%v filePath:%v", ErrBloomFile, f.k, f.m, e.FilePath)
+		}
+		f.bits = make([]uint64, words)
+		if err = binary.Read(r, binary.LittleEndian, f.bits); err != nil {
+			return fmt.Errorf("%w: read bits err:%v filePath:%v", ErrBloomFile, err, e.FilePath)
+		}
+		filters = append(filters, f)
+	}
+	e.filters = filters
+
+	return nil
+}
+
+func newBloomFilter(capacity uint64, fpRate float64) *bloomFilter {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint32(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		k:        k,
+		m:        m,
+		capacity: capacity,
+		bits:     make([]uint64, (m+63)/64),
+	}
+}
+
+func (f *bloomFilter) add(h1, h2 uint64) {
+	for i := uint64(0); i < uint64(f.k); i++ {
+		idx := (h1 + i*h2) % f.m
+		f.bits[idx/64] |= 1 << (idx % 64)
+	}
+	f.count++
+}
+
+func (f *bloomFilter) test(h1, h2 uint64) bool {
+	for i := uint64(0); i < uint64(f.k); i++ {
+		idx := (h1 + i*h2) % f.m
+		if f.bits[idx/64]&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHash 用128位fnv的高低两半做double hashing
+func bloomHash(key string) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write([]byte(key))
+	sum := h.Sum(nil)
+	h1 := binary.BigEndian.Uint64(sum[:8])
+	h2 := binary.BigEndian.Uint64(sum[8:]) | 1
+	return h1, h2
+}
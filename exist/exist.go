@@ -0,0 +1,33 @@
+package exist
+
+// IExister 精确模式(Exister)和概率模式(BloomExister)的公共接口，调用方可以按需切换
+type IExister interface {
+	// Has 返回key是否已存在，不存在时写入
+	Has(key string) bool
+	// Peek 返回key是否存在，不写入
+	Peek(key string) bool
+	Len() int
+	Close() error
+}
+
+var (
+	_ IExister = (*Exister)(nil)
+	_ IExister = (*BloomExister)(nil)
+)
+
+type Config struct {
+	FilePath string
+	Bloom    bool    // 使用布隆过滤器，key很多、内存放不下时使用
+	Capacity int     // Bloom时预计的key数量
+	FPRate   float64 // Bloom时的误判率，默认0.001
+}
+
+func Open(cfg Config) (IExister, error) {
+	if !cfg.Bloom {
+		return OpenExister(cfg.FilePath)
+	}
+	if cfg.FPRate <= 0 {
+		cfg.FPRate = 0.001
+	}
+	return NewBloomExister(cfg.FilePath, cfg.Capacity, cfg.FPRate)
+}
@@ -1,64 +1,346 @@
 package exist
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/logxxx/utils/fileutil"
+	"github.com/logxxx/utils/runutil"
+	log "github.com/sirupsen/logrus"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// 文件格式：每行一条记录，只追加
+//
+//	key                  旧格式，永不过期
+//	+\t<expireAt>\tkey   添加，expireAt为unix毫秒，0表示永不过期
+//	-\t0\tkey            删除
+//
+// key中有\t、\r、\n或以"开头时，后两种格式的key用strconv.Quote转义。
+//
+// 被删除/覆盖的记录过多时重写文件(Compact)，同时去掉已过期的key。
+
+const (
+	opAdd    = "+"
+	opRemove = "-"
+)
+
+var ErrClosed = errors.New("exister closed")
+
 type Exister struct {
 	FilePath  string
 	cacheLock sync.Mutex
-	cache     map[string]bool
+	cache     map[string]int64 // v:过期时间(unix毫秒)，0表示永不过期
+	ttl       time.Duration
+	file      *os.File
+	lines     int // 文件中的记录数
+	isClosed  bool
 }
 
+// NewExister 打开失败时只打印日志，之后的写入也会失败。需要处理错误时使用OpenExister
 func NewExister(filePath string) *Exister {
+	resp, err := OpenExister(filePath)
+	if err != nil {
+		log.Errorf("NewExister err:%v filePath:%v", err, filePath)
+	}
+	return resp
+}
+
+// OpenExister 读取已有的记录，并打开文件用于追加
+func OpenExister(filePath string) (*Exister, error) {
 	resp := &Exister{
 		FilePath: filePath,
-		cache:    map[string]bool{},
+		cache:    map[string]int64{},
 	}
 
-	resp.loadFile()
+	err := resp.loadFile()
+	if err != nil {
+		return resp, err
+	}
 
-	return resp
+	err = resp.openFile()
+	if err != nil {
+		return resp, err
+	}
 
+	return resp, nil
 }
 
-func (e *Exister) loadFile() {
-	file, err := os.ReadFile(e.FilePath)
+func (e *Exister) loadFile() error {
+	f, err := os.Open(e.FilePath)
 	if err != nil {
-		return
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
 	}
-	for _, key := range strings.Split(string(file), "\n") {
-		if key == "" {
+	defer f.Close()
+
+	now := nowMilli()
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			//没有换行结尾的是未写完的记录
+			break
+		}
+		e.lines++
+
+		op, expireAt, key, ok := parseLine(strings.TrimSuffix(line, "\n"))
+		if !ok {
+			log.Errorf("Exister.loadFile skip broken line:%v filePath:%v", line, e.FilePath)
+			continue
+		}
+		if op == opRemove || (expireAt > 0 && expireAt <= now) {
+			delete(e.cache, key)
 			continue
 		}
-		e.cache[key] = true
+		e.cache[key] = expireAt
 	}
+
+	return nil
 }
 
+func parseLine(line string) (op string, expireAt int64, key string, ok bool) {
+	if line == "" {
+		return "", 0, "", false
+	}
+	if !strings.Contains(line, "\t") {
+		return opAdd, 0, line, true
+	}
+	parts := strings.SplitN(line, "\t", 3)
+	if len(parts) != 3 || (parts[0] != opAdd && parts[0] != opRemove) || parts[2] == "" {
+		return "", 0, "", false
+	}
+	expireAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, "", false
+	}
+	key = parts[2]
+	if strings.HasPrefix(key, `"`) {
+		key, err = strconv.Unquote(key)
+		if err != nil {
+			return "", 0, "", false
+		}
+	}
+	return parts[0], expireAt, key, true
+}
+
+func formatLine(op string, expireAt int64, key string) string {
+	special := strings.ContainsAny(key, "\t\r\n")
+	if op == opAdd && expireAt == 0 && !special {
+		return key + "\n"
+	}
+	if special || strings.HasPrefix(key, `"`) {
+		key = strconv.Quote(key)
+	}
+	return fmt.Sprintf("%v\t%v\t%v\n", op, expireAt, key)
+}
+
+func (e *Exister) openFile() error {
+	err := os.MkdirAll(filepath.Dir(e.FilePath), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(e.FilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	e.file = f
+	return nil
+}
+
+// SetTTL 设置Has写入的key的过期时间，<=0时永不过期
+func (e *Exister) SetTTL(ttl time.Duration) {
+	e.cacheLock.Lock()
+	defer e.cacheLock.Unlock()
+	e.ttl = ttl
+}
+
+// Has 返回key是否已存在，不存在时写入。写入失败时只打印日志
 func (e *Exister) Has(key string) bool {
+	e.cacheLock.Lock()
+	ttl := e.ttl
+	e.cacheLock.Unlock()
+
+	existed, err := e.Mark(key, ttl)
+	if err != nil {
+		log.Errorf("Exister.Has err:%v key:%v filePath:%v", err, key, e.FilePath)
+	}
+	return existed
+}
+
+// Mark 返回key是否已存在，不存在时写入，ttl之后过期，ttl<=0时永不过期
+func (e *Exister) Mark(key string, ttl time.Duration) (bool, error) {
+	if key == "" {
+		return false, nil
+	}
+	e.cacheLock.Lock()
+	defer e.cacheLock.Unlock()
+	if e.exists(key, nowMilli()) {
+		return true, nil
+	}
+
+	var expireAt int64
+	if ttl > 0 {
+		expireAt = nowMilli() + int64(ttl/time.Millisecond)
+	}
+	e.cache[key] = expireAt
+	return false, e.writeFile(formatLine(opAdd, expireAt, key))
+}
+
+// Peek 返回key是否存在，不写入
+func (e *Exister) Peek(key string) bool {
 	if key == "" {
 		return false
 	}
 	e.cacheLock.Lock()
 	defer e.cacheLock.Unlock()
-	if e.cache[key] {
-		return true
+	return e.exists(key, nowMilli())
+}
+
+// Remove 删除key，key不存在时忽略
+func (e *Exister) Remove(key string) error {
+	if key == "" {
+		return nil
+	}
+	e.cacheLock.Lock()
+	defer e.cacheLock.Unlock()
+	if _, ok := e.cache[key]; !ok {
+		return nil
+	}
+	delete(e.cache, key)
+	return e.writeFile(formatLine(opRemove, 0, key))
+}
+
+// Len 返回未过期的key数量
+func (e *Exister) Len() int {
+	e.cacheLock.Lock()
+	defer e.cacheLock.Unlock()
+	now := nowMilli()
+	count := 0
+	for key := range e.cache {
+		if e.exists(key, now) {
+			count++
+		}
 	}
-	e.cache[key] = true
-	e.writeFile(key)
-	return false
+	return count
 }
 
-func (e *Exister) writeFile(key string) {
-	os.MkdirAll(filepath.Dir(e.FilePath), 0755)
+func (e *Exister) exists(key string, now int64) bool {
+	expireAt, ok := e.cache[key]
+	return ok && (expireAt == 0 || expireAt > now)
+}
 
-	f, err := os.OpenFile(e.FilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+func (e *Exister) writeFile(line string) error {
+	if e.isClosed {
+		return ErrClosed
+	}
+	if e.file == nil {
+		//之前打开失败，重试一次
+		err := e.openFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := e.file.WriteString(line)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer f.Close()
-	f.WriteString(key + "\n")
+	e.lines++
+
+	if e.lines > 2*len(e.cache)+1024 {
+		return e.compact()
+	}
+	return nil
+}
+
+// Compact 重写文件，去掉已删除、已过期的key
+func (e *Exister) Compact() error {
+	e.cacheLock.Lock()
+	defer e.cacheLock.Unlock()
+	if e.isClosed {
+		return ErrClosed
+	}
+	return e.compact()
+}
+
+func (e *Exister) compact() error {
+
+	now := nowMilli()
+	buf := &bytes.Buffer{}
+	for key, expireAt := range e.cache {
+		if expireAt > 0 && expireAt <= now {
+			delete(e.cache, key)
+			continue
+		}
+		buf.WriteString(formatLine(opAdd, expireAt, key))
+	}
+
+	err := fileutil.WriteToFileAtomic(buf.Bytes(), e.FilePath, true)
+	if err != nil {
+		log.Errorf("Exister.compact WriteToFileAtomic err:%v filePath:%v", err, e.FilePath)
+		return err
+	}
+	e.lines = len(e.cache)
+
+	//原来打开的是被替换掉的文件，重新打开
+	if e.file != nil {
+		e.file.Close()
+		e.file = nil
+	}
+	return e.openFile()
+}
+
+// StartCompactor 每隔interval重写一次文件，直到ctx结束
+func (e *Exister) StartCompactor(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	runutil.GoRunSafe(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := e.Compact()
+			if err == ErrClosed {
+				return
+			}
+			if err != nil {
+				log.Errorf("Exister.StartCompactor Compact err:%v filePath:%v", err, e.FilePath)
+			}
+		}
+	})
+}
+
+// Close 关闭文件，之后的写入返回ErrClosed
+func (e *Exister) Close() error {
+	e.cacheLock.Lock()
+	defer e.cacheLock.Unlock()
+	if e.isClosed {
+		return nil
+	}
+	e.isClosed = true
+	if e.file == nil {
+		return nil
+	}
+	err := e.file.Close()
+	e.file = nil
+	return err
+}
+
+func nowMilli() int64 {
+	return time.Now().UnixNano() / 1e6
 }
@@ -0,0 +1,220 @@
+package exist_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/logxxx/utils/exist"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExister(t *testing.T) {
+
+	filePath := filepath.Join(t.TempDir(), "exist", "urls.txt")
+
+	//兼容旧格式
+	assert.Nil(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+	assert.Nil(t, ioutil.WriteFile(filePath, []byte("old1\nold2\n"), 0644))
+
+	e, err := exist.OpenExister(filePath)
+	assert.Nil(t, err)
+	assert.True(t, e.Peek("old1"))
+	assert.False(t, e.Peek("new1"))
+	assert.False(t, e.Peek("new1"))
+
+	assert.False(t, e.Has("new1"))
+	assert.True(t, e.Has("new1"))
+
+	existed, err := e.Mark("ttl", 50*time.Millisecond)
+	assert.Nil(t, err)
+	assert.False(t, existed)
+	assert.True(t, e.Peek("ttl"))
+
+	assert.Nil(t, e.Remove("old2"))
+	assert.False(t, e.Peek("old2"))
+	assert.Nil(t, e.Close())
+
+	//重新打开后状态一致
+	e, err = exist.OpenExister(filePath)
+	assert.Nil(t, err)
+	assert.True(t, e.Peek("old1"))
+	assert.True(t, e.Peek("new1"))
+	assert.True(t, e.Peek("ttl"))
+	assert.False(t, e.Peek("old2"))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, e.Peek("ttl"))
+	assert.Equal(t, 2, e.Len())
+
+	assert.Nil(t, e.Compact())
+	content, err := ioutil.ReadFile(filePath)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.ElementsMatch(t, []string{"old1", "new1"}, lines)
+
+	//过期后可以重新写入
+	assert.False(t, e.Has("ttl"))
+	assert.Nil(t, e.Close())
+	assert.Equal(t, exist.ErrClosed, e.Remove("old1"))
+}
+
+// key中有分隔符时重新打开后仍然能读出
+func TestExister_SpecialKeys(t *testing.T) {
+
+	filePath := filepath.Join(t.TempDir(), "urls.txt")
+	keys := []string{"a\tb", "line1\nline2", "cr\r", `"quoted"`, `"`, "+\t0\tfake"}
+
+	e, err := exist.OpenExister(filePath)
+	assert.Nil(t, err)
+	for _, key := range keys {
+		assert.False(t, e.Has(key))
+		_, err = e.Mark(key+"_ttl", time.Hour)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, e.Remove(keys[0]+"_ttl"))
+	assert.Nil(t, e.Close())
+
+	for i := 0; i < 2; i++ {
+		e, err = exist.OpenExister(filePath)
+		assert.Nil(t, err)
+		assert.Equal(t, len(keys)*2-1, e.Len())
+		for _, key := range keys {
+			assert.True(t, e.Peek(key), "%q", key)
+			assert.Equal(t, key != keys[0], e.Peek(key+"_ttl"), "%q", key)
+		}
+		assert.False(t, e.Peek("line1"))
+		assert.False(t, e.Peek("fake"))
+
+		//compact后再读一次
+		assert.Nil(t, e.Compact())
+		assert.Nil(t, e.Close())
+	}
+}
+
+func TestExister_OpenErr(t *testing.T) {
+
+	//文件路径是已存在的目录，打开失败返回错误而不是panic
+	dir := t.TempDir()
+	_, err := exist.OpenExister(dir)
+	assert.NotNil(t, err)
+
+	e := exist.NewExister(dir)
+	assert.False(t, e.Has("key"))
+	_, err = e.Mark("key2", 0)
+	assert.NotNil(t, err)
+}
+
+func TestExister_AutoCompact(t *testing.T) {
+
+	filePath := filepath.Join(t.TempDir(), "urls.txt")
+	e, err := exist.OpenExister(filePath)
+	assert.Nil(t, err)
+	defer e.Close()
+
+	for i := 0; i < 2000; i++ {
+		e.Has("key")
+		assert.Nil(t, e.Remove("key"))
+	}
+
+	content, err := ioutil.ReadFile(filePath)
+	assert.Nil(t, err)
+	assert.True(t, strings.Count(string(content), "\n") <= 1024)
+	assert.False(t, e.Peek("key"))
+}
+
+func TestBloomExister(t *testing.T) {
+
+	filePath := filepath.Join(t.TempDir(), "bloom.bin")
+
+	e, err := exist.NewBloomExister(filePath, 1000, 0.01)
+	assert.Nil(t, err)
+	e.SetSnapshotEvery(3000)
+
+	//超过初始容量后自动扩展
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("https://example.com/%v", i)
+		e.Has(key)
+		assert.True(t, e.Peek(key))
+	}
+
+	falsePositive := 0
+	for i := 5000; i < 15000; i++ {
+		if e.Peek(fmt.Sprintf("https://example.com/%v", i)) {
+			falsePositive++
+		}
+	}
+	assert.True(t, falsePositive < 100, "falsePositive:%v", falsePositive)
+
+	//未写入快照的key在重新打开后从log恢复
+	count := e.Len()
+	assert.True(t, count > 4900)
+	reopen, err := exist.NewBloomExister(filePath, 1000, 0.01)
+	assert.Nil(t, err)
+	assert.Equal(t, count, reopen.Len())
+	assert.True(t, reopen.Peek("https://example.com/4999"))
+	assert.Nil(t, reopen.Close())
+	assert.Nil(t, e.Close())
+
+	reopen, err = exist.NewBloomExister(filePath, 1, 0.5)
+	assert.Nil(t, err)
+	defer reopen.Close()
+	for i := 0; i < 5000; i++ {
+		assert.True(t, reopen.Has(fmt.Sprintf("https://example.com/%v", i)))
+	}
+	assert.Equal(t, count, reopen.Len())
+
+	_, err = exist.NewBloomExister(filePath, 1000, 0)
+	assert.NotNil(t, err)
+}
+
+// key中有换行时重新打开后从log恢复，空key与Exister一致，重新打开前后都不记录
+func TestBloomExister_SpecialKeys(t *testing.T) {
+
+	filePath := filepath.Join(t.TempDir(), "bloom.bin")
+	keys := []string{"a\nb", "cr\r", `"quoted"`, `"`}
+
+	e, err := exist.NewBloomExister(filePath, 1000, 0.01)
+	assert.Nil(t, err)
+	defer e.Close()
+	for _, key := range keys {
+		assert.False(t, e.Has(key), "%q", key)
+	}
+	assert.False(t, e.Has(""))
+
+	reopen, err := exist.NewBloomExister(filePath, 1000, 0.01)
+	assert.Nil(t, err)
+	defer reopen.Close()
+	assert.Equal(t, len(keys), reopen.Len())
+	for _, key := range keys {
+		assert.True(t, reopen.Peek(key), "%q", key)
+	}
+	assert.False(t, reopen.Peek("a"))
+	assert.False(t, reopen.Peek("b"))
+	assert.False(t, reopen.Has(""))
+}
+
+func TestOpen(t *testing.T) {
+
+	dir := t.TempDir()
+	for _, cfg := range []exist.Config{
+		{FilePath: filepath.Join(dir, "exact.txt")},
+		{FilePath: filepath.Join(dir, "bloom.bin"), Bloom: true, Capacity: 100},
+	} {
+		e, err := exist.Open(cfg)
+		assert.Nil(t, err)
+		assert.False(t, e.Has("a"))
+		assert.True(t, e.Has("a"))
+		assert.True(t, e.Peek("a"))
+		assert.False(t, e.Peek("b"))
+		assert.Equal(t, 1, e.Len())
+		assert.Nil(t, e.Close())
+	}
+
+	_, err := exist.Open(exist.Config{FilePath: filepath.Join(dir, "exact.txt"), Bloom: true})
+	assert.True(t, errors.Is(err, exist.ErrBloomFile))
+}
@@ -0,0 +1,329 @@
+package filekv
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/logxxx/utils/fileutil"
+	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// 存储格式：
+//
+//	单文件(默认)：所有key都在fileName中
+//	分桶：fileName.d/meta.json 记录桶的数量，key按hash分散到fileName.d/bucket_xxx中，
+//	     每个桶的格式与单文件相同
+//
+// 使用哪种格式由磁盘上是否存在meta.json决定，与当前的SetBuckets无关，
+// 因此旧的单文件始终可读，并在开启分桶后的第一次写入时迁移。
+
+const (
+	updateTimeKey = "update_time"
+	expireKey     = "__expire__" // 记录每个key的过期时间(unix毫秒)
+)
+
+func isReservedKey(key string) bool {
+	return key == updateTimeKey || key == expireKey
+}
+
+type bucketMeta struct {
+	Version int `json:"version"`
+	Buckets int `json:"buckets"`
+}
+
+// cachedFile 已解密解析的文件内容，文件变化(mtime/size/inode)后失效
+type cachedFile struct {
+	stat   os.FileInfo
+	data   map[string][]byte
+	expire map[string]int64
+}
+
+func newCachedFile(stat os.FileInfo, data map[string][]byte) *cachedFile {
+	c := &cachedFile{
+		stat:   stat,
+		data:   data,
+		expire: make(map[string]int64),
+	}
+	if raw, ok := data[expireKey]; ok {
+		if err := json.Unmarshal(raw, &c.expire); err != nil {
+			log.Errorf("FileKV parse expire err:%v raw:%v", err, string(raw))
+		}
+	}
+	return c
+}
+
+// get 返回未过期的值
+func (c *cachedFile) get(key string, now int64) ([]byte, bool) {
+	if isReservedKey(key) {
+		return nil, false
+	}
+	value, ok := c.data[key]
+	if !ok || c.isExpired(key, now) {
+		return nil, false
+	}
+	return value, true
+}
+
+func (c *cachedFile) isExpired(key string, now int64) bool {
+	expireAt, ok := c.expire[key]
+	return ok && expireAt <= now
+}
+
+func bucketDir(fileName string) string {
+	return fileName + ".d"
+}
+
+func bucketMetaName(fileName string) string {
+	return filepath.Join(bucketDir(fileName), "meta.json")
+}
+
+func bucketName(fileName string, bucket int) string {
+	return filepath.Join(bucketDir(fileName), fmt.Sprintf("bucket_%03d", bucket))
+}
+
+func bucketOf(key string, buckets int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(buckets))
+}
+
+// SetBuckets 设置分桶数量，<=0时使用单文件。
+// 只对还没有分桶的fileName生效，已有的单文件会在下一次写入时迁移为分桶格式
+func (w *FileKV) SetBuckets(buckets int) {
+	w.buckets = buckets
+}
+
+// readBucketMeta 返回fileName的分桶数量，单文件格式返回0
+func (w *FileKV) readBucketMeta(fileName string) (int, error) {
+	content, err := ioutil.ReadFile(bucketMetaName(fileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	meta := &bucketMeta{}
+	err = json.Unmarshal(content, meta)
+	if err != nil {
+		return 0, err
+	}
+	if meta.Buckets <= 0 {
+		return 0, fmt.Errorf("invalid bucket meta:%v", string(content))
+	}
+	return meta.Buckets, nil
+}
+
+// dataFiles 返回fileName对应的所有数据文件
+func (w *FileKV) dataFiles(fileName string) ([]string, error) {
+	buckets, err := w.readBucketMeta(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if buckets == 0 {
+		return []string{fileName}, nil
+	}
+	files := make([]string, 0, buckets)
+	for i := 0; i < buckets; i++ {
+		files = append(files, bucketName(fileName, i))
+	}
+	return files, nil
+}
+
+// dataFileOf 按key分组，返回每个数据文件包含的key
+func (w *FileKV) dataFileOf(fileName string, keys []string) (map[string][]string, error) {
+	buckets, err := w.readBucketMeta(fileName)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]string)
+	for _, key := range keys {
+		path := fileName
+		if buckets > 0 {
+			path = bucketName(fileName, bucketOf(key, buckets))
+		}
+		result[path] = append(result[path], key)
+	}
+	return result, nil
+}
+
+// loadFile 读取并解析数据文件，文件未变化时直接使用缓存。返回的内容不能修改
+func (w *FileKV) loadFile(path string) (*cachedFile, error) {
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.dropCache(path)
+			return newCachedFile(nil, map[string][]byte{}), nil
+		}
+		return nil, err
+	}
+
+	w.cacheLock.Lock()
+	c := w.cache[path]
+	w.cacheLock.Unlock()
+
+	if c != nil && os.SameFile(c.stat, stat) && c.stat.Size() == stat.Size() && c.stat.ModTime().Equal(stat.ModTime()) {
+		return c, nil
+	}
+
+	data, err := w.readFileAndDecrypt(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c = newCachedFile(stat, data)
+	w.storeCache(path, c)
+
+	return c, nil
+}
+
+func (w *FileKV) storeCache(path string, c *cachedFile) {
+	w.cacheLock.Lock()
+	defer w.cacheLock.Unlock()
+	if w.cache == nil {
+		w.cache = make(map[string]*cachedFile)
+	}
+	w.cache[path] = c
+}
+
+func (w *FileKV) dropCache(paths ...string) {
+	w.cacheLock.Lock()
+	defer w.cacheLock.Unlock()
+	if len(paths) == 0 {
+		w.cache = nil
+		return
+	}
+	for _, path := range paths {
+		delete(w.cache, path)
+	}
+}
+
+// writeFile 加密并原子地写入数据文件，同时更新缓存。
+// 写入时顺便清理已过期的key
+func (w *FileKV) writeFile(path string, data map[string][]byte, expire map[string]int64) error {
+
+	now := nowMilli()
+	for key, expireAt := range expire {
+		if expireAt <= now {
+			delete(data, key)
+			delete(expire, key)
+		}
+	}
+	for key := range expire {
+		if _, ok := data[key]; !ok {
+			delete(expire, key)
+		}
+	}
+
+	delete(data, expireKey)
+	if len(expire) > 0 {
+		data[expireKey], _ = json.Marshal(expire)
+	}
+
+	newData, err := json.MarshalIndent(data, "", " ")
+	if err != nil {
+		log.Errorf("FileKV.writeFile json.Marshal data err:%v path:%v", err, path)
+		return err
+	}
+
+	//加密并加上文件头
+	newData, err = w.encodeFile(newData)
+	if err != nil {
+		log.Errorf("FileKV.writeFile encodeFile err:%v path:%v", err, path)
+		return err
+	}
+
+	err = fileutil.WriteToFileAtomic(newData, path, true)
+	if err != nil {
+		log.Errorf("FileKV.writeFile WriteToFileAtomic err:%v path:%v", err, path)
+		return err
+	}
+
+	w.publish(path, fsnotify.Write)
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		w.dropCache(path)
+		return nil
+	}
+	w.storeCache(path, &cachedFile{stat: stat, data: data, expire: expire})
+
+	return nil
+}
+
+// migrateToBuckets 开启分桶后，将单文件迁移为分桶格式。
+// meta.json最后写入，迁移中途失败时仍按单文件读取，下次重新迁移
+func (w *FileKV) migrateToBuckets(fileName string) error {
+
+	if w.buckets <= 0 {
+		return nil
+	}
+
+	buckets, err := w.readBucketMeta(fileName)
+	if err != nil {
+		return err
+	}
+	if buckets > 0 {
+		//上次迁移完成但没来得及删除单文件
+		if fileutil.HasFile(fileName) {
+			os.Remove(fileName)
+			w.dropCache(fileName)
+		}
+		return nil
+	}
+
+	c, err := w.loadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	bucketData := make([]map[string][]byte, w.buckets)
+	bucketExpire := make([]map[string]int64, w.buckets)
+	for i := range bucketData {
+		bucketData[i] = make(map[string][]byte)
+		bucketExpire[i] = make(map[string]int64)
+	}
+	for k, v := range c.data {
+		if isReservedKey(k) {
+			continue
+		}
+		bucket := bucketOf(k, w.buckets)
+		bucketData[bucket][k] = v
+		if expireAt, ok := c.expire[k]; ok {
+			bucketExpire[bucket][k] = expireAt
+		}
+	}
+
+	for i, d := range bucketData {
+		if len(d) <= 0 {
+			continue
+		}
+		if updateTime, ok := c.data[updateTimeKey]; ok {
+			d[updateTimeKey] = updateTime
+		}
+		err = w.writeFile(bucketName(fileName, i), d, bucketExpire[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	metaData, _ := json.Marshal(&bucketMeta{Version: 1, Buckets: w.buckets})
+	err = fileutil.WriteToFileAtomic(metaData, bucketMetaName(fileName), true)
+	if err != nil {
+		log.Errorf("FileKV.migrateToBuckets write meta err:%v fileName:%v", err, fileName)
+		return err
+	}
+
+	if len(c.data) > 0 {
+		log.Infof("FileKV.migrateToBuckets done. fileName:%v keys:%v buckets:%v", fileName, len(c.data), w.buckets)
+	}
+
+	os.Remove(fileName)
+	w.dropCache(fileName)
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package filekv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/logxxx/utils"
+	"github.com/logxxx/utils/aes"
+)
+
+// 文件格式：
+//
+//	{"filekv":1,"codec":"json","cipher":"none"}\n
+//	<cipher加密后的body>
+//
+// 第一行是明文的文件头，记录value的编码方式和整个body的加密方式，
+// 读取时与当前实例的配置不一致会返回ErrCodecMismatch，而不是解密/解析失败。
+// body是map[string][]byte的json，value为codec编码后的数据。
+// 没有文件头的旧文件视为codec为json，用当前的cipher解密。
+
+const fileVersion = 1
+
+var (
+	ErrCodecMismatch = errors.New("filekv codec mismatch")
+
+	headerPrefix = []byte(`{"filekv":`)
+)
+
+// Codec value的编码方式。aes.AesCodec也实现了该接口
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	Name() string
+}
+
+// Cipher 整个文件的加密方式
+type Cipher interface {
+	Encrypt(data []byte) ([]byte, error)
+	Decrypt(data []byte) ([]byte, error)
+	Name() string
+}
+
+var (
+	_ Codec = JSONCodec{}
+	_ Codec = GobCodec{}
+	_ Codec = aes.AesCodec{}
+)
+
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	if v == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+type GobCodec struct{}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	b := &bytes.Buffer{}
+	err := gob.NewEncoder(b).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+type aesCipher struct {
+	key []byte
+}
+
+// NewAesCipher 用key的md5作为密钥进行aes加密
+func NewAesCipher(key string) Cipher {
+	return &aesCipher{key: []byte(utils.MD5(key))}
+}
+
+func (c *aesCipher) Encrypt(data []byte) ([]byte, error) {
+	return aes.Encrypt(c.key, data)
+}
+
+func (c *aesCipher) Decrypt(data []byte) ([]byte, error) {
+	return aes.Decrypt(c.key, data)
+}
+
+func (c *aesCipher) Name() string {
+	return "aes"
+}
+
+// funcCipher 兼容SetEncryptFn/SetDecryptFn
+type funcCipher struct {
+	encryptFn func([]byte) ([]byte, error)
+	decryptFn func([]byte) ([]byte, error)
+}
+
+func (c *funcCipher) Encrypt(data []byte) ([]byte, error) {
+	if c.encryptFn == nil {
+		return data, nil
+	}
+	return c.encryptFn(data)
+}
+
+func (c *funcCipher) Decrypt(data []byte) ([]byte, error) {
+	if c.decryptFn == nil {
+		return data, nil
+	}
+	return c.decryptFn(data)
+}
+
+func (c *funcCipher) Name() string {
+	return "custom"
+}
+
+type fileHeader struct {
+	Version int    `json:"filekv"`
+	Codec   string `json:"codec"`
+	Cipher  string `json:"cipher"`
+}
+
+func (w *FileKV) getCodec() Codec {
+	if w.codec == nil {
+		return JSONCodec{}
+	}
+	return w.codec
+}
+
+func (w *FileKV) cipherName() string {
+	if w.cipher == nil {
+		return "none"
+	}
+	return w.cipher.Name()
+}
+
+// encodeFile 生成文件头，并加密body
+func (w *FileKV) encodeFile(body []byte) ([]byte, error) {
+
+	var err error
+	if w.cipher != nil {
+		body, err = w.cipher.Encrypt(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	header, _ := json.Marshal(&fileHeader{
+		Version: fileVersion,
+		Codec:   w.getCodec().Name(),
+		Cipher:  w.cipherName(),
+	})
+
+	result := make([]byte, 0, len(header)+1+len(body))
+	result = append(result, header...)
+	result = append(result, '\n')
+	result = append(result, body...)
+	return result, nil
+}
+
+// decodeFile 检查文件头，返回解密后的body
+func (w *FileKV) decodeFile(fileData []byte) ([]byte, error) {
+
+	header := &fileHeader{Version: 0, Codec: "json", Cipher: w.cipherName()}
+	body := fileData
+	if bytes.HasPrefix(fileData, headerPrefix) {
+		idx := bytes.IndexByte(fileData, '\n')
+		if idx < 0 {
+			return nil, errors.New("filekv header not complete")
+		}
+		err := json.Unmarshal(fileData[:idx], header)
+		if err != nil {
+			return nil, fmt.Errorf("filekv header invalid:%v err:%v", string(fileData[:idx]), err)
+		}
+		body = fileData[idx+1:]
+	}
+
+	if header.Version > fileVersion {
+		return nil, fmt.Errorf("filekv file version:%v not supported, max:%v", header.Version, fileVersion)
+	}
+
+	if header.Codec != w.getCodec().Name() || header.Cipher != w.cipherName() {
+		return nil, fmt.Errorf("%w: file codec:%v cipher:%v, current codec:%v cipher:%v",
+			ErrCodecMismatch, header.Codec, header.Cipher, w.getCodec().Name(), w.cipherName())
+	}
+
+	if w.cipher == nil || len(body) <= 0 {
+		return body, nil
+	}
+
+	return w.cipher.Decrypt(body)
+}
@@ -4,41 +4,129 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
 	"github.com/logxxx/utils"
 	"github.com/logxxx/utils/fileutil"
+	"github.com/logxxx/utils/notify"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 var (
-	_fileKV = &FileKV{
-		encryptFn: func(data []byte) ([]byte, error) { return data, nil },
-		decryptFn: func(data []byte) ([]byte, error) { return data, nil },
-	}
+	_fileKV     = NewFileKV()
 	ErrNotFound = errors.New("not found")
 )
 
+const defaultLockTimeout = 10 * time.Second
+
 // FileKV 以文件的方式存储kv。
-// 适用于读多写少(效率不高)，只有getset的场景。
+// 适用于读多写少的场景。读取的文件内容会缓存在内存中，文件变化后自动失效；
+// key较多时可以用SetBuckets按key的hash分散到多个文件，减少每次写入的数据量。
+// 支持带过期时间的key(SetWithTTL)，以及SetNX/CompareAndSwap；可以用Watch监听变化。
 type FileKV struct {
-	lock      sync.RWMutex
-	encryptFn func([]byte) ([]byte, error)
-	decryptFn func([]byte) ([]byte, error)
+	lock        sync.RWMutex
+	lockTimeout time.Duration
+	codec       Codec
+	cipher      Cipher
+	buckets     int
+
+	cacheLock sync.Mutex
+	cache     map[string]*cachedFile // k:数据文件路径
+	ttlFiles  map[string]bool        // 写入过带ttl数据的fileName，由StartSweeper清理
+
+	watchLock sync.Mutex
+	watchers  map[*watcher]bool
+	notifier  notify.INotify
+	fsWatcher *fsnotify.Watcher
+	watchDirs map[string]bool
+}
+
+type Option func(w *FileKV)
+
+// WithCodec 设置value的编码方式，默认为JSONCodec
+func WithCodec(codec Codec) Option {
+	return func(w *FileKV) {
+		w.codec = codec
+	}
+}
+
+// WithCipher 设置整个文件的加密方式，默认不加密
+func WithCipher(cipher Cipher) Option {
+	return func(w *FileKV) {
+		w.cipher = cipher
+	}
 }
 
+func WithBuckets(buckets int) Option {
+	return func(w *FileKV) {
+		w.buckets = buckets
+	}
+}
+
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(w *FileKV) {
+		w.lockTimeout = timeout
+	}
+}
+
+// NewFileKV 创建独立的实例，各实例的编码/加密配置互不影响
+func NewFileKV(opts ...Option) *FileKV {
+	w := &FileKV{
+		lockTimeout: defaultLockTimeout,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// GetFileKV 返回进程内共享的默认实例。
+// 需要加密或其他编码方式时应使用NewFileKV，避免影响其他使用者
 func GetFileKV() *FileKV {
 	return _fileKV
 }
 
+// Deprecated: 会影响所有使用同一实例的调用方，使用NewFileKV(WithCipher(...))
 func (w *FileKV) SetEncryptFn(encryptFn func(data []byte) ([]byte, error)) {
-	w.encryptFn = encryptFn
+	w.funcCipher().encryptFn = encryptFn
+	w.dropCache()
 }
 
+// Deprecated: 会影响所有使用同一实例的调用方，使用NewFileKV(WithCipher(...))
 func (w *FileKV) SetDecryptFn(decryptFn func(data []byte) ([]byte, error)) {
-	w.decryptFn = decryptFn
+	w.funcCipher().decryptFn = decryptFn
+	w.dropCache()
+}
+
+func (w *FileKV) funcCipher() *funcCipher {
+	c, ok := w.cipher.(*funcCipher)
+	if !ok {
+		c = &funcCipher{}
+		w.cipher = c
+	}
+	return c
+}
+
+// SetLockTimeout 设置等待跨进程文件锁的超时时间，<=0时一直等待
+func (w *FileKV) SetLockTimeout(timeout time.Duration) {
+	w.lockTimeout = timeout
+}
+
+// lockFile 获取fileName的跨进程锁，保证多个进程读-改-写同一个文件时不会互相覆盖
+func (w *FileKV) lockFile(fileName string) (*fileutil.FileLock, error) {
+	fileLock := fileutil.NewFileLock(fileName + ".lock")
+	err := fileLock.Lock(w.lockTimeout)
+	if err != nil {
+		log.Errorf("FileKV.lockFile err:%v fileName:%v", err, fileName)
+		return nil, err
+	}
+	return fileLock, nil
 }
 
 func (w *FileKV) MustGet(fileName, key string, value interface{}) error {
@@ -46,20 +134,20 @@ func (w *FileKV) MustGet(fileName, key string, value interface{}) error {
 	w.lock.RLock()
 	defer w.lock.RUnlock()
 
-	data, err := w.readFileAndDecrypt(fileName)
+	values, err := w.getMany(fileName, []string{key})
 	if err != nil {
-		log.Errorf("FileKV.MustGet readFileAndDecrypt err:%v fileName:%v", err, fileName)
+		log.Errorf("FileKV.MustGet getMany err:%v fileName:%v", err, fileName)
 		return err
 	}
 
-	rawValue, ok := data[key]
-	if !ok || len(rawValue) < 0 {
+	rawValue, ok := values[key]
+	if !ok {
 		return ErrNotFound
 	}
 
-	err = json.Unmarshal(rawValue, value)
+	err = w.getCodec().Unmarshal(rawValue, value)
 	if err != nil {
-		log.Errorf("FileKV.MustGet Unmarshal err:%v rawValue:%v", err, string(rawValue))
+		log.Errorf("FileKV.MustGet Unmarshal err:%v fileName:%v key:%v", err, fileName, key)
 		return err
 	}
 
@@ -84,24 +172,167 @@ func (w *FileKV) Get(fileName, key string, value interface{}) error {
 	return nil
 }
 
+// GetMany 批量读取，不存在的key不会出现在结果中。
+// 返回的是codec编码后的原始数据，codec不是json时用Unmarshal解码
+func (w *FileKV) GetMany(fileName string, keys []string) (map[string]json.RawMessage, error) {
+
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	return w.getMany(fileName, keys)
+}
+
+func (w *FileKV) getMany(fileName string, keys []string) (map[string]json.RawMessage, error) {
+
+	groups, err := w.dataFileOf(fileName, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	now := nowMilli()
+	result := make(map[string]json.RawMessage, len(keys))
+	for path, pathKeys := range groups {
+		c, err := w.loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range pathKeys {
+			if rawValue, ok := c.get(key, now); ok {
+				result[key] = rawValue
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Keys 返回所有以prefix开头的key，按字典序排列
+func (w *FileKV) Keys(fileName, prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	err := w.Range(fileName, func(key string, value json.RawMessage) bool {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, err
+}
+
+// Range 按key的字典序遍历所有数据，fn返回false时停止。value与GetMany一样是编码后的原始数据
+func (w *FileKV) Range(fileName string, fn func(key string, value json.RawMessage) bool) error {
+
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	files, err := w.dataFiles(fileName)
+	if err != nil {
+		log.Errorf("FileKV.Range dataFiles err:%v fileName:%v", err, fileName)
+		return err
+	}
+
+	now := nowMilli()
+	all := make(map[string][]byte)
+	for _, path := range files {
+		c, err := w.loadFile(path)
+		if err != nil {
+			return err
+		}
+		for k := range c.data {
+			if v, ok := c.get(k, now); ok {
+				all[k] = v
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !fn(k, all[k]) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
 func (w *FileKV) RemoveFile(fileName string) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 	log.Debugf("FileKV.RemoveFile:%v", fileName)
-	if !utils.HasFile(fileName) {
-		return nil
+	fileLock, err := w.lockFile(fileName)
+	if err != nil {
+		return err
+	}
+	defer fileLock.Unlock()
+
+	files, _ := w.dataFiles(fileName)
+	w.dropCache(append(files, fileName)...)
+
+	defer w.publish(fileName, fsnotify.Remove)
+
+	err = os.RemoveAll(bucketDir(fileName))
+	if err != nil {
+		return err
 	}
-	return os.Remove(fileName)
 
+	if utils.HasFile(fileName) {
+		err = os.Remove(fileName)
+		if err != nil {
+			return err
+		}
+	}
+
+	//持有锁时删除锁文件，等待中的进程会重新创建
+	err = fileLock.Remove()
+	if err != nil {
+		log.Errorf("FileKV.RemoveFile remove lock file err:%v fileName:%v", err, fileName)
+	}
+	return nil
 }
 
 func (w *FileKV) Set(fileName, key string, value interface{}) error {
 	return w.setWithLock(fileName, key, value)
 }
 
+// SetMany 批量写入，每个数据文件只读写一次。分桶时多个桶之间不保证原子性
+func (w *FileKV) SetMany(fileName string, kvs map[string]interface{}) error {
+
+	muts := make([]*mutation, 0, len(kvs))
+	for key, value := range kvs {
+		valueBytes, err := w.marshalValue(value)
+		if err != nil {
+			log.Errorf("FileKV.SetMany marshalValue err:%v key:%v value:%+v", err, key, value)
+			return err
+		}
+		muts = append(muts, &mutation{key: key, value: valueBytes})
+	}
+
+	_, err := w.updateWithLock(fileName, muts)
+	return err
+}
+
+// Delete 删除key，key不存在时忽略
+func (w *FileKV) Delete(fileName string, keys ...string) error {
+	muts := make([]*mutation, 0, len(keys))
+	for _, key := range keys {
+		muts = append(muts, &mutation{key: key})
+	}
+	_, err := w.updateWithLock(fileName, muts)
+	return err
+}
+
 func (w *FileKV) setWithLock(fileName, key string, value interface{}) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
+	fileLock, err := w.lockFile(fileName)
+	if err != nil {
+		return err
+	}
+	defer fileLock.Unlock()
 	return w.set(fileName, key, value)
 }
 
@@ -109,51 +340,149 @@ func (w *FileKV) set(fileName, key string, value interface{}) error {
 
 	//log.Debugf("FileKV.Set start. fileName:%v key:%v value:%+v", fileName, key, utils.JsonToString(value))
 
-	data, err := w.readFileAndDecrypt(fileName)
+	valueBytes, err := w.marshalValue(value)
 	if err != nil {
-		log.Errorf("FileKV.Set readFileAndDecrypt err:%v fileName:%v", err, fileName)
+		log.Errorf("FileKV.Set marshalValue err:%v value:%+v", err, value)
 		return err
 	}
 
-	var valueBytes = []byte("{}")
-	if value != nil {
-		valueBytes, err = json.Marshal(value)
-		if err != nil {
-			log.Errorf("FileKV.Set json.Marshal err:%v value:%+v", err, value)
-			return err
-		}
+	_, err = w.update(fileName, []*mutation{{key: key, value: valueBytes}})
+	return err
+}
+
+// Unmarshal 解码GetMany/Range返回的原始数据
+func (w *FileKV) Unmarshal(rawValue []byte, value interface{}) error {
+	return w.getCodec().Unmarshal(rawValue, value)
+}
+
+func (w *FileKV) marshalValue(value interface{}) ([]byte, error) {
+	return w.getCodec().Marshal(value)
+}
+
+// mutation 对一个key的修改
+type mutation struct {
+	key      string
+	value    []byte // 为nil时删除key
+	expireAt int64  // unix毫秒，0表示不过期
+	keepTTL  bool   // 保留原来的过期时间
+	// cond 不为nil时，所有mutation的cond都返回true才会修改。old为未过期的旧值
+	cond func(old []byte, exists bool) bool
+}
+
+func (w *FileKV) updateWithLock(fileName string, muts []*mutation) (bool, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	fileLock, err := w.lockFile(fileName)
+	if err != nil {
+		return false, err
 	}
+	defer fileLock.Unlock()
+	return w.update(fileName, muts)
+}
 
-	if bytes.Compare(data[key], valueBytes) == 0 {
-		//log.Debugf("FileKV.Set NO NEED! data[%v]:%v value:%v", key, string(data[key]), string(valueBytes))
-		return nil
+// update 读-改-写，需要在持有锁的情况下调用。cond不满足时返回false
+func (w *FileKV) update(fileName string, muts []*mutation) (bool, error) {
+
+	err := w.migrateToBuckets(fileName)
+	if err != nil {
+		log.Errorf("FileKV.update migrateToBuckets err:%v fileName:%v", err, fileName)
+		return false, err
 	}
 
-	data[key] = valueBytes
-	data["update_time"] = []byte(time.Now().Format("2006/01/02 15:04:05"))
+	keys := make([]string, 0, len(muts))
+	mutOfKey := make(map[string]*mutation, len(muts))
+	for _, m := range muts {
+		if isReservedKey(m.key) {
+			return false, fmt.Errorf("reserved key:%v", m.key)
+		}
+		keys = append(keys, m.key)
+		mutOfKey[m.key] = m
+	}
 
-	newData, err := json.MarshalIndent(data, "", " ")
+	groups, err := w.dataFileOf(fileName, keys)
 	if err != nil {
-		log.Errorf("FileKV.Set json.Marshal data err:%v data:%+v", err, data)
-		return err
+		log.Errorf("FileKV.update dataFileOf err:%v fileName:%v", err, fileName)
+		return false, err
 	}
 
-	//加密
-	if w.encryptFn != nil {
-		newData, err = w.encryptFn(newData)
+	now := nowMilli()
+	files := make(map[string]*cachedFile, len(groups))
+	for path, pathKeys := range groups {
+		c, err := w.loadFile(path)
 		if err != nil {
-			log.Errorf("FileKV.Set encryptFn err:%v data:%v", err, string(newData))
-			return err
+			log.Errorf("FileKV.update loadFile err:%v path:%v", err, path)
+			return false, err
+		}
+		files[path] = c
+
+		for _, key := range pathKeys {
+			m := mutOfKey[key]
+			if m.cond == nil {
+				continue
+			}
+			old, exists := c.get(key, now)
+			if !m.cond(old, exists) {
+				return false, nil
+			}
 		}
 	}
 
-	err = fileutil.WriteToFile(newData, fileName)
-	if err != nil {
-		log.Errorf("FileKV.Set WriteToFile err:%v fileName:%v", err, fileName)
-		return err
+	for path, pathKeys := range groups {
+		c := files[path]
+
+		//缓存中的map是共享的，修改前先复制
+		var newData map[string][]byte
+		var newExpire map[string]int64
+		for _, key := range pathKeys {
+			m := mutOfKey[key]
+			oldValue, exists := c.get(key, now)
+			oldExpire := c.expire[key]
+			expireAt := m.expireAt
+			if m.keepTTL {
+				expireAt = oldExpire
+			}
+			if m.value != nil && exists && bytes.Compare(oldValue, m.value) == 0 && expireAt == oldExpire {
+				continue
+			}
+			if m.value == nil && !exists {
+				continue
+			}
+			if newData == nil {
+				newData = make(map[string][]byte, len(c.data)+1)
+				for k, v := range c.data {
+					newData[k] = v
+				}
+				newExpire = make(map[string]int64, len(c.expire))
+				for k, v := range c.expire {
+					newExpire[k] = v
+				}
+			}
+			if m.value == nil {
+				delete(newData, key)
+				delete(newExpire, key)
+				continue
+			}
+			newData[key] = m.value
+			if expireAt > 0 {
+				newExpire[key] = expireAt
+			} else {
+				delete(newExpire, key)
+			}
+		}
+
+		if newData == nil {
+			continue
+		}
+
+		newData[updateTimeKey] = []byte(time.Now().Format("2006/01/02 15:04:05"))
+
+		err = w.writeFile(path, newData, newExpire)
+		if err != nil {
+			return false, err
+		}
 	}
 
-	return nil
+	return true, nil
 }
 
 func (w *FileKV) readFileAndDecrypt(fileName string) (allKVs map[string][]byte, err error) {
@@ -174,13 +503,11 @@ func (w *FileKV) readFileAndDecrypt(fileName string) (allKVs map[string][]byte,
 		return
 	}
 
-	//解密
-	if w.decryptFn != nil {
-		fileData, err = w.decryptFn(fileData)
-		if err != nil {
-			log.Errorf("FileKV.readFileAndDecrypt decryptFn err:%v fileData:%v", err, string(fileData))
-			return
-		}
+	//检查文件头并解密
+	fileData, err = w.decodeFile(fileData)
+	if err != nil {
+		log.Errorf("FileKV.readFileAndDecrypt decodeFile err:%v fileName:%v", err, fileName)
+		return
 	}
 
 	err = json.Unmarshal(fileData, &allKVs)
@@ -0,0 +1,393 @@
+package filekv_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/logxxx/utils/aes"
+	"github.com/logxxx/utils/filekv"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestHelperProcess 在子进程中执行，用于测试多进程共用一个kv文件
+func TestHelperProcess(t *testing.T) {
+	fileName := os.Getenv("FILEKV_FILE")
+	if fileName == "" {
+		return
+	}
+	id := os.Getenv("FILEKV_ID")
+	count, _ := strconv.Atoi(os.Getenv("FILEKV_COUNT"))
+	for i := 0; i < count; i++ {
+		if err := filekv.GetFileKV().Set(fileName, fmt.Sprintf("%v_%v", id, i), i); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(0)
+}
+
+func TestFileKV_MultiProcess(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "kv.json")
+	procs, count := 4, 50
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < procs; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+		cmd.Env = append(os.Environ(), "FILEKV_FILE="+fileName, fmt.Sprintf("FILEKV_ID=%v", i), fmt.Sprintf("FILEKV_COUNT=%v", count))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("helper %v err:%v output:%s", i, err, output)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < procs; i++ {
+		for j := 0; j < count; j++ {
+			value := -1
+			err := filekv.GetFileKV().MustGet(fileName, fmt.Sprintf("%v_%v", i, j), &value)
+			if err != nil {
+				t.Fatalf("key %v_%v err:%v", i, j, err)
+			}
+			assert.Equal(t, j, value)
+		}
+	}
+}
+
+func TestFileKV_Buckets(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "kv.json")
+
+	//先写入旧的单文件格式
+	kv := new(filekv.FileKV)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, kv.Set(fileName, fmt.Sprintf("old_%v", i), i))
+	}
+
+	kv.SetBuckets(4)
+
+	values, err := kv.GetMany(fileName, []string{"old_1", "old_2", "missing"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(values))
+	assert.Equal(t, "2", string(values["old_2"]))
+
+	kvs := make(map[string]interface{})
+	for i := 0; i < 10; i++ {
+		kvs[fmt.Sprintf("new_%v", i)] = i
+	}
+	assert.Nil(t, kv.SetMany(fileName, kvs))
+
+	_, err = os.Stat(fileName)
+	assert.True(t, os.IsNotExist(err))
+	buckets, _ := filepath.Glob(fileName + ".d/bucket_*")
+	assert.Equal(t, 4, len(buckets))
+
+	assert.Nil(t, kv.Delete(fileName, "old_0", "new_0", "missing"))
+
+	keys, err := kv.Keys(fileName, "new_")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"new_1", "new_2", "new_3", "new_4", "new_5", "new_6", "new_7", "new_8", "new_9"}, keys)
+
+	//没有设置分桶的实例也能读取已分桶的数据
+	other := new(filekv.FileKV)
+	count := 0
+	err = other.Range(fileName, func(key string, value json.RawMessage) bool {
+		count++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 18, count)
+
+	value := 0
+	assert.Nil(t, other.MustGet(fileName, "old_9", &value))
+	assert.Equal(t, 9, value)
+	assert.Equal(t, filekv.ErrNotFound, other.MustGet(fileName, "old_0", &value))
+
+	//其他实例修改后缓存失效
+	assert.Nil(t, other.Set(fileName, "old_9", 99))
+	assert.Nil(t, kv.MustGet(fileName, "old_9", &value))
+	assert.Equal(t, 99, value)
+
+	assert.Nil(t, kv.RemoveFile(fileName))
+	keys, err = kv.Keys(fileName, "")
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+
+	//不留下锁文件
+	entries, err := ioutil.ReadDir(filepath.Dir(fileName))
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestFileKV_TTL(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "kv.json")
+
+	kv := new(filekv.FileKV)
+	assert.Nil(t, kv.SetWithTTL(fileName, "short", "a", 50*time.Millisecond))
+	assert.Nil(t, kv.SetWithTTL(fileName, "long", "b", time.Hour))
+	assert.Nil(t, kv.Set(fileName, "forever", "c"))
+
+	value := ""
+	assert.Nil(t, kv.MustGet(fileName, "short", &value))
+	assert.Equal(t, "a", value)
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, filekv.ErrNotFound, kv.MustGet(fileName, "short", &value))
+	keys, err := kv.Keys(fileName, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"forever", "long"}, keys)
+
+	//其他实例读取时同样不可见
+	other := new(filekv.FileKV)
+	assert.Equal(t, "", other.GetString(fileName, "short"))
+	assert.Equal(t, "b", other.GetString(fileName, "long"))
+
+	count, err := kv.Sweep(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	count, err = kv.Sweep(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	//普通Set会清除过期时间
+	assert.Nil(t, kv.SetWithTTL(fileName, "forever", "c", 50*time.Millisecond))
+	assert.Nil(t, kv.Set(fileName, "forever", "c"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "c", kv.GetString(fileName, "forever"))
+}
+
+func TestFileKV_SetNX(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "kv.json")
+	kv := new(filekv.FileKV)
+
+	ok, err := kv.SetNX(fileName, "key", 1, 50*time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = kv.SetNX(fileName, "key", 2, 0)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	//过期后可以重新写入
+	time.Sleep(100 * time.Millisecond)
+	ok, err = kv.SetNX(fileName, "key", 3, 0)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	value := 0
+	assert.Nil(t, kv.MustGet(fileName, "key", &value))
+	assert.Equal(t, 3, value)
+
+	//并发SetNX只有一个成功
+	kv.SetBuckets(4)
+	wg := sync.WaitGroup{}
+	lock := sync.Mutex{}
+	success := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := kv.SetNX(fileName, "race", i, time.Hour)
+			assert.Nil(t, err)
+			if ok {
+				lock.Lock()
+				success++
+				lock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, success)
+}
+
+func TestFileKV_CompareAndSwap(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "kv.json")
+	kv := new(filekv.FileKV)
+
+	//old为nil表示key不存在
+	ok, err := kv.CompareAndSwap(fileName, "key", nil, 1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = kv.CompareAndSwap(fileName, "key", 2, 3)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, err = kv.CompareAndSwap(fileName, "key", 1, 2)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	value := 0
+	assert.Nil(t, kv.MustGet(fileName, "key", &value))
+	assert.Equal(t, 2, value)
+
+	//保留原来的过期时间
+	assert.Nil(t, kv.SetWithTTL(fileName, "ttl", "a", 50*time.Millisecond))
+	ok, err = kv.CompareAndSwap(fileName, "ttl", "a", "b")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "b", kv.GetString(fileName, "ttl"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "", kv.GetString(fileName, "ttl"))
+}
+
+type codecUser struct {
+	Name string
+	Age  int
+}
+
+func TestFileKV_Codec(t *testing.T) {
+
+	dir := t.TempDir()
+
+	codecs := []filekv.Codec{filekv.JSONCodec{}, filekv.GobCodec{}, aes.AesCodec{EncryptKey: "0123456789abcdef"}}
+	for _, codec := range codecs {
+		fileName := filepath.Join(dir, codec.Name()+".kv")
+
+		kv := filekv.NewFileKV(filekv.WithCodec(codec), filekv.WithCipher(filekv.NewAesCipher("secret")))
+		assert.Nil(t, kv.Set(fileName, "user", &codecUser{Name: "tom", Age: 18}))
+
+		user := &codecUser{}
+		assert.Nil(t, filekv.NewFileKV(filekv.WithCodec(codec), filekv.WithCipher(filekv.NewAesCipher("secret"))).MustGet(fileName, "user", user), codec.Name())
+		assert.Equal(t, &codecUser{Name: "tom", Age: 18}, user, codec.Name())
+
+		values, err := kv.GetMany(fileName, []string{"user"})
+		assert.Nil(t, err)
+		user = &codecUser{}
+		assert.Nil(t, kv.Unmarshal(values["user"], user))
+		assert.Equal(t, "tom", user.Name)
+
+		//文件头是明文
+		content, err := ioutil.ReadFile(fileName)
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(string(content), fmt.Sprintf(`{"filekv":1,"codec":"%v","cipher":"aes"}`, codec.Name())))
+	}
+
+	//编码方式不一致时返回明确的错误
+	fileName := filepath.Join(dir, "gob.kv")
+	err := filekv.NewFileKV().MustGet(fileName, "user", &codecUser{})
+	assert.True(t, errors.Is(err, filekv.ErrCodecMismatch))
+	err = filekv.NewFileKV(filekv.WithCodec(filekv.GobCodec{})).Set(fileName, "other", 1)
+	assert.True(t, errors.Is(err, filekv.ErrCodecMismatch))
+}
+
+func TestFileKV_Instances(t *testing.T) {
+
+	dir := t.TempDir()
+
+	//没有文件头的旧文件按json读取
+	legacy := filepath.Join(dir, "legacy.kv")
+	assert.Nil(t, ioutil.WriteFile(legacy, []byte(`{"name":"InRvbSI="}`), 0644))
+	kv := filekv.NewFileKV()
+	assert.Equal(t, "tom", kv.GetString(legacy, "name"))
+	assert.Nil(t, kv.Set(legacy, "age", 18))
+	assert.Equal(t, "tom", kv.GetString(legacy, "name"))
+
+	//SetEncryptFn只影响当前实例
+	encrypted := filekv.NewFileKV()
+	encrypted.SetEncryptFn(func(data []byte) ([]byte, error) {
+		return []byte(base64.StdEncoding.EncodeToString(data)), nil
+	})
+	encrypted.SetDecryptFn(func(data []byte) ([]byte, error) {
+		return base64.StdEncoding.DecodeString(string(data))
+	})
+	fileName := filepath.Join(dir, "encrypted.kv")
+	assert.Nil(t, encrypted.Set(fileName, "key", "value"))
+	assert.Equal(t, "value", encrypted.GetString(fileName, "key"))
+
+	plain := filepath.Join(dir, "plain.kv")
+	assert.Nil(t, kv.Set(plain, "key", "value"))
+	content, err := ioutil.ReadFile(plain)
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), `"cipher":"none"`)
+
+	err = kv.MustGet(fileName, "key", new(string))
+	assert.True(t, errors.Is(err, filekv.ErrCodecMismatch))
+}
+
+func TestFileKV_Watch(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "kv.json")
+
+	kv := filekv.NewFileKV()
+	assert.Nil(t, kv.Set(fileName, "state_a", 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := kv.Watch(ctx, fileName, "state_")
+	assert.Nil(t, err)
+
+	next := func() filekv.Change {
+		select {
+		case change := <-changes:
+			return change
+		case <-time.After(5 * time.Second):
+			t.Fatal("wait change timeout")
+		}
+		return filekv.Change{}
+	}
+
+	//本进程的修改
+	assert.Nil(t, kv.Set(fileName, "other", 1))
+	assert.Nil(t, kv.Set(fileName, "state_a", 2))
+	change := next()
+	assert.Equal(t, "state_a", change.Key)
+	assert.Equal(t, "1", string(change.Old))
+	assert.Equal(t, "2", string(change.New))
+	assert.NotEmpty(t, change.UpdateTime)
+
+	//其他实例(相当于其他进程)的修改，依赖fsnotify
+	other := filekv.NewFileKV()
+	assert.Nil(t, other.Set(fileName, "state_b", "b"))
+	change = next()
+	assert.Equal(t, "state_b", change.Key)
+	assert.Nil(t, change.Old)
+	assert.Equal(t, `"b"`, string(change.New))
+
+	assert.Nil(t, other.Delete(fileName, "state_a"))
+	change = next()
+	assert.Equal(t, "state_a", change.Key)
+	assert.Equal(t, "2", string(change.Old))
+	assert.Nil(t, change.New)
+
+	//过期
+	assert.Nil(t, kv.SetWithTTL(fileName, "state_c", 3, 100*time.Millisecond))
+	change = next()
+	assert.Equal(t, "state_c", change.Key)
+	assert.Equal(t, "3", string(change.New))
+	change = next()
+	assert.Equal(t, "state_c", change.Key)
+	assert.Nil(t, change.New)
+
+	//其他实例迁移为分桶后继续监听分桶目录
+	other.SetBuckets(4)
+	assert.Nil(t, other.Set(fileName, "state_d", 4))
+	change = next()
+	assert.Equal(t, "state_d", change.Key)
+	assert.Nil(t, other.Set(fileName, "state_d", 5))
+	change = next()
+	assert.Equal(t, "state_d", change.Key)
+	assert.Equal(t, "5", string(change.New))
+
+	cancel()
+	for range changes {
+	}
+}
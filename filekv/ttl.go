@@ -0,0 +1,207 @@
+package filekv
+
+import (
+	"bytes"
+	"context"
+	"github.com/logxxx/utils/runutil"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// 过期时间保存在每个数据文件的__expire__中。
+// 过期的key对Get/Range等读取不可见，在所在文件下一次写入时清理，也可以用Sweep/StartSweeper主动清理
+
+func nowMilli() int64 {
+	return time.Now().UnixNano() / 1e6
+}
+
+func expireAtOf(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return nowMilli() + int64(ttl/time.Millisecond)
+}
+
+// SetWithTTL 写入key，ttl之后过期。ttl<=0时与Set相同，不过期
+func (w *FileKV) SetWithTTL(fileName, key string, value interface{}, ttl time.Duration) error {
+
+	valueBytes, err := w.marshalValue(value)
+	if err != nil {
+		log.Errorf("FileKV.SetWithTTL marshalValue err:%v key:%v value:%+v", err, key, value)
+		return err
+	}
+
+	_, err = w.updateWithLock(fileName, []*mutation{{key: key, value: valueBytes, expireAt: expireAtOf(ttl)}})
+	if err != nil {
+		return err
+	}
+
+	w.markTTLFile(fileName, ttl)
+
+	return nil
+}
+
+// SetNX key不存在(或已过期)时才写入，返回是否写入。ttl<=0时不过期
+func (w *FileKV) SetNX(fileName, key string, value interface{}, ttl time.Duration) (bool, error) {
+
+	valueBytes, err := w.marshalValue(value)
+	if err != nil {
+		log.Errorf("FileKV.SetNX marshalValue err:%v key:%v value:%+v", err, key, value)
+		return false, err
+	}
+
+	ok, err := w.updateWithLock(fileName, []*mutation{{
+		key:      key,
+		value:    valueBytes,
+		expireAt: expireAtOf(ttl),
+		cond: func(old []byte, exists bool) bool {
+			return !exists
+		},
+	}})
+	if err != nil {
+		return false, err
+	}
+
+	if ok {
+		w.markTTLFile(fileName, ttl)
+	}
+
+	return ok, nil
+}
+
+// CompareAndSwap 当前值与old相同时替换为new，返回是否替换。
+// 比较的是codec编码后的结果，old为nil时表示key不存在。替换后保留原来的过期时间
+func (w *FileKV) CompareAndSwap(fileName, key string, old, new interface{}) (bool, error) {
+
+	var oldBytes []byte
+	if old != nil {
+		var err error
+		oldBytes, err = w.marshalValue(old)
+		if err != nil {
+			log.Errorf("FileKV.CompareAndSwap marshalValue old err:%v key:%v old:%+v", err, key, old)
+			return false, err
+		}
+	}
+
+	newBytes, err := w.marshalValue(new)
+	if err != nil {
+		log.Errorf("FileKV.CompareAndSwap marshalValue new err:%v key:%v new:%+v", err, key, new)
+		return false, err
+	}
+
+	return w.updateWithLock(fileName, []*mutation{{
+		key:     key,
+		value:   newBytes,
+		keepTTL: true,
+		cond: func(current []byte, exists bool) bool {
+			if oldBytes == nil {
+				return !exists
+			}
+			return exists && bytes.Equal(current, oldBytes)
+		},
+	}})
+}
+
+// Sweep 清理fileName中已过期的key，返回清理的数量
+func (w *FileKV) Sweep(fileName string) (int, error) {
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	fileLock, err := w.lockFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer fileLock.Unlock()
+
+	files, err := w.dataFiles(fileName)
+	if err != nil {
+		log.Errorf("FileKV.Sweep dataFiles err:%v fileName:%v", err, fileName)
+		return 0, err
+	}
+
+	now := nowMilli()
+	count := 0
+	for _, path := range files {
+		c, err := w.loadFile(path)
+		if err != nil {
+			return count, err
+		}
+
+		expired := 0
+		for key := range c.expire {
+			if _, ok := c.data[key]; ok && c.isExpired(key, now) {
+				expired++
+			}
+		}
+		if expired <= 0 {
+			continue
+		}
+
+		newData := make(map[string][]byte, len(c.data))
+		for k, v := range c.data {
+			newData[k] = v
+		}
+		newExpire := make(map[string]int64, len(c.expire))
+		for k, v := range c.expire {
+			newExpire[k] = v
+		}
+
+		err = w.writeFile(path, newData, newExpire)
+		if err != nil {
+			return count, err
+		}
+		count += expired
+	}
+
+	return count, nil
+}
+
+// StartSweeper 每隔interval清理一次当前实例写入过带ttl数据的文件，直到ctx结束
+func (w *FileKV) StartSweeper(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	runutil.GoRunSafe(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, fileName := range w.ttlFileNames() {
+				count, err := w.Sweep(fileName)
+				if err != nil {
+					log.Errorf("FileKV.StartSweeper Sweep err:%v fileName:%v", err, fileName)
+					continue
+				}
+				if count > 0 {
+					log.Debugf("FileKV.StartSweeper fileName:%v expired:%v", fileName, count)
+				}
+			}
+		}
+	})
+}
+
+func (w *FileKV) markTTLFile(fileName string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	w.cacheLock.Lock()
+	defer w.cacheLock.Unlock()
+	if w.ttlFiles == nil {
+		w.ttlFiles = make(map[string]bool)
+	}
+	w.ttlFiles[fileName] = true
+}
+
+func (w *FileKV) ttlFileNames() []string {
+	w.cacheLock.Lock()
+	defer w.cacheLock.Unlock()
+	result := make([]string, 0, len(w.ttlFiles))
+	for fileName := range w.ttlFiles {
+		result = append(result, fileName)
+	}
+	return result
+}
@@ -0,0 +1,349 @@
+package filekv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/fsnotify/fsnotify"
+	"github.com/logxxx/utils/notify"
+	"github.com/logxxx/utils/runutil"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Watch的实现：
+// 本进程写入数据文件后通过notify发布事件，其他进程的写入由fsnotify监听所在目录得到，
+// 两者都只用来唤醒watcher，watcher重新读取后与上一次的快照比较得到变化，
+// 因此重复或多余的事件不会产生重复的Change。
+
+// Change 一个key的变化。value与GetMany一样是codec编码后的原始数据
+type Change struct {
+	Key        string          `json:"key"`
+	Old        json.RawMessage `json:"old"`         // 新增时为nil
+	New        json.RawMessage `json:"new"`         // 删除或过期时为nil
+	UpdateTime string          `json:"update_time"` // key所在数据文件的update_time
+}
+
+type watcher struct {
+	fileName string
+	prefix   string
+	wakeCh   chan struct{}
+}
+
+type watchValue struct {
+	value    []byte
+	expireAt int64
+}
+
+// Watch 监听fileName中以keyPrefix开头的key的变化，ctx结束后关闭返回的channel。
+// 只返回Watch之后的变化；消费过慢时多次变化会合并为一次
+func (w *FileKV) Watch(ctx context.Context, fileName, keyPrefix string) (<-chan Change, error) {
+
+	wt := &watcher{
+		fileName: fileName,
+		prefix:   keyPrefix,
+		wakeCh:   make(chan struct{}, 1),
+	}
+
+	//先注册再读取快照，避免两者之间的修改被漏掉
+	err := w.addWatcher(wt)
+	if err != nil {
+		return nil, err
+	}
+
+	values, _, err := w.snapshot(fileName, keyPrefix)
+	if err != nil {
+		w.removeWatcher(wt)
+		return nil, err
+	}
+
+	out := make(chan Change)
+	runutil.GoRunSafe(func() {
+		defer close(out)
+		defer w.removeWatcher(wt)
+		w.watchLoop(ctx, wt, values, out)
+	})
+
+	return out, nil
+}
+
+func (w *FileKV) watchLoop(ctx context.Context, wt *watcher, values map[string]*watchValue, out chan<- Change) {
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		//到最近一个key的过期时间时也要检查一次
+		timer.Stop()
+		if next := nextExpireAt(values); next > 0 {
+			timer.Reset(time.Duration(next-nowMilli()) * time.Millisecond)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wt.wakeCh:
+		case <-timer.C:
+		}
+
+		newValues, updateTimes, err := w.snapshot(wt.fileName, wt.prefix)
+		if err != nil {
+			log.Errorf("FileKV.Watch snapshot err:%v fileName:%v", err, wt.fileName)
+			continue
+		}
+
+		changes, err := w.diff(wt.fileName, values, newValues, updateTimes)
+		if err != nil {
+			log.Errorf("FileKV.Watch diff err:%v fileName:%v", err, wt.fileName)
+			continue
+		}
+		values = newValues
+
+		for _, change := range changes {
+			select {
+			case <-ctx.Done():
+				return
+			case out <- change:
+			}
+		}
+	}
+}
+
+func nextExpireAt(values map[string]*watchValue) int64 {
+	var next int64
+	for _, v := range values {
+		if v.expireAt > 0 && (next == 0 || v.expireAt < next) {
+			next = v.expireAt
+		}
+	}
+	return next
+}
+
+// snapshot 返回当前以prefix开头的所有key，以及每个数据文件的update_time
+func (w *FileKV) snapshot(fileName, prefix string) (map[string]*watchValue, map[string]string, error) {
+
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	files, err := w.dataFiles(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := nowMilli()
+	values := make(map[string]*watchValue)
+	updateTimes := make(map[string]string, len(files))
+	for _, path := range files {
+		c, err := w.loadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		updateTimes[path] = string(c.data[updateTimeKey])
+		for k := range c.data {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			if v, ok := c.get(k, now); ok {
+				values[k] = &watchValue{value: v, expireAt: c.expire[k]}
+			}
+		}
+	}
+
+	return values, updateTimes, nil
+}
+
+// diff 比较两次快照，按key的字典序返回变化
+func (w *FileKV) diff(fileName string, oldValues, newValues map[string]*watchValue, updateTimes map[string]string) ([]Change, error) {
+
+	keys := make([]string, 0)
+	for k, v := range newValues {
+		if old, ok := oldValues[k]; !ok || !bytes.Equal(old.value, v.value) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range oldValues {
+		if _, ok := newValues[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) <= 0 {
+		return nil, nil
+	}
+
+	groups, err := w.dataFileOf(fileName, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]Change, 0, len(keys))
+	for path, pathKeys := range groups {
+		for _, k := range pathKeys {
+			change := Change{Key: k, UpdateTime: updateTimes[path]}
+			if old, ok := oldValues[k]; ok {
+				change.Old = old.value
+			}
+			if v, ok := newValues[k]; ok {
+				change.New = v.value
+			}
+			changes = append(changes, change)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+
+	return changes, nil
+}
+
+func (w *FileKV) addWatcher(wt *watcher) error {
+
+	w.watchLock.Lock()
+	defer w.watchLock.Unlock()
+
+	if w.notifier == nil {
+		w.notifier = notify.NewNotifyEngine().NewNotify("filekv")
+		w.notifier.Sub(w.dispatch)
+	}
+
+	if w.fsWatcher == nil {
+		fsWatcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			log.Errorf("FileKV.Watch NewWatcher err:%v", err)
+			return err
+		}
+		w.fsWatcher = fsWatcher
+		w.watchDirs = make(map[string]bool)
+		runutil.GoRunSafe(func() {
+			w.watchFs(fsWatcher)
+		})
+	}
+
+	dir := filepath.Dir(wt.fileName)
+	if !w.watchDirs[dir] {
+		os.MkdirAll(dir, 0755)
+		err := w.fsWatcher.Add(dir)
+		if err != nil {
+			log.Errorf("FileKV.Watch watch dir err:%v dir:%v", err, dir)
+			return err
+		}
+		w.watchDirs[dir] = true
+	}
+	w.watchBucketDir(wt.fileName)
+
+	if w.watchers == nil {
+		w.watchers = make(map[*watcher]bool)
+	}
+	w.watchers[wt] = true
+
+	return nil
+}
+
+// watchBucketDir 分桶目录存在时加入监听，需要持有watchLock
+func (w *FileKV) watchBucketDir(fileName string) {
+	dir := bucketDir(fileName)
+	if w.fsWatcher == nil || w.watchDirs[dir] || !isDir(dir) {
+		return
+	}
+	err := w.fsWatcher.Add(dir)
+	if err != nil {
+		log.Errorf("FileKV.Watch watch bucket dir err:%v dir:%v", err, dir)
+		return
+	}
+	w.watchDirs[dir] = true
+}
+
+func isDir(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && stat.IsDir()
+}
+
+func (w *FileKV) removeWatcher(wt *watcher) {
+
+	w.watchLock.Lock()
+	defer w.watchLock.Unlock()
+
+	delete(w.watchers, wt)
+	if len(w.watchers) > 0 || w.fsWatcher == nil {
+		return
+	}
+
+	//没有watcher时停止监听目录
+	w.fsWatcher.Close()
+	w.fsWatcher = nil
+	w.watchDirs = nil
+}
+
+// watchFs 把其他进程对数据文件的修改转发到notifier
+func (w *FileKV) watchFs(fsWatcher *fsnotify.Watcher) {
+	for {
+		select {
+		case e, ok := <-fsWatcher.Events:
+			if !ok {
+				return
+			}
+			if e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+			w.publish(e.Name, e.Op)
+		case err, ok := <-fsWatcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("FileKV watcher err:%v", err)
+		}
+	}
+}
+
+// publish 通知watcher数据文件path发生了变化
+func (w *FileKV) publish(path string, op fsnotify.Op) {
+	w.watchLock.Lock()
+	notifier := w.notifier
+	hasWatcher := len(w.watchers) > 0
+	w.watchLock.Unlock()
+
+	if notifier == nil || !hasWatcher {
+		return
+	}
+	//队列满时已有待处理的事件，watcher会重新读取全部数据，可以丢弃
+	_ = notifier.Pub(&fsnotify.Event{Name: path, Op: op})
+}
+
+func (w *FileKV) dispatch(e *fsnotify.Event) {
+	if e == nil {
+		return
+	}
+
+	w.watchLock.Lock()
+	defer w.watchLock.Unlock()
+
+	for wt := range w.watchers {
+		if !isDataFileOf(wt.fileName, e.Name) {
+			continue
+		}
+		if e.Name == bucketDir(wt.fileName) {
+			w.watchBucketDir(wt.fileName)
+		}
+		select {
+		case wt.wakeCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// isDataFileOf path是否是fileName的数据文件、分桶目录或分桶meta
+func isDataFileOf(fileName, path string) bool {
+	fileName = filepath.Clean(fileName)
+	path = filepath.Clean(path)
+	if path == fileName || path == bucketDir(fileName) {
+		return true
+	}
+	if filepath.Dir(path) != bucketDir(fileName) {
+		return false
+	}
+	name := filepath.Base(path)
+	return name == "meta.json" || strings.HasPrefix(name, "bucket_") && !strings.Contains(name, ".tmp")
+}
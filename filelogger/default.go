@@ -1,24 +1,52 @@
 package filelogger
 
-import "log"
+import (
+	"fmt"
+	"log"
+	"sync"
+)
 
 var (
-	_default *Logger
+	_default     *Logger
+	_defaultLock sync.Mutex
 )
 
-func initDefaultLogger() {
-	_default, _ = NewLogger("default")
+// defaultLogger 第一次使用时创建，创建失败时下次再试
+func defaultLogger() *Logger {
+	_defaultLock.Lock()
+	defer _defaultLock.Unlock()
+	if _default == nil {
+		_default, _ = NewLogger("default")
+	}
+	return _default
+}
+
+func Debugf(format string, args ...interface{}) {
+	defaultLogf(DebugLevel, format, args...)
 }
 
 func Infof(format string, args ...interface{}) {
+	defaultLogf(InfoLevel, format, args...)
+}
 
-	if _default == nil {
-		initDefaultLogger()
+func Warnf(format string, args ...interface{}) {
+	defaultLogf(WarnLevel, format, args...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	defaultLogf(ErrorLevel, format, args...)
+}
+
+func defaultLogf(level Level, format string, args ...interface{}) {
+
+	logger := defaultLogger()
+	if logger != nil && level < logger.GetLevel() {
+		return
 	}
 
-	prefix := "[info]"
-	log.Printf(prefix+format, args...)
-	if _default != nil {
-		_default.writeToFile(prefix+format, args...)
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("[%v]%v", level, msg)
+	if logger != nil {
+		logger.writeToFile(level, msg)
 	}
 }
@@ -0,0 +1,195 @@
+package filelogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+func (l Level) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+func (l *Level) UnmarshalJSON(data []byte) error {
+	s := ""
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	*l, err = ParseLevel(s)
+	return err
+}
+
+// ParseLevel 解析debug/info/warn/error，不区分大小写
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToLower(s)
+	if s == "warning" {
+		return WarnLevel, nil
+	}
+	for i, name := range levelNames {
+		if name == s {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("invalid level:%v", s)
+}
+
+type Format int32
+
+const (
+	TextFormat Format = iota // [15:04:05][info][k=v]msg，条目之间空一行
+	JSONFormat               // 每行一个json对象，见Entry
+)
+
+// Entry 一条日志
+type Entry struct {
+	Time   time.Time              `json:"time"`
+	Level  Level                  `json:"level"`
+	Biz    string                 `json:"biz"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	Msg    string                 `json:"msg"`
+}
+
+// format 格式化为写入文件的内容，fields为Fields的输出顺序，为空时按key排序
+func (e *Entry) format(f Format, fields []Field) []byte {
+	if f == JSONFormat {
+		data, err := json.Marshal(e)
+		if err != nil {
+			//字段值无法序列化时退化为字符串
+			entry := *e
+			entry.Fields = make(map[string]interface{}, len(e.Fields))
+			for k, v := range e.Fields {
+				entry.Fields[k] = fmt.Sprint(v)
+			}
+			data, _ = json.Marshal(entry)
+		}
+		return append(data, '\n')
+	}
+
+	if len(fields) == 0 && len(e.Fields) > 0 {
+		keys := make([]string, 0, len(e.Fields))
+		for k := range e.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fields = append(fields, Field{Key: k, Value: e.Fields[k]})
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(e.Time.Format("[15:04:05]"))
+	buf.WriteString("[" + e.Level.String() + "]")
+	for _, field := range fields {
+		buf.WriteString(field.Format())
+	}
+	buf.WriteString(e.Msg)
+	buf.WriteString("\n\n")
+	return buf.Bytes()
+}
+
+var textHeader = regexp.MustCompile(`^\[(\d{2}:\d{2}:\d{2})\]\[(debug|info|warn|error)\](.*)$`)
+
+// parseEntries 解析文件内容，day为文件中内容所在的日期(文本格式只记录了时分秒)。
+// 两种格式可以混在同一个文件中，文本格式的多行消息会合并为一条
+func parseEntries(biz string, day string, content []byte) []*Entry {
+	entries := make([]*Entry, 0)
+	var last *Entry
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "{") {
+			e := &Entry{}
+			if json.Unmarshal([]byte(line), e) == nil {
+				entries = append(entries, e)
+				last = nil
+				continue
+			}
+		}
+
+		match := textHeader.FindStringSubmatch(line)
+		if match == nil {
+			//文本格式消息的后续行
+			if last != nil {
+				last.Msg += "\n" + line
+			}
+			continue
+		}
+
+		t, err := time.ParseInLocation("20060102 15:04:05", day+" "+match[1], time.Local)
+		if err != nil {
+			continue
+		}
+		level, _ := ParseLevel(match[2])
+		last = &Entry{Time: t, Level: level, Biz: biz}
+		last.Fields, last.Msg = parseTextFields(match[3])
+		entries = append(entries, last)
+	}
+
+	for _, e := range entries {
+		e.Msg = strings.TrimRight(e.Msg, "\n")
+	}
+	return entries
+}
+
+// entryStarts 返回content中每条日志的起始位置
+func entryStarts(content []byte) []int {
+	starts := make([]int, 0)
+	pos := 0
+	for pos < len(content) {
+		end := bytes.IndexByte(content[pos:], '\n')
+		if end < 0 {
+			end = len(content)
+		} else {
+			end += pos
+		}
+		line := content[pos:end]
+		if bytes.HasPrefix(line, []byte("{")) || textHeader.Match(line) {
+			starts = append(starts, pos)
+		}
+		pos = end + 1
+	}
+	return starts
+}
+
+// parseTextFields 拆出消息前的[k=v]、[k]
+func parseTextFields(s string) (map[string]interface{}, string) {
+	var fields map[string]interface{}
+	for strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			break
+		}
+		if fields == nil {
+			fields = make(map[string]interface{})
+		}
+		kv := s[1:end]
+		if idx := strings.Index(kv, "="); idx >= 0 {
+			fields[kv[:idx]] = kv[idx+1:]
+		} else {
+			fields[kv] = ""
+		}
+		s = s[end+1:]
+	}
+	return fields, s
+}
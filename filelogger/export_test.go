@@ -0,0 +1,12 @@
+package filelogger
+
+import "time"
+
+// SetTimeNow 替换当前时间，返回恢复函数
+func SetTimeNow(fn func() time.Time) func() {
+	old := timeNow
+	timeNow = fn
+	return func() {
+		timeNow = old
+	}
+}
@@ -0,0 +1,150 @@
+package filelogger
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Hook 把logrus的日志按字段(默认biz)转发到对应的filelogger Logger，
+// 字段和级别一起带过去，这样已有的log.WithField("biz", xxx)不用改代码就能在/log/:biz看到。
+//
+//	log.AddHook(filelogger.NewHook())
+//	log.WithField("biz", "order").WithField("id", 1).Warnf("timeout")
+//
+// 字段的值来自调用方，每个不同的值都会创建一个Logger并一直打开文件，
+// 值不受控制时应当用WithAllowedBiz限定范围。
+type Hook struct {
+	bizField   string
+	defaultBiz string
+	allowed    map[string]bool // 为nil时不限制
+	levels     []log.Level
+	opts       *Options
+}
+
+type HookOption func(h *Hook)
+
+// WithBizField 用哪个字段的值作为bizName，默认为biz
+func WithBizField(field string) HookOption {
+	return func(h *Hook) {
+		h.bizField = field
+	}
+}
+
+// WithDefaultBiz 没有bizName字段的日志写入defaultBiz，默认不转发
+func WithDefaultBiz(biz string) HookOption {
+	return func(h *Hook) {
+		h.defaultBiz = biz
+	}
+}
+
+// WithAllowedBiz 只转发这些biz的日志，其他值写入defaultBiz(原值保留在字段中)，默认不限制
+func WithAllowedBiz(bizs ...string) HookOption {
+	return func(h *Hook) {
+		h.allowed = make(map[string]bool, len(bizs))
+		for _, biz := range bizs {
+			h.allowed[biz] = true
+		}
+	}
+}
+
+// WithHookLevels 只转发这些级别的日志，默认全部
+func WithHookLevels(levels ...log.Level) HookOption {
+	return func(h *Hook) {
+		h.levels = levels
+	}
+}
+
+// WithLoggerOptions 创建Logger时使用的配置，默认与NewLogger一致
+func WithLoggerOptions(opts Options) HookOption {
+	return func(h *Hook) {
+		h.opts = &opts
+	}
+}
+
+func NewHook(opts ...HookOption) *Hook {
+	h := &Hook{
+		bizField: "biz",
+		levels:   log.AllLevels,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+func (h *Hook) Levels() []log.Level {
+	return h.levels
+}
+
+func (h *Hook) Fire(e *log.Entry) error {
+
+	//filelogger自己打的日志已经写过文件
+	if _, ok := e.Data[internalField]; ok {
+		return nil
+	}
+
+	biz := h.defaultBiz
+	rejected := false
+	if v, ok := e.Data[h.bizField]; ok {
+		biz = fmt.Sprint(v)
+		//值不合法(如包含路径)或不在允许范围内时写入defaultBiz，保留原值
+		if !validBizName(biz) || (h.allowed != nil && !h.allowed[biz]) {
+			biz = h.defaultBiz
+			rejected = true
+		}
+	}
+	if biz == "" {
+		return nil
+	}
+
+	logger, err := h.getLogger(biz)
+	if err != nil {
+		return err
+	}
+
+	level := fromLogrusLevel(e.Level)
+	if level < logger.GetLevel() {
+		return nil
+	}
+
+	entry := &Entry{
+		Time:  e.Time,
+		Level: level,
+		Biz:   biz,
+		Msg:   e.Message,
+	}
+	for k, v := range e.Data {
+		if k == h.bizField && !rejected {
+			continue
+		}
+		if entry.Fields == nil {
+			entry.Fields = make(map[string]interface{}, len(e.Data))
+		}
+		//error序列化为json时是{}
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry.Fields[k] = v
+	}
+
+	return logger.writeEntry(entry, nil)
+}
+
+func (h *Hook) getLogger(biz string) (*Logger, error) {
+	if h.opts == nil {
+		return NewLogger(biz)
+	}
+	return NewLoggerWithOptions(biz, *h.opts)
+}
+
+func fromLogrusLevel(level log.Level) Level {
+	switch level {
+	case log.TraceLevel, log.DebugLevel:
+		return DebugLevel
+	case log.InfoLevel:
+		return InfoLevel
+	case log.WarnLevel:
+		return WarnLevel
+	}
+	return ErrorLevel
+}
@@ -0,0 +1,116 @@
+package filelogger_test
+
+import (
+	"errors"
+	"github.com/logxxx/utils/filelogger"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHook(t *testing.T) {
+	dir := t.TempDir()
+	l := logrus.New()
+	l.Out = ioutil.Discard
+	l.Level = logrus.DebugLevel
+	l.AddHook(filelogger.NewHook(
+		filelogger.WithLoggerOptions(filelogger.Options{Dir: dir}),
+		filelogger.WithDefaultBiz("hook_default"),
+	))
+
+	l.WithField("biz", "hook_order").WithField("id", 7).WithError(errors.New("boom")).Warnf("pay %v", "timeout")
+	l.WithField("biz", "hook_order").Debug("detail")
+	l.Info("no biz")
+
+	order, err := filelogger.NewLoggerWithOptions("hook_order", filelogger.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer order.Close()
+	entries, err := order.Query(filelogger.Query{})
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(entries)) {
+		assert.Equal(t, filelogger.WarnLevel, entries[0].Level)
+		assert.Equal(t, "pay timeout", entries[0].Msg)
+		assert.Equal(t, map[string]interface{}{"id": "7", "error": "boom"}, entries[0].Fields)
+		assert.Equal(t, filelogger.DebugLevel, entries[1].Level)
+	}
+	assert.Contains(t, order.GetFromFile(), "[warn][error=boom][id=7]pay timeout")
+
+	def, err := filelogger.NewLoggerWithOptions("hook_default", filelogger.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer def.Close()
+	assert.Contains(t, def.GetFromFile(), "[info]no biz")
+
+	//Logger的最低级别同样生效
+	order.SetLevel(filelogger.InfoLevel)
+	l.WithField("biz", "hook_order").Debug("dropped")
+	assert.NotContains(t, order.GetFromFile(), "dropped")
+}
+
+func TestHook_SkipInternal(t *testing.T) {
+	dir := t.TempDir()
+	std := logrus.StandardLogger()
+	old := std.ReplaceHooks(make(logrus.LevelHooks))
+	defer std.ReplaceHooks(old)
+	std.AddHook(filelogger.NewHook(
+		filelogger.WithLoggerOptions(filelogger.Options{Dir: dir}),
+		filelogger.WithDefaultBiz("hook_internal"),
+	))
+
+	//Logger打印到logrus的日志不会经过Hook再写一遍
+	logger, err := filelogger.NewLoggerWithOptions("hook_internal", filelogger.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	logger.Infof("once")
+	assert.Equal(t, 1, strings.Count(logger.GetFromFile(), "once"))
+}
+
+func TestHook_RejectBiz(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "logs")
+	l := logrus.New()
+	l.Out = ioutil.Discard
+	l.AddHook(filelogger.NewHook(
+		filelogger.WithLoggerOptions(filelogger.Options{Dir: dir}),
+		filelogger.WithDefaultBiz("hook_reject"),
+		filelogger.WithAllowedBiz("hook_allowed"),
+	))
+
+	//路径和不在允许范围内的值写入defaultBiz，原值保留在字段中
+	l.WithField("biz", "../escape").Info("path")
+	l.WithField("biz", "hook_other").Info("other")
+	l.WithField("biz", "hook_allowed").Info("allowed")
+
+	def, err := filelogger.NewLoggerWithOptions("hook_reject", filelogger.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer def.Close()
+	content := def.GetFromFile()
+	assert.Contains(t, content, "[info][biz=../escape]path")
+	assert.Contains(t, content, "[info][biz=hook_other]other")
+	assert.NotContains(t, content, "allowed")
+
+	allowed, err := filelogger.NewLoggerWithOptions("hook_allowed", filelogger.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowed.Close()
+	assert.Contains(t, allowed.GetFromFile(), "[info]allowed")
+
+	assert.Equal(t, []string{"logs"}, listFiles(t, root))
+	assert.Equal(t, []string{"filelog_hook_allowed.txt", "filelog_hook_reject.txt"}, listFiles(t, dir))
+
+	for _, name := range []string{"", "../escape", "a/b", `a\b`, ".."} {
+		_, err = filelogger.NewLoggerWithOptions(name, filelogger.Options{Dir: dir})
+		assert.True(t, errors.Is(err, filelogger.ErrInvalidBizName), name)
+	}
+}
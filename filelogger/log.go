@@ -1,25 +1,28 @@
 package filelogger
 
 import (
+	"errors"
 	"fmt"
-	"github.com/logxxx/utils/fileutil"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
-	"os"
-	"sync"
-	"time"
+	"strings"
+	"sync/atomic"
 )
 
-var (
-	loggerMap   = make(map[string]*Logger, 0)       //k:bizName
-	logFileLock = make(map[string]*sync.RWMutex, 0) //k:fileName
-)
+// ErrInvalidBizName bizName会作为文件名的一部分，不能为空，不能包含路径分隔符和..
+var ErrInvalidBizName = errors.New("invalid biz name")
 
 type Logger struct {
-	bizName  string
-	fileName string
-	file     *os.File
-	fields   []Field
+	bizName string
+	out     *output
+	fields  []Field
+}
+
+// internalField 包内打的logrus日志都带上这个字段(值为bizName)，Hook不转发这些日志，
+// 避免重复写入，以及持有文件锁时打的日志重入同一个文件
+const internalField = "filelogger"
+
+func internalLog(bizName string) *log.Entry {
+	return log.WithField(internalField, bizName)
 }
 
 type Field struct {
@@ -29,7 +32,7 @@ type Field struct {
 
 func (f *Field) Format() string {
 	result := ""
-	if f.Value != "" {
+	if f.Value != nil && f.Value != "" {
 		result = fmt.Sprintf("[%v=%v]", f.Key, f.Value)
 	} else {
 		result = fmt.Sprintf("[%v]", f.Key)
@@ -37,30 +40,27 @@ func (f *Field) Format() string {
 	return result
 }
 
+// NewLogger 使用默认配置(见SetDefaultOptions)创建Logger，同一个bizName返回同一个Logger
 func NewLogger(bizName string) (*Logger, error) {
-	logger := loggerMap[bizName]
-	if logger != nil {
-		return logger, nil
-	}
-
-	name := getLoggerName(bizName)
-	os.Remove(name)
-	f, err := os.Create(name)
-	if err != nil {
-		return nil, err
-	}
+	return NewLoggerWithOptions(bizName, getDefaultOptions())
+}
 
-	logger = &Logger{
-		bizName:  bizName,
-		fileName: name,
-		file:     f,
+// NewLoggerWithOptions 创建Logger，已存在的日志文件会继续追加。
+// bizName已经创建过时直接返回已有的Logger，opts不生效
+func NewLoggerWithOptions(bizName string, opts Options) (*Logger, error) {
+	if !validBizName(bizName) {
+		return nil, fmt.Errorf("%w:%q", ErrInvalidBizName, bizName)
 	}
-
-	loggerMap[bizName] = logger
-	logFileLock[name] = &sync.RWMutex{}
-
-	return logger, nil
-
+	return _registry.getOrCreate(bizName, func() (*Logger, error) {
+		out, err := newOutput(bizName, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &Logger{
+			bizName: bizName,
+			out:     out,
+		}, nil
+	})
 }
 
 func (l *Logger) WithField(key string, values ...interface{}) *Logger {
@@ -83,86 +83,147 @@ func (l *Logger) WithField(key string, values ...interface{}) *Logger {
 		newField.Value = values[0]
 	}
 
+	//复制一份，避免同一个Logger派生的多个子Logger共用底层数组
+	fields := make([]Field, 0, len(l.fields)+1)
+	fields = append(fields, l.fields...)
+	fields = append(fields, newField)
+
 	newLogger := &Logger{
-		bizName:  l.bizName,
-		fileName: l.fileName,
-		file:     l.file,
-		fields:   append(l.fields, newField),
+		bizName: l.bizName,
+		out:     l.out,
+		fields:  fields,
 	}
 	return newLogger
 }
 
+// SetLevel 设置最低级别，低于level的日志不记录，对同一个biz的所有Logger生效
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32((*int32)(&l.out.level), int32(level))
+}
+
+func (l *Logger) GetLevel() Level {
+	return Level(atomic.LoadInt32((*int32)(&l.out.level)))
+}
+
+// SetFormat 设置之后写入的日志格式，对同一个biz的所有Logger生效
+func (l *Logger) SetFormat(format Format) {
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	l.out.format = format
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(DebugLevel, format, args...)
+}
+
 func (l *Logger) Infof(format string, args ...interface{}) {
-	prefix := "[info]"
+	l.logf(InfoLevel, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(WarnLevel, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(ErrorLevel, format, args...)
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if level < l.GetLevel() {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	prefix := "[" + level.String() + "]"
 	for _, field := range l.fields {
 		prefix += field.Format()
 	}
-	log.Infof(prefix+format, args...)
-	l.writeToFile(prefix+format, args...)
-}
+	echo := internalLog(l.bizName)
+	switch level {
+	case DebugLevel:
+		echo.Debug(prefix + msg)
+	case InfoLevel:
+		echo.Info(prefix + msg)
+	case WarnLevel:
+		echo.Warn(prefix + msg)
+	default:
+		echo.Error(prefix + msg)
+	}
 
-func (l *Logger) writeToFile(format string, args ...interface{}) {
+	l.writeToFile(level, msg)
+}
 
-	logFileLock[l.fileName].Lock()
-	defer logFileLock[l.fileName].Unlock()
+func (l *Logger) writeToFile(level Level, msg string) {
 
-	if l.file == nil {
-		return
+	entry := &Entry{
+		Time:  timeNow(),
+		Level: level,
+		Biz:   l.bizName,
+		Msg:   msg,
+	}
+	if len(l.fields) > 0 {
+		entry.Fields = make(map[string]interface{}, len(l.fields))
+		for _, field := range l.fields {
+			entry.Fields[field.Key] = field.Value
+		}
 	}
 
-	if !fileutil.HasFile(l.fileName) {
-		return
+	err := l.writeEntry(entry, l.fields)
+	if err != nil {
+		internalLog(l.bizName).Errorf("Logger writeToFile err:%v", err)
 	}
 
-	content := fmt.Sprintf(format, args...)
-	now := time.Now().Format("[15:04:05]")
-	_, _ = l.file.WriteString(now + content + "\n\n")
+}
+
+// writeEntry 写入一条日志，fields为文本格式中字段的顺序，为空时按key排序
+func (l *Logger) writeEntry(entry *Entry, fields []Field) error {
+
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+
+	return l.out.write(entry.format(l.out.format, fields))
 
 }
 
+// GetFromFile 返回所有日志，包括切分出的旧文件，从旧到新
 func (l *Logger) GetFromFile() string {
 
-	logFileLock[l.fileName].RLock()
-	defer logFileLock[l.fileName].RUnlock()
+	l.out.lock.RLock()
+	defer l.out.lock.RUnlock()
 
-	content, _ := ioutil.ReadFile(l.fileName)
+	content, err := l.out.readAll()
+	if err != nil {
+		internalLog(l.bizName).Errorf("Logger GetFromFile err:%v", err)
+	}
 	return string(content)
 
 }
 
+// Close 关闭文件，日志文件保留，之后可以用NewLogger重新打开。
+// 同一个biz的所有Logger(包括WithField产生的)都会关闭
 func (l *Logger) Close() {
-	if l.file != nil {
-		l.file.Close()
-	}
+	l.out.lock.Lock()
+	l.out.close()
+	l.out.lock.Unlock()
 
-	os.Remove(l.fileName)
-
-	delete(loggerMap, l.bizName)
+	_registry.remove(l)
 }
 
+// Clean 删除所有旧文件并清空当前文件，重新开始记录。
+// 已有的Logger(包括WithField产生的)继续有效
 func (l *Logger) Clean() error {
 
-	logFileLock[l.fileName].Lock()
-	defer logFileLock[l.fileName].Unlock()
-
-	l.Close()
-
-	newL, err := NewLogger(l.bizName)
-	if err != nil {
-		return err
-	}
-
-	l = newL
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
 
-	return nil
+	return l.out.truncate()
 
 }
 
-func getLoggerName(bizName string) string {
-	name := fmt.Sprintf("filelog_%v_%v.txt", bizName, time.Now().Format("20060102_150405"))
-	return name
+func validBizName(bizName string) bool {
+	return bizName != "" && !strings.ContainsAny(bizName, "/\\\x00") && !strings.Contains(bizName, "..")
 }
 
 func getLogger(bizName string) *Logger {
-	return loggerMap[bizName]
+	return _registry.get(bizName)
 }
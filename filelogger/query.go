@@ -0,0 +1,58 @@
+package filelogger
+
+import (
+	"fmt"
+	"time"
+)
+
+// Query 查询条件，零值返回全部日志
+type Query struct {
+	Level  Level             // 最低级别
+	Since  time.Time         // 不早于，为零时不限制
+	Until  time.Time         // 早于，为零时不限制
+	Fields map[string]string // 字段值(按字符串比较)都相等
+	Limit  int               // 只返回最新的Limit条，<=0时不限制
+}
+
+func (q *Query) match(e *Entry) bool {
+	if e.Level < q.Level {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Time.Before(q.Until) {
+		return false
+	}
+	for k, want := range q.Fields {
+		v, ok := e.Fields[k]
+		if !ok || fmt.Sprint(v) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// Query 按条件查询日志(包括切分出的旧文件)，从旧到新
+func (l *Logger) Query(q Query) ([]*Entry, error) {
+
+	l.out.lock.RLock()
+	defer l.out.lock.RUnlock()
+
+	result := make([]*Entry, 0)
+	err := l.out.readEach(func(day string, content []byte) {
+		for _, e := range parseEntries(l.bizName, day, content) {
+			if q.match(e) {
+				result = append(result, e)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+	return result, nil
+}
@@ -0,0 +1,148 @@
+package filelogger_test
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/logxxx/utils/filelogger"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger_Level(t *testing.T) {
+	logger, err := filelogger.NewLoggerWithOptions("level", filelogger.Options{Dir: t.TempDir(), Level: filelogger.InfoLevel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	logger.Debugf("debug %v", 1)
+	logger.Infof("info %v", 2)
+	logger.WithField("user", "tom").Warnf("warn %v", 3)
+	logger.SetLevel(filelogger.ErrorLevel)
+	logger.Warnf("warn %v", 4)
+	logger.Errorf("error %v", 5)
+
+	content := logger.GetFromFile()
+	assert.NotContains(t, content, "debug 1")
+	assert.Contains(t, content, "[info]info 2")
+	assert.Contains(t, content, "[warn][user=tom]warn 3")
+	assert.NotContains(t, content, "warn 4")
+	assert.Contains(t, content, "[error]error 5")
+}
+
+func TestLogger_JSONFormat(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := filelogger.NewLoggerWithOptions("json", filelogger.Options{Dir: dir, Format: filelogger.JSONFormat})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	logger.WithField("user", "tom").WithField("age", 18).Warnf("hello %v", "world")
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "filelog_json.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Equal(t, 1, len(lines))
+
+	m := map[string]interface{}{}
+	err = json.Unmarshal([]byte(lines[0]), &m)
+	assert.Nil(t, err)
+	assert.Equal(t, "warn", m["level"])
+	assert.Equal(t, "json", m["biz"])
+	assert.Equal(t, "hello world", m["msg"])
+	assert.Equal(t, map[string]interface{}{"user": "tom", "age": float64(18)}, m["fields"])
+	_, err = time.Parse(time.RFC3339Nano, m["time"].(string))
+	assert.Nil(t, err)
+}
+
+func TestLogger_Query(t *testing.T) {
+	now := time.Date(2023, 5, 1, 10, 0, 0, 0, time.Local)
+	defer filelogger.SetTimeNow(func() time.Time { return now })()
+
+	logger, err := filelogger.NewLoggerWithOptions("query", filelogger.Options{Dir: t.TempDir(), Daily: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	//文本和json混在一起，并且跨天切分
+	logger.WithField("user", "tom").Infof("text info\nsecond line")
+	now = now.Add(time.Hour)
+	logger.WithField("user", "jerry").Errorf("text error")
+	logger.SetFormat(filelogger.JSONFormat)
+	now = now.Add(24 * time.Hour)
+	logger.WithField("user", "tom").Warnf("json warn")
+	logger.Debugf("json debug")
+
+	all, err := logger.Query(filelogger.Query{})
+	assert.Nil(t, err)
+	if assert.Equal(t, 4, len(all)) {
+		assert.Equal(t, "text info\nsecond line", all[0].Msg)
+		assert.Equal(t, filelogger.InfoLevel, all[0].Level)
+		assert.Equal(t, "query", all[0].Biz)
+		assert.Equal(t, time.Date(2023, 5, 1, 10, 0, 0, 0, time.Local), all[0].Time)
+		assert.Equal(t, "jerry", all[1].Fields["user"])
+		assert.Equal(t, "json warn", all[2].Msg)
+		assert.True(t, all[2].Time.Equal(time.Date(2023, 5, 2, 11, 0, 0, 0, time.Local)))
+	}
+
+	entries, err := logger.Query(filelogger.Query{Level: filelogger.WarnLevel})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	entries, err = logger.Query(filelogger.Query{Fields: map[string]string{"user": "tom"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	entries, err = logger.Query(filelogger.Query{
+		Since: time.Date(2023, 5, 1, 10, 30, 0, 0, time.Local),
+		Until: time.Date(2023, 5, 2, 11, 0, 0, 0, time.Local),
+	})
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(entries)) {
+		assert.Equal(t, "text error", entries[0].Msg)
+	}
+
+	entries, err = logger.Query(filelogger.Query{Limit: 1})
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(entries)) {
+		assert.Equal(t, "json debug", entries[0].Msg)
+	}
+}
+
+func TestRegisterAPI_Query(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	filelogger.RegisterAPI(e)
+
+	logger, err := filelogger.NewLoggerWithOptions("api_query", filelogger.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	logger.WithField("user", "tom").Infof("hello")
+	logger.WithField("user", "jerry").Errorf("oops")
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/log/query/api_query?level=info&field=user:jerry", nil))
+	assert.Equal(t, 200, w.Code)
+	entries := make([]*filelogger.Entry, 0)
+	err = json.Unmarshal(w.Body.Bytes(), &entries)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(entries)) {
+		assert.Equal(t, "oops", entries[0].Msg)
+		assert.Equal(t, filelogger.ErrorLevel, entries[0].Level)
+	}
+
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/log/query/api_query?level=fatal", nil))
+	assert.Equal(t, 400, w.Code)
+}
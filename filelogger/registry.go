@@ -0,0 +1,68 @@
+package filelogger
+
+import (
+	"sort"
+	"sync"
+)
+
+// registry 按bizName登记的Logger，所有方法都是并发安全的
+type registry struct {
+	lock    sync.RWMutex
+	loggers map[string]*Logger //k:bizName
+}
+
+var _registry = &registry{loggers: make(map[string]*Logger)}
+
+// getOrCreate bizName已登记时返回已有的Logger，否则用create创建并登记
+func (r *registry) getOrCreate(bizName string, create func() (*Logger, error)) (*Logger, error) {
+	r.lock.RLock()
+	logger := r.loggers[bizName]
+	r.lock.RUnlock()
+	if logger != nil {
+		return logger, nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	logger = r.loggers[bizName]
+	if logger != nil {
+		return logger, nil
+	}
+	logger, err := create()
+	if err != nil {
+		return nil, err
+	}
+	r.loggers[bizName] = logger
+	return logger, nil
+}
+
+func (r *registry) get(bizName string) *Logger {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.loggers[bizName]
+}
+
+// remove 只有登记的Logger与l共用同一个文件时才删除，避免删掉Close后重新创建的Logger
+func (r *registry) remove(l *Logger) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if logger := r.loggers[l.bizName]; logger != nil && logger.out == l.out {
+		delete(r.loggers, l.bizName)
+	}
+}
+
+// all 按bizName排序返回所有Logger
+func (r *registry) all() []*Logger {
+	r.lock.RLock()
+	loggers := make([]*Logger, 0, len(r.loggers))
+	for _, logger := range r.loggers {
+		loggers = append(loggers, logger)
+	}
+	r.lock.RUnlock()
+
+	sort.Slice(loggers, func(i, j int) bool {
+		return loggers[i].bizName < loggers[j].bizName
+	})
+	return loggers
+}
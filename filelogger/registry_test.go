@@ -0,0 +1,115 @@
+package filelogger_test
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/logxxx/utils/filelogger"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLogger_Concurrent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	filelogger.RegisterAPI(e)
+
+	opts := filelogger.Options{Dir: t.TempDir(), MaxSize: 2048, MaxBackups: 2}
+	root, err := filelogger.NewLoggerWithOptions("concurrent", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	parent := root.WithField("parent")
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				logger, err := filelogger.NewLoggerWithOptions("concurrent", opts)
+				assert.Nil(t, err)
+				assert.True(t, logger == root)
+
+				parent.WithField("worker", i).Infof("msg %v", j)
+
+				switch j % 10 {
+				case 0:
+					assert.Nil(t, logger.Clean())
+				case 1:
+					_, _, err = logger.Tail(3)
+					assert.Nil(t, err)
+				case 2:
+					_, err = logger.Query(filelogger.Query{Fields: map[string]string{"worker": fmt.Sprint(i)}})
+					assert.Nil(t, err)
+				case 3:
+					w := httptest.NewRecorder()
+					e.ServeHTTP(w, httptest.NewRequest("GET", "/log", nil))
+					assert.Equal(t, 200, w.Code)
+				case 4:
+					w := httptest.NewRecorder()
+					e.ServeHTTP(w, httptest.NewRequest("GET", "/log/clean/concurrent", nil))
+					assert.Equal(t, 200, w.Code)
+				case 5:
+					logger.SetLevel(filelogger.DebugLevel)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	//Clean后原来的Logger和子Logger都还能写
+	assert.Nil(t, root.Clean())
+	assert.Equal(t, "", root.GetFromFile())
+	parent.WithField("after").Infof("still works")
+	content := root.GetFromFile()
+	assert.Contains(t, content, "[parent][after]still works")
+}
+
+func TestLogger_WithFieldSiblings(t *testing.T) {
+	logger, err := filelogger.NewLoggerWithOptions("siblings", filelogger.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	parent := logger.WithField("a", 1).WithField("b", 2).WithField("c", 3)
+	left := parent.WithField("left")
+	right := parent.WithField("right")
+	left.Infof("l")
+	right.Infof("r")
+
+	content := logger.GetFromFile()
+	assert.Contains(t, content, "[a=1][b=2][c=3][left]l")
+	assert.Contains(t, content, "[a=1][b=2][c=3][right]r")
+	assert.False(t, strings.Contains(content, "[right]l"), content)
+}
+
+func TestLogger_CloseAndReopen(t *testing.T) {
+	opts := filelogger.Options{Dir: t.TempDir()}
+	old, err := filelogger.NewLoggerWithOptions("reopen", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Infof("first")
+	old.Close()
+
+	logger, err := filelogger.NewLoggerWithOptions("reopen", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	assert.False(t, old == logger)
+
+	//旧的Logger再次Close不影响新创建的
+	old.Close()
+	again, err := filelogger.NewLoggerWithOptions("reopen", opts)
+	assert.Nil(t, err)
+	assert.True(t, again == logger)
+	logger.Infof("second")
+	assert.Contains(t, logger.GetFromFile(), "first")
+	assert.Contains(t, logger.GetFromFile(), "second")
+}
@@ -0,0 +1,447 @@
+package filelogger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"github.com/logxxx/utils/runutil"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 文件布局(dir下)：
+//
+//	filelog_<biz>.txt                   正在写入的文件，重启后继续追加
+//	filelog_<biz>.<20060102>.<n>.txt    切分出的旧文件，日期为其中内容所在的日期
+//	filelog_<biz>.<20060102>.<n>.txt.gz 开启Compress时压缩后的旧文件
+//
+// 写入前文件超过MaxSize或者跨天时切分，旧文件超过MaxBackups个时删除最旧的。
+
+const dayFormat = "20060102"
+
+var timeNow = time.Now
+
+type Options struct {
+	Dir        string // 日志目录，默认为当前目录
+	MaxSize    int64  // 单个文件的最大字节数，<=0时不按大小切分
+	Daily      bool   // 跨天时切分
+	MaxBackups int    // 保留的旧文件数，<=0时全部保留
+	Compress   bool   // 用gzip压缩旧文件
+	Level      Level  // 最低级别，默认DebugLevel(全部记录)
+	Format     Format // 默认TextFormat
+}
+
+var (
+	defaultOptions = Options{
+		Dir:        ".",
+		MaxSize:    100 * 1024 * 1024,
+		Daily:      true,
+		MaxBackups: 7,
+	}
+	defaultOptionsLock sync.RWMutex
+)
+
+// SetDefaultOptions 设置NewLogger使用的配置，只对之后创建的Logger生效
+func SetDefaultOptions(opts Options) {
+	defaultOptionsLock.Lock()
+	defer defaultOptionsLock.Unlock()
+	defaultOptions = opts
+}
+
+func getDefaultOptions() Options {
+	defaultOptionsLock.RLock()
+	defer defaultOptionsLock.RUnlock()
+	return defaultOptions
+}
+
+// output 一个biz的日志文件，同一个biz的Logger(包括WithField产生的)共用
+type output struct {
+	lock    sync.RWMutex
+	bizName string
+	opts    Options
+	file    *os.File
+	size    int64
+	day     string // 当前文件中内容所在的日期
+	level   Level  // 低于level的日志不记录
+	format  Format
+
+	segs []*segment // 旧文件，打开时加载，切分、删除时更新，偏移量由此计算，见stream.go
+
+	subsLock sync.Mutex // 订阅时只持有读锁，subs单独加锁
+	subs     map[chan *streamEvent]struct{}
+}
+
+func newOutput(bizName string, opts Options) (*output, error) {
+	if opts.Dir == "" {
+		opts.Dir = "."
+	}
+	err := os.MkdirAll(opts.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	o := &output{bizName: bizName, opts: opts, level: opts.Level, format: opts.Format}
+	err = o.open()
+	if err != nil {
+		return nil, err
+	}
+	o.segs, err = o.loadSegments(nil)
+	if err != nil {
+		o.file.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *output) fileName() string {
+	return filepath.Join(o.opts.Dir, fmt.Sprintf("filelog_%v.txt", o.bizName))
+}
+
+// open 以追加方式打开当前文件，需要持有写锁
+func (o *output) open() error {
+	f, err := os.OpenFile(o.fileName(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	o.file = f
+	o.size = stat.Size()
+	o.day = timeNow().Format(dayFormat)
+	if o.size > 0 {
+		o.day = stat.ModTime().Format(dayFormat)
+	}
+	return nil
+}
+
+// write 写入一条日志，需要时先切分，需要持有写锁
+func (o *output) write(content []byte) error {
+	if o.file == nil {
+		return os.ErrClosed
+	}
+
+	//文件被外部删除时重新创建
+	if _, err := os.Stat(o.fileName()); os.IsNotExist(err) {
+		o.file.Close()
+		if err = o.open(); err != nil {
+			o.file = nil
+			return err
+		}
+	}
+
+	today := timeNow().Format(dayFormat)
+	if o.size > 0 && ((o.opts.Daily && o.day != today) || (o.opts.MaxSize > 0 && o.size+int64(len(content)) > o.opts.MaxSize)) {
+		err := o.rotate()
+		if err != nil {
+			internalLog(o.bizName).Errorf("output rotate err:%v", err)
+		}
+	}
+
+	n, err := o.file.Write(content)
+	o.size += int64(n)
+	if o.size == int64(n) {
+		o.day = today
+	}
+	if n > 0 {
+		o.publish(content[:n])
+	}
+	return err
+}
+
+// rotate 把当前文件改名为旧文件，重新打开一个空文件，需要持有写锁
+func (o *output) rotate() error {
+
+	//重新扫描一次目录，发现外部删除的旧文件
+	segs, err := o.loadSegments(o.segs)
+	if err != nil {
+		return err
+	}
+	o.segs = segs
+	seq := 0
+	for _, seg := range segs {
+		if seg.day == o.day && seg.seq >= seq {
+			seq = seg.seq + 1
+		}
+	}
+	rotated := filepath.Join(o.opts.Dir, fmt.Sprintf("filelog_%v.%v.%v.txt", o.bizName, o.day, seq))
+	size := o.size
+
+	o.file.Close()
+	o.file = nil
+	err = os.Rename(o.fileName(), rotated)
+	if err != nil {
+		//改名失败时继续写原来的文件
+		if openErr := o.open(); openErr != nil {
+			internalLog(o.bizName).Errorf("output reopen err:%v", openErr)
+		}
+		return err
+	}
+
+	err = o.open()
+	if err != nil {
+		return err
+	}
+
+	if o.opts.Compress {
+		runutil.GoRunSafe(func() {
+			err := compressFile(rotated)
+			if err != nil {
+				internalLog(o.bizName).Errorf("output compress err:%v file:%v", err, rotated)
+			}
+		})
+	}
+
+	o.removeOldSegments(append(segs, &segment{path: rotated, day: o.day, seq: seq, size: size}))
+	return nil
+}
+
+// removeOldSegments 删除超过MaxBackups的旧文件，剩下的作为o.segs，需要持有写锁
+func (o *output) removeOldSegments(segs []*segment) {
+	sortSegments(segs)
+	if o.opts.MaxBackups > 0 && len(segs) > o.opts.MaxBackups {
+		for _, seg := range segs[:len(segs)-o.opts.MaxBackups] {
+			os.Remove(seg.path)
+			os.Remove(seg.path + ".gz")
+		}
+		segs = segs[len(segs)-o.opts.MaxBackups:]
+	}
+	o.segs = segs
+}
+
+type segment struct {
+	path string // 不带.gz后缀
+	day  string
+	seq  int
+	size int64 // 解压后的大小，只在o.segs中有效
+}
+
+// segments 返回所有旧文件，按从旧到新排列
+func (o *output) segments() ([]*segment, error) {
+	pattern := regexp.MustCompile(`^filelog_` + regexp.QuoteMeta(o.bizName) + `\.(\d{8})\.(\d+)\.txt(\.gz)?$`)
+	infos, err := ioutil.ReadDir(o.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	segs := make([]*segment, 0)
+	for _, info := range infos {
+		match := pattern.FindStringSubmatch(info.Name())
+		if match == nil {
+			continue
+		}
+		path := filepath.Join(o.opts.Dir, info.Name()[:len(info.Name())-len(match[3])])
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		seq, _ := strconv.Atoi(match[2])
+		segs = append(segs, &segment{path: path, day: match[1], seq: seq})
+	}
+	sortSegments(segs)
+	return segs, nil
+}
+
+// loadSegments 扫描所有旧文件并取得大小，known中已有的文件沿用其大小
+func (o *output) loadSegments(known []*segment) ([]*segment, error) {
+	segs, err := o.segments()
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(known))
+	for _, seg := range known {
+		sizes[seg.path] = seg.size
+	}
+	for _, seg := range segs {
+		if size, ok := sizes[seg.path]; ok {
+			seg.size = size
+			continue
+		}
+		seg.size, err = segmentSize(seg)
+		if err != nil {
+			internalLog(o.bizName).Errorf("output segment size err:%v file:%v", err, seg.path)
+		}
+	}
+	return segs, nil
+}
+
+// segmentSize 旧文件解压后的大小。压缩的文件取gzip末尾记录的原始大小，不用解压
+func segmentSize(seg *segment) (int64, error) {
+	stat, err := os.Stat(seg.path)
+	if err == nil {
+		return stat.Size(), nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+	f, err := os.Open(seg.path + ".gz")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	stat, err = f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if stat.Size() < 4 {
+		return 0, fmt.Errorf("invalid gzip size:%v", stat.Size())
+	}
+	b := make([]byte, 4)
+	_, err = f.ReadAt(b, stat.Size()-4)
+	if err != nil {
+		return 0, err
+	}
+	//ISIZE为原始大小模2^32，单个文件不超过4G
+	return int64(binary.LittleEndian.Uint32(b)), nil
+}
+
+func sortSegments(segs []*segment) {
+	sort.Slice(segs, func(i, j int) bool {
+		if segs[i].day != segs[j].day {
+			return segs[i].day < segs[j].day
+		}
+		return segs[i].seq < segs[j].seq
+	})
+}
+
+// readSegment 读取旧文件，可能正在被压缩，两种格式都尝试
+func readSegment(seg *segment) ([]byte, error) {
+	content, err := ioutil.ReadFile(seg.path)
+	if err == nil {
+		return content, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	gz, err := ioutil.ReadFile(seg.path + ".gz")
+	if err != nil {
+		return nil, err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// readEach 按从旧到新的顺序读取所有旧文件和当前文件，day为文件中内容所在的日期
+func (o *output) readEach(fn func(day string, content []byte)) error {
+	segs, err := o.segments()
+	if err != nil {
+		return err
+	}
+	for _, seg := range segs {
+		content, err := readSegment(seg)
+		if err != nil {
+			internalLog(o.bizName).Errorf("output read segment err:%v file:%v", err, seg.path)
+			continue
+		}
+		fn(seg.day, content)
+	}
+	content, err := ioutil.ReadFile(o.fileName())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fn(o.day, content)
+	return nil
+}
+
+func (o *output) readAll() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := o.readEach(func(day string, content []byte) {
+		buf.Write(content)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// truncate 删除所有旧文件并清空当前文件，结束所有订阅，需要持有写锁
+func (o *output) truncate() error {
+	segs, err := o.segments()
+	if err != nil {
+		return err
+	}
+	for _, seg := range segs {
+		os.Remove(seg.path)
+		os.Remove(seg.path + ".gz")
+	}
+	o.segs = nil
+
+	o.closeSubs()
+
+	if o.file == nil {
+		//已经Close过，只清空文件
+		err = os.Truncate(o.fileName(), 0)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	err = o.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	o.size = 0
+	o.day = timeNow().Format(dayFormat)
+	return nil
+}
+
+// close 关闭文件，结束所有订阅，需要持有写锁
+func (o *output) close() error {
+	o.closeSubs()
+	if o.file == nil {
+		return nil
+	}
+	err := o.file.Close()
+	o.file = nil
+	return err
+}
+
+// compressFile 压缩为path.gz后删除path
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(dst)
+	_, err = io.Copy(w, src)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Remove(path)
+}
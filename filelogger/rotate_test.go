@@ -0,0 +1,132 @@
+package filelogger_test
+
+import (
+	"github.com/logxxx/utils/filelogger"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listFiles(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLogger_RotateBySize(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := filelogger.NewLoggerWithOptions("rotate_size", filelogger.Options{
+		Dir:        dir,
+		MaxSize:    60,
+		MaxBackups: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	//每条26字节，每个文件2条，只保留3个旧文件
+	for i := 0; i < 10; i++ {
+		logger.Infof("line %02d", i)
+	}
+
+	files := listFiles(t, dir)
+	assert.Equal(t, 4, len(files), files)
+	assert.Contains(t, files, "filelog_rotate_size.txt")
+
+	content := logger.GetFromFile()
+	assert.NotContains(t, content, "line 00")
+	assert.Contains(t, content, "line 09")
+	//从旧到新
+	lines := strings.Split(strings.TrimSpace(content), "\n\n")
+	for i := 1; i < len(lines); i++ {
+		assert.True(t, lines[i-1][10:] < lines[i][10:], lines)
+	}
+}
+
+func TestLogger_RotateDaily(t *testing.T) {
+	now := time.Date(2023, 5, 1, 23, 59, 0, 0, time.Local)
+	defer filelogger.SetTimeNow(func() time.Time { return now })()
+
+	dir := t.TempDir()
+	logger, err := filelogger.NewLoggerWithOptions("rotate_daily", filelogger.Options{
+		Dir:   dir,
+		Daily: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	logger.Infof("day1")
+	now = now.Add(2 * time.Minute)
+	logger.Infof("day2")
+
+	assert.Equal(t, []string{"filelog_rotate_daily.20230501.0.txt", "filelog_rotate_daily.txt"}, listFiles(t, dir))
+	content := logger.GetFromFile()
+	assert.True(t, strings.Index(content, "day1") < strings.Index(content, "day2"), content)
+}
+
+func TestLogger_Compress(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := filelogger.NewLoggerWithOptions("rotate_gzip", filelogger.Options{
+		Dir:      dir,
+		MaxSize:  30,
+		Compress: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	logger.Infof("first")
+	logger.Infof("second")
+
+	//压缩在后台进行
+	gz := filepath.Join(dir, "filelog_rotate_gzip."+time.Now().Format("20060102")+".0.txt.gz")
+	assert.Eventually(t, func() bool {
+		files := listFiles(t, dir)
+		return len(files) == 2 && files[0] == filepath.Base(gz)
+	}, 3*time.Second, 10*time.Millisecond)
+
+	content := logger.GetFromFile()
+	assert.True(t, strings.Index(content, "first") >= 0 && strings.Index(content, "first") < strings.Index(content, "second"), content)
+}
+
+func TestLogger_Append(t *testing.T) {
+	dir := t.TempDir()
+	opts := filelogger.Options{Dir: dir}
+	logger, err := filelogger.NewLoggerWithOptions("append", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Infof("before restart")
+	logger.Close()
+
+	logger, err = filelogger.NewLoggerWithOptions("append", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Infof("after restart")
+	content := logger.GetFromFile()
+	assert.Contains(t, content, "before restart")
+	assert.Contains(t, content, "after restart")
+
+	err = logger.Clean()
+	assert.Nil(t, err)
+	assert.Equal(t, "", logger.GetFromFile())
+	logger.Infof("after clean")
+	assert.Contains(t, logger.GetFromFile(), "after clean")
+	logger.Close()
+}
@@ -0,0 +1,281 @@
+package filelogger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+// 偏移量(offset)：所有旧文件和当前文件按从旧到新拼接后的字节位置(旧文件按解压后的大小)。
+// 旧文件的大小在打开时加载，之后随切分、删除更新，计算偏移量不读文件；
+// 按偏移量读取时只读需要的部分，当前文件和未压缩的旧文件直接定位。
+// 删除旧文件(超过MaxBackups、Clean)后偏移量会整体前移，
+// 传入的偏移量超过总长度时视为日志已被重置，从头开始返回。
+
+const (
+	streamBuffer = 256
+	tailChunk    = 64 * 1024 // Tail从后往前每次读取的字节数
+)
+
+// streamEvent 一次写入的内容，offset为写入后的偏移量
+type streamEvent struct {
+	offset int64
+	data   []byte
+}
+
+// Read 返回偏移量since之后的日志和当前的偏移量，下次从返回的偏移量继续读
+func (l *Logger) Read(since int64) ([]byte, int64, error) {
+
+	l.out.lock.RLock()
+	defer l.out.lock.RUnlock()
+
+	total := l.out.total()
+	if since < 0 || since > total {
+		since = 0
+	}
+	content, err := l.out.readFrom(since)
+	if err != nil {
+		return nil, 0, err
+	}
+	return content, total, nil
+}
+
+// Tail 返回最后n条日志和当前的偏移量
+func (l *Logger) Tail(n int) ([]byte, int64, error) {
+
+	l.out.lock.RLock()
+	defer l.out.lock.RUnlock()
+
+	content, err := l.out.tail(n)
+	if err != nil {
+		return nil, 0, err
+	}
+	return content, l.out.total(), nil
+}
+
+// Size 日志文件(包括旧文件)在磁盘上的总大小
+func (l *Logger) Size() (size int64, files int, err error) {
+
+	l.out.lock.RLock()
+	defer l.out.lock.RUnlock()
+
+	segs, err := l.out.segments()
+	if err != nil {
+		return 0, 0, err
+	}
+	paths := []string{l.out.fileName()}
+	for _, seg := range segs {
+		paths = append(paths, seg.path, seg.path+".gz")
+	}
+	for _, path := range paths {
+		stat, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		size += stat.Size()
+		files++
+	}
+	return size, files, nil
+}
+
+// subscribe 订阅之后写入的日志，backlog为偏移量since之后已有的日志。
+// since<0时不返回已有的日志，tail>0时返回最后tail条。
+// 读取backlog时持有读锁，写入会等到订阅完成，不会漏掉或重复日志。
+// 订阅者处理不过来时channel会被关闭，需要从最后收到的偏移量重新订阅
+func (o *output) subscribe(since int64, tail int) ([]byte, int64, chan *streamEvent, error) {
+
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	total := o.total()
+	var backlog []byte
+	var err error
+	if tail > 0 {
+		backlog, err = o.tail(tail)
+	} else if since >= 0 {
+		if since > total {
+			since = 0
+		}
+		backlog, err = o.readFrom(since)
+	}
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	ch := make(chan *streamEvent, streamBuffer)
+	o.subsLock.Lock()
+	if o.subs == nil {
+		o.subs = make(map[chan *streamEvent]struct{})
+	}
+	o.subs[ch] = struct{}{}
+	o.subsLock.Unlock()
+
+	return backlog, total, ch, nil
+}
+
+func (o *output) unsubscribe(ch chan *streamEvent) {
+	o.subsLock.Lock()
+	defer o.subsLock.Unlock()
+	if _, ok := o.subs[ch]; ok {
+		delete(o.subs, ch)
+		close(ch)
+	}
+}
+
+// publish 通知订阅者，需要持有写锁
+func (o *output) publish(data []byte) {
+	o.subsLock.Lock()
+	defer o.subsLock.Unlock()
+	if len(o.subs) == 0 {
+		return
+	}
+
+	event := &streamEvent{offset: o.total(), data: append([]byte(nil), data...)}
+	for ch := range o.subs {
+		select {
+		case ch <- event:
+		default:
+			delete(o.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// closeSubs 结束所有订阅
+func (o *output) closeSubs() {
+	o.subsLock.Lock()
+	defer o.subsLock.Unlock()
+	for ch := range o.subs {
+		delete(o.subs, ch)
+		close(ch)
+	}
+}
+
+// total 当前的偏移量，需要持有锁
+func (o *output) total() int64 {
+	total := o.size
+	for _, seg := range o.segs {
+		total += seg.size
+	}
+	return total
+}
+
+// parts 按从旧到新排列的旧文件和当前文件
+func (o *output) parts() []*segment {
+	parts := make([]*segment, 0, len(o.segs)+1)
+	parts = append(parts, o.segs...)
+	return append(parts, &segment{path: o.fileName(), day: o.day, size: o.size})
+}
+
+// readFrom 返回偏移量since之后的内容，只读取since所在及之后的文件，需要持有锁
+func (o *output) readFrom(since int64) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	pos := int64(0)
+	for _, seg := range o.parts() {
+		start := since - pos
+		pos += seg.size
+		if pos <= since {
+			continue
+		}
+		if start < 0 {
+			start = 0
+		}
+		content, from, err := o.readRange(seg, start, seg.size)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(content)) > start-from {
+			buf.Write(content[start-from:])
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// tail 返回最后n条日志，从当前文件末尾往前读，够n条时停止，n<=0时返回全部，需要持有锁
+func (o *output) tail(n int) ([]byte, error) {
+	if n <= 0 {
+		return o.readFrom(0)
+	}
+
+	parts := o.parts()
+	var buf []byte
+	for i := len(parts) - 1; i >= 0; i-- {
+		seg := parts[i]
+		end := seg.size
+		for end > 0 {
+			start := end - tailChunk
+			if start < 0 {
+				start = 0
+			}
+			content, from, err := o.readRange(seg, start, end)
+			if err != nil {
+				return nil, err
+			}
+			buf = append(content, buf...)
+			end = from
+
+			//没读到文件开头时，第一行可能是半行，不能算作一条日志的开头
+			starts := entryStarts(buf)
+			if end > 0 && len(starts) > 0 && starts[0] == 0 {
+				starts = starts[1:]
+			}
+			if len(starts) > n {
+				return buf[starts[len(starts)-n]:], nil
+			}
+		}
+	}
+	return buf, nil
+}
+
+// readRange 读取文件中[start, end)的内容，返回内容和其实际的起始位置。
+// 压缩的旧文件不能定位，从头解压，起始位置为0。
+// 旧文件读取失败时记录日志并跳过，当前文件不存在时视为空
+func (o *output) readRange(seg *segment, start, end int64) ([]byte, int64, error) {
+	content, from, err := readSegmentRange(seg, start, end)
+	if err == nil {
+		return content, from, nil
+	}
+	if seg.path == o.fileName() {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	internalLog(o.bizName).Errorf("output read segment err:%v file:%v", err, seg.path)
+	return nil, 0, nil
+}
+
+// readSegmentRange 见output.readRange，旧文件可能正在被压缩，两种格式都尝试
+func readSegmentRange(seg *segment, start, end int64) ([]byte, int64, error) {
+	f, err := os.Open(seg.path)
+	if err == nil {
+		defer f.Close()
+		content := make([]byte, end-start)
+		n, err := f.ReadAt(content, start)
+		if err == io.EOF {
+			err = nil
+		}
+		return content[:n], start, err
+	}
+	if !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+
+	f, err = os.Open(seg.path + ".gz")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	buf := &bytes.Buffer{}
+	_, err = io.Copy(buf, io.LimitReader(r, end))
+	if err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), 0, nil
+}
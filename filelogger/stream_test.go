@@ -0,0 +1,291 @@
+package filelogger_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/logxxx/utils/filelogger"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger_TailAndRead(t *testing.T) {
+	logger, err := filelogger.NewLoggerWithOptions("tail", filelogger.Options{Dir: t.TempDir(), MaxSize: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	for i := 0; i < 5; i++ {
+		logger.Infof("line %v\nmore", i)
+	}
+
+	//跨文件取最后两条，多行消息算一条
+	content, offset, err := logger.Tail(2)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(content[10:]), "[info]line 3\nmore"), string(content))
+	assert.Contains(t, string(content), "line 4")
+
+	all, offset2, err := logger.Read(0)
+	assert.Nil(t, err)
+	assert.Equal(t, offset, offset2)
+	assert.Equal(t, int64(len(all)), offset)
+
+	logger.Infof("line 5")
+	content, offset3, err := logger.Read(offset)
+	assert.Nil(t, err)
+	assert.Equal(t, "[info]line 5\n\n", string(content[10:]))
+	assert.Equal(t, offset+int64(len(content)), offset3)
+
+	//偏移量超出时从头返回
+	content, _, err = logger.Read(offset3 + 100)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), offset3)
+}
+
+func TestLogger_ReadCompressed(t *testing.T) {
+	dir := t.TempDir()
+	opts := filelogger.Options{Dir: dir, MaxSize: 4096, Compress: true}
+	logger, err := filelogger.NewLoggerWithOptions("read_gz", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//超过Tail每次读取的大小，分布在多个压缩的旧文件中
+	for i := 0; i < 3000; i++ {
+		logger.Infof("line %04d %v", i, strings.Repeat("x", 20))
+	}
+	all, offset, err := logger.Read(0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(all)), offset)
+	assert.Contains(t, string(all), "line 0000 ")
+
+	content, offset2, err := logger.Read(offset - 100)
+	assert.Nil(t, err)
+	assert.Equal(t, offset, offset2)
+	assert.Equal(t, all[len(all)-100:], content)
+
+	content, _, err = logger.Tail(2500)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(content[10:]), "[info]line 0500 "), string(content[:50]))
+	assert.True(t, strings.HasSuffix(string(content), "line 2999 "+strings.Repeat("x", 20)+"\n\n"))
+
+	//等待压缩完成后重新打开，偏移量不变
+	compressed := func() bool {
+		for _, name := range listFiles(t, dir) {
+			if name != "filelog_read_gz.txt" && strings.HasSuffix(name, ".txt") {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 100 && !compressed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, compressed())
+	logger.Close()
+	logger, err = filelogger.NewLoggerWithOptions("read_gz", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	content, offset2, err = logger.Read(offset - 100)
+	assert.Nil(t, err)
+	assert.Equal(t, offset, offset2)
+	assert.Equal(t, all[len(all)-100:], content)
+}
+
+func TestRegisterAPI_TailAndIndex(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	filelogger.RegisterAPI(e)
+
+	logger, err := filelogger.NewLoggerWithOptions("api_tail", filelogger.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	logger.Infof("a")
+	logger.Infof("b")
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/log/api_tail?tail=1", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "[info]b\n\n", w.Body.String()[10:])
+	offset := w.Header().Get("X-Log-Offset")
+
+	logger.Infof("c")
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/log/api_tail?since="+offset, nil))
+	assert.Equal(t, "[info]c\n\n", w.Body.String()[10:])
+
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/log/api_tail?tail=x", nil))
+	assert.Equal(t, 400, w.Code)
+
+	//流接口同样拒绝无效的参数，不会从头重放
+	for _, url := range []string{"/log/stream/api_tail?since=x", "/log/stream/api_tail?tail=x"} {
+		w = httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		assert.Equal(t, 400, w.Code, url)
+	}
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/log/stream/api_tail", nil)
+	req.Header.Set("Last-Event-ID", "x")
+	e.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/log", nil))
+	infos := make([]map[string]interface{}, 0)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &infos))
+	found := false
+	for _, info := range infos {
+		if info["biz"] == "api_tail" {
+			found = true
+			assert.Equal(t, float64(3*19), info["size"])
+			assert.Equal(t, float64(1), info["files"])
+		}
+	}
+	assert.True(t, found, w.Body.String())
+}
+
+type sseEvent struct {
+	id   int64
+	data string
+}
+
+func readEvents(t *testing.T, r *bufio.Reader, n int) []sseEvent {
+	events := make([]sseEvent, 0, n)
+	cur := sseEvent{}
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			cur.id, _ = strconv.ParseInt(line[4:], 10, 64)
+		case strings.HasPrefix(line, "data: "):
+			if cur.data != "" {
+				cur.data += "\n"
+			}
+			cur.data += line[6:]
+		case line == "":
+			events = append(events, cur)
+			cur = sseEvent{}
+		}
+	}
+	return events
+}
+
+func TestRegisterAPI_Stream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	filelogger.RegisterAPI(e)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	logger, err := filelogger.NewLoggerWithOptions("api_stream", filelogger.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	logger.Infof("old 1")
+	logger.Infof("old 2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/log/stream/api_stream?tail=1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	r := bufio.NewReader(resp.Body)
+
+	events := readEvents(t, r, 1)
+	assert.True(t, strings.HasSuffix(events[0].data, "[info]old 2"), events[0].data)
+
+	logger.WithField("k", "v").Warnf("new\nline")
+	events = append(events, readEvents(t, r, 1)...)
+	assert.True(t, strings.HasSuffix(events[1].data, "[warn][k=v]new\nline"), events[1].data)
+
+	//事件id与Read的偏移量一致，可以用来续传
+	_, offset, err := logger.Read(0)
+	assert.Nil(t, err)
+	assert.Equal(t, offset, events[1].id)
+	content, _, err := logger.Read(events[0].id)
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), "new\nline")
+
+	//重连时从Last-Event-ID继续
+	req, _ = http.NewRequestWithContext(ctx, "GET", server.URL+"/log/stream/api_stream", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatInt(events[0].id, 10))
+	resp2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+	events = readEvents(t, bufio.NewReader(resp2.Body), 1)
+	assert.True(t, strings.HasSuffix(events[0].data, "new\nline"), events[0].data)
+
+	//Close后流结束
+	logger.Close()
+	rest, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "", string(rest))
+}
+
+func TestRegisterAPI_ReservedBiz(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	filelogger.RegisterAPI(e)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	dir := t.TempDir()
+	loggers := make(map[string]*filelogger.Logger)
+	for _, biz := range []string{"clean", "stream", "query"} {
+		logger, err := filelogger.NewLoggerWithOptions(biz, filelogger.Options{Dir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer logger.Close()
+		logger.Infof("%v 1", biz)
+		loggers[biz] = logger
+	}
+
+	//biz名与操作名相同时只读接口不会清空日志
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/log/query/clean", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "clean 1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/log/stream/clean?tail=1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := readEvents(t, bufio.NewReader(resp.Body), 1)
+	resp.Body.Close()
+	assert.True(t, strings.HasSuffix(events[0].data, "clean 1"), events[0].data)
+
+	//只清空名为stream的biz
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/log/clean/stream", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "", loggers["stream"].GetFromFile())
+	assert.Contains(t, loggers["clean"].GetFromFile(), "clean 1")
+	assert.Contains(t, loggers["query"].GetFromFile(), "query 1")
+}
@@ -1,21 +1,171 @@
 package filelogger
 
-import "github.com/gin-gonic/gin"
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
 
+const offsetHeader = "X-Log-Offset"
+
+type loggerInfo struct {
+	Biz   string `json:"biz"`
+	Size  int64  `json:"size"`  // 磁盘上的总字节数
+	Files int    `json:"files"` // 文件数，包括旧文件
+}
+
+// RegisterAPI 注册日志接口。操作放在biz前面(如/log/stream/:biz)，
+// 与/log/clean/:biz一致，避免biz名与操作名相同时请求被路由到其他接口
 func RegisterAPI(e *gin.Engine) {
+	e.GET("/log", func(c *gin.Context) {
+		loggers := _registry.all()
+		infos := make([]*loggerInfo, 0, len(loggers))
+		for _, logger := range loggers {
+			size, files, err := logger.Size()
+			if err != nil {
+				c.String(500, err.Error())
+				return
+			}
+			infos = append(infos, &loggerInfo{Biz: logger.bizName, Size: size, Files: files})
+		}
+		c.JSON(200, infos)
+	})
+
+	// 参数：tail=N 最后N条；since=offset 从偏移量开始。
+	// 响应头X-Log-Offset为当前偏移量，下次用since=offset获取新增的日志
 	e.GET("/log/:biz", func(c *gin.Context) {
 		logger := getLogger(c.Param("biz"))
 		if logger == nil {
 			c.String(400, "logger not found")
 			return
 		}
-		c.String(200, logger.GetFromFile())
+
+		var content []byte
+		var offset int64
+		var err error
+		if tail := c.Query("tail"); tail != "" {
+			n, parseErr := strconv.Atoi(tail)
+			if parseErr != nil {
+				c.String(400, "invalid tail:%v", tail)
+				return
+			}
+			content, offset, err = logger.Tail(n)
+		} else {
+			since, parseErr := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+			if parseErr != nil {
+				c.String(400, "invalid since:%v", c.Query("since"))
+				return
+			}
+			content, offset, err = logger.Read(since)
+		}
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+
+		c.Header(offsetHeader, strconv.FormatInt(offset, 10))
+		c.Data(200, "text/plain; charset=utf-8", content)
+	})
+
+	// Server-Sent Events，每次写入推送一个事件，id为写入后的偏移量。
+	// 参数：tail=N 先推送最后N条；since=offset 先推送偏移量之后的日志；都没有时只推送新的日志。
+	// 断线重连时浏览器带上的Last-Event-ID优先
+	e.GET("/log/stream/:biz", func(c *gin.Context) {
+		logger := getLogger(c.Param("biz"))
+		if logger == nil {
+			c.String(400, "logger not found")
+			return
+		}
+
+		since := int64(-1)
+		tail := 0
+		var err error
+		if lastID := c.GetHeader("Last-Event-ID"); lastID != "" {
+			since, err = strconv.ParseInt(lastID, 10, 64)
+			if err != nil {
+				c.String(400, "invalid Last-Event-ID:%v", lastID)
+				return
+			}
+		} else if c.Query("since") != "" {
+			since, err = strconv.ParseInt(c.Query("since"), 10, 64)
+			if err != nil {
+				c.String(400, "invalid since:%v", c.Query("since"))
+				return
+			}
+		} else if c.Query("tail") != "" {
+			tail, err = strconv.Atoi(c.Query("tail"))
+			if err != nil {
+				c.String(400, "invalid tail:%v", c.Query("tail"))
+				return
+			}
+		}
+
+		backlog, offset, ch, err := logger.out.subscribe(since, tail)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		defer logger.out.unsubscribe(ch)
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(200)
+
+		//已有的日志按条推送，每条的id为其结束位置
+		starts := append(entryStarts(backlog), len(backlog))
+		base := offset - int64(len(backlog))
+		for i := 0; i+1 < len(starts); i++ {
+			writeEvent(c.Writer, base+int64(starts[i+1]), backlog[starts[i]:starts[i+1]])
+		}
+		c.Writer.Flush()
+
+		ping := time.NewTicker(15 * time.Second)
+		defer ping.Stop()
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-ping.C:
+				c.Writer.WriteString(": ping\n\n")
+			case event, ok := <-ch:
+				if !ok {
+					return
+				}
+				writeEvent(c.Writer, event.offset, event.data)
+			}
+			c.Writer.Flush()
+		}
+	})
+
+	// 参数：level=warn since/until=RFC3339或2006-01-02 15:04:05 field=k:v(可多个) limit=100
+	e.GET("/log/query/:biz", func(c *gin.Context) {
+		logger := getLogger(c.Param("biz"))
+		if logger == nil {
+			c.String(400, "logger not found")
+			return
+		}
+		q, err := parseQuery(c)
+		if err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		entries, err := logger.Query(q)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, entries)
 	})
 
 	e.GET("/log/clean/:biz", func(c *gin.Context) {
 		biz := c.Param("biz")
 		if biz == "" {
-			for _, logger := range loggerMap {
+			for _, logger := range _registry.all() {
 				logger.Clean()
 			}
 		} else {
@@ -33,3 +183,62 @@ func RegisterAPI(e *gin.Engine) {
 		}
 	})
 }
+
+func writeEvent(w io.Writer, id int64, data []byte) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "id: %v\n", id)
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		buf.WriteString("data: " + line + "\n")
+	}
+	buf.WriteString("\n")
+	w.Write(buf.Bytes())
+}
+
+func parseQuery(c *gin.Context) (Query, error) {
+	q := Query{}
+	var err error
+
+	if level := c.Query("level"); level != "" {
+		q.Level, err = ParseLevel(level)
+		if err != nil {
+			return q, err
+		}
+	}
+	if since := c.Query("since"); since != "" {
+		q.Since, err = parseQueryTime(since)
+		if err != nil {
+			return q, err
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		q.Until, err = parseQueryTime(until)
+		if err != nil {
+			return q, err
+		}
+	}
+	for _, field := range c.QueryArray("field") {
+		kv := strings.SplitN(field, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if q.Fields == nil {
+			q.Fields = make(map[string]string)
+		}
+		q.Fields[kv[0]] = kv[1]
+	}
+	if limit := c.Query("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+func parseQueryTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", s, time.Local)
+}
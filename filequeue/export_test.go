@@ -0,0 +1,6 @@
+package filequeue
+
+// IsWatched 文件名为name的写入是否会唤醒等待中的消费者
+func (q *FileQueue) IsWatched(name string) bool {
+	return q.isWatched(name)
+}
@@ -0,0 +1,214 @@
+package filequeue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/logxxx/utils/fileutil"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sort"
+)
+
+// pending保存所有不在segment里的数据：已被Reserve但未Ack的、被Nack后等待重试的、
+// 带优先级或延迟投递的。
+// 存储在fileName.pending中，每行一条pendingRecord，只追加；
+// 每个进程在操作前重放新增的记录得到最新状态，记录过多时整体重写(compactPending)。
+
+const (
+	opPut = "put"
+	opDel = "del"
+)
+
+type pendingItem struct {
+	ID        int64           `json:"id"`
+	Data      json.RawMessage `json:"data"`
+	Priority  int             `json:"priority,omitempty"`   // 越大越先投递，segment中的数据视为0
+	Attempts  int             `json:"attempts,omitempty"`   // 已经投递的次数
+	Reserved  bool            `json:"reserved,omitempty"`   // 是否被消费者持有
+	VisibleAt int64           `json:"visible_at,omitempty"` // unix nano，到达该时间后可以被取出
+}
+
+type pendingRecord struct {
+	Op   string       `json:"op"`
+	ID   int64        `json:"id,omitempty"`
+	Item *pendingItem `json:"item,omitempty"`
+}
+
+func (q *FileQueue) pendingName() string {
+	return q.fileName + ".pending"
+}
+
+// syncPending 重放pending文件中新增的记录。文件被其他进程重写过时重新加载
+func (q *FileQueue) syncPending() error {
+
+	stat, err := os.Stat(q.pendingName())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		q.resetPending(nil)
+		return nil
+	}
+
+	if q.pendingStat == nil || !os.SameFile(q.pendingStat, stat) || stat.Size() < q.pendingOffset {
+		q.resetPending(stat)
+	}
+
+	if stat.Size() == q.pendingOffset {
+		return nil
+	}
+
+	f, err := os.Open(q.pendingName())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(q.pendingOffset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			//没有换行结尾的是未写完的记录，等写完后再读
+			break
+		}
+		q.pendingOffset += int64(len(line))
+		q.pendingLines++
+
+		line = bytes.TrimSpace(line)
+		if len(line) <= 0 {
+			continue
+		}
+
+		record := pendingRecord{}
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			log.Errorf("FileQueue.syncPending skip broken record:%v fileName:%v", string(line), q.fileName)
+			continue
+		}
+		q.applyPending(&record)
+	}
+
+	return nil
+}
+
+func (q *FileQueue) resetPending(stat os.FileInfo) {
+	q.pending = make(map[int64]*pendingItem)
+	q.pendingStat = stat
+	q.pendingOffset = 0
+	q.pendingLines = 0
+}
+
+func (q *FileQueue) applyPending(record *pendingRecord) {
+	switch record.Op {
+	case opPut:
+		if record.Item != nil {
+			q.pending[record.Item.ID] = record.Item
+		}
+	case opDel:
+		delete(q.pending, record.ID)
+	}
+}
+
+// writePending 追加一条记录并应用到内存
+func (q *FileQueue) writePending(record *pendingRecord) error {
+
+	row, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	size, err := appendLineToFile(q.pendingName(), row)
+	if err != nil {
+		return err
+	}
+
+	stat, err := os.Stat(q.pendingName())
+	if err != nil {
+		return err
+	}
+
+	q.applyPending(record)
+	q.pendingStat = stat
+	q.pendingOffset = size
+	q.pendingLines++
+
+	if q.pendingLines > 2*len(q.pending)+64 {
+		return q.compactPending()
+	}
+
+	return nil
+}
+
+// compactPending 只保留仍然有效的数据，重写pending文件
+func (q *FileQueue) compactPending() error {
+
+	buf := &bytes.Buffer{}
+	for _, item := range q.sortedPending() {
+		row, err := json.Marshal(&pendingRecord{Op: opPut, Item: item})
+		if err != nil {
+			return err
+		}
+		_, err = appendLine(buf, row)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := fileutil.WriteToFileAtomic(buf.Bytes(), q.pendingName(), true)
+	if err != nil {
+		log.Errorf("FileQueue.compactPending err:%v fileName:%v", err, q.fileName)
+		return err
+	}
+
+	stat, err := os.Stat(q.pendingName())
+	if err != nil {
+		return err
+	}
+
+	q.pendingStat = stat
+	q.pendingOffset = stat.Size()
+	q.pendingLines = len(q.pending)
+
+	return nil
+}
+
+// sortedPending 按id从小到大返回所有pending数据
+func (q *FileQueue) sortedPending() []*pendingItem {
+	items := make([]*pendingItem, 0, len(q.pending))
+	for _, item := range q.pending {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ID < items[j].ID
+	})
+	return items
+}
+
+// readyPending 返回已到可见时间、优先级最高的数据，优先级相同时取id最小的，同时记录最早重新可见的时间。
+// skip不为nil时跳过skip返回true的数据
+func (q *FileQueue) readyPending(now int64, skip func(item *pendingItem) bool) *pendingItem {
+	var ready *pendingItem
+	q.nextVisibleAt = 0
+	for _, item := range q.pending {
+		if skip != nil && skip(item) {
+			continue
+		}
+		if item.VisibleAt > now {
+			if q.nextVisibleAt == 0 || item.VisibleAt < q.nextVisibleAt {
+				q.nextVisibleAt = item.VisibleAt
+			}
+			continue
+		}
+		if ready == nil || item.Priority > ready.Priority || (item.Priority == ready.Priority && item.ID < ready.ID) {
+			ready = item
+		}
+	}
+	return ready
+}
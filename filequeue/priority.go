@@ -0,0 +1,211 @@
+package filequeue
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+type pushOptions struct {
+	priority  int
+	notBefore time.Time
+}
+
+type PushOption func(o *pushOptions)
+
+// Priority 设置优先级，越大越先投递。普通Push的优先级为0，可以为负数
+func Priority(priority int) PushOption {
+	return func(o *pushOptions) {
+		o.priority = priority
+	}
+}
+
+// Delay 延迟d之后才能被取出
+func Delay(d time.Duration) PushOption {
+	return func(o *pushOptions) {
+		o.notBefore = time.Now().Add(d)
+	}
+}
+
+// NotBefore 到达t之后才能被取出
+func NotBefore(t time.Time) PushOption {
+	return func(o *pushOptions) {
+		o.notBefore = t
+	}
+}
+
+// Item 队列中的一条数据，用于查看队列状态
+type Item struct {
+	ID        int64           `json:"id,omitempty"` // 进入pending后才分配，普通数据为0
+	Data      json.RawMessage `json:"data"`
+	Priority  int             `json:"priority"`
+	Attempts  int             `json:"attempts"`
+	Reserved  bool            `json:"reserved"`
+	VisibleAt time.Time       `json:"visible_at"` // 可以被取出的时间，为0表示立即可取
+}
+
+// PushWithOptions 带优先级/延迟的Push，不带选项时与Push相同
+func (q *FileQueue) PushWithOptions(obj interface{}, opts ...PushOption) error {
+
+	o := &pushOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.priority == 0 && !o.notBefore.After(time.Now()) {
+		return q.Push(obj)
+	}
+
+	if err := q.lockAll(); err != nil {
+		return err
+	}
+	defer q.unlockAll()
+
+	meta, err := q.loadMeta()
+	if err != nil {
+		log.Errorf("PushWithOptions loadMeta err:%v", err)
+		return err
+	}
+
+	err = q.syncPending()
+	if err != nil {
+		log.Errorf("PushWithOptions syncPending err:%v", err)
+		return err
+	}
+
+	newRow, err := json.Marshal(obj)
+	if err != nil {
+		log.Errorf("PushWithOptions Marshal err:%v", err)
+		return err
+	}
+
+	meta.NextID++
+	item := &pendingItem{
+		ID:       meta.NextID,
+		Data:     newRow,
+		Priority: o.priority,
+	}
+	if !o.notBefore.IsZero() {
+		item.VisibleAt = o.notBefore.UnixNano()
+	}
+
+	//先保存meta，保证id不会被重复分配
+	err = q.saveMeta(meta)
+	if err != nil {
+		log.Errorf("PushWithOptions saveMeta err:%v", err)
+		return err
+	}
+
+	err = q.writePending(&pendingRecord{Op: opPut, Item: item})
+	if err != nil {
+		log.Errorf("PushWithOptions writePending err:%v", err)
+		return err
+	}
+
+	q.wakeUp()
+
+	return nil
+}
+
+// Peek 查看下一条会被取出的数据，不修改队列。
+// 超过投递次数的数据会被跳过，仍然由Pop/Reserve移入死信队列
+func (q *FileQueue) Peek(obj interface{}) error {
+
+	if err := q.lockAll(); err != nil {
+		return err
+	}
+	defer q.unlockAll()
+
+	meta, err := q.loadMeta()
+	if err != nil {
+		log.Errorf("Peek loadMeta err:%v", err)
+		return err
+	}
+
+	err = q.syncPending()
+	if err != nil {
+		log.Errorf("Peek syncPending err:%v", err)
+		return err
+	}
+
+	item, err := q.peekReady(meta)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(item.Data, obj)
+}
+
+// Len 返回队列中未Ack的数据条数，包括未到时间和已被Reserve的
+func (q *FileQueue) Len() (int, error) {
+	count := 0
+	err := q.scan(func(item *Item) bool {
+		count++
+		return true
+	})
+	return count, err
+}
+
+// List 返回队列中最多limit条数据，limit<=0时返回全部。
+// 先列出pending中的数据(按优先级排序，已被Reserve的排在最后)，再按顺序列出segment中的数据
+func (q *FileQueue) List(limit int) ([]*Item, error) {
+	items := make([]*Item, 0)
+	err := q.scan(func(item *Item) bool {
+		items = append(items, item)
+		return limit <= 0 || len(items) < limit
+	})
+	return items, err
+}
+
+func (q *FileQueue) scan(fn func(item *Item) bool) error {
+
+	if err := q.lockAll(); err != nil {
+		return err
+	}
+	defer q.unlockAll()
+
+	meta, err := q.loadMeta()
+	if err != nil {
+		log.Errorf("FileQueue.scan loadMeta err:%v", err)
+		return err
+	}
+
+	err = q.syncPending()
+	if err != nil {
+		log.Errorf("FileQueue.scan syncPending err:%v", err)
+		return err
+	}
+
+	pending := q.sortedPending()
+	sort.SliceStable(pending, func(i, j int) bool {
+		a, b := pending[i], pending[j]
+		if a.Reserved != b.Reserved {
+			return !a.Reserved
+		}
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.VisibleAt < b.VisibleAt
+	})
+
+	for _, p := range pending {
+		item := &Item{
+			ID:       p.ID,
+			Data:     p.Data,
+			Priority: p.Priority,
+			Attempts: p.Attempts,
+			Reserved: p.Reserved,
+		}
+		if p.VisibleAt > 0 {
+			item.VisibleAt = time.Unix(0, p.VisibleAt)
+		}
+		if !fn(item) {
+			return nil
+		}
+	}
+
+	return q.scanRecords(meta, func(row json.RawMessage) bool {
+		return fn(&Item{Data: row})
+	})
+}
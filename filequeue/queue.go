@@ -3,12 +3,12 @@ package filequeue
 import (
 	"encoding/json"
 	"errors"
+	"github.com/fsnotify/fsnotify"
 	"github.com/logxxx/utils/fileutil"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
 	"os"
-	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -17,9 +17,32 @@ var (
 	ErrEmpty = errors.New("empty queue")
 )
 
+const defaultLockTimeout = 10 * time.Second
+
 type FileQueue struct {
-	lock     sync.RWMutex
-	fileName string
+	lock        sync.RWMutex
+	fileLock    *fileutil.FileLock // 跨进程锁，多个进程共用同一个队列文件时保证读-改-写不冲突
+	lockTimeout time.Duration
+	fileName    string
+	segmentSize int64
+
+	visibilityTimeout time.Duration
+	maxAttempts       int
+	deadOnce          sync.Once
+	deadQueue         *FileQueue
+
+	pending       map[int64]*pendingItem // 已取出未确认、等待重试的数据
+	pendingStat   os.FileInfo            // 用于判断pending文件是否被其他进程重写
+	pendingOffset int64                  // pending文件已重放到的位置
+	pendingLines  int
+	nextVisibleAt int64 // pending中最早重新可见的时间，用于PopWait定时唤醒
+
+	pollInterval time.Duration
+	retryDelay   time.Duration
+	waitLock     sync.Mutex
+	waitCh       chan struct{} // Push时close，唤醒所有等待者
+	watcher      *fsnotify.Watcher
+	isClosed     bool
 }
 
 func GetFileQueue(fileName string) *FileQueue {
@@ -34,72 +57,110 @@ func GetFileQueue(fileName string) *FileQueue {
 
 func NewFileQueue(fileName string) *FileQueue {
 	return &FileQueue{
-		lock:     sync.RWMutex{},
-		fileName: fileName,
-	}
-}
+		lock:        sync.RWMutex{},
+		fileLock:    fileutil.NewFileLock(fileName + ".lock"),
+		lockTimeout: defaultLockTimeout,
+		fileName:    fileName,
+		segmentSize: defaultSegmentSize,
 
-func saveToFile(fileName string, obj []json.RawMessage) error {
+		visibilityTimeout: defaultVisibilityTimeout,
+		maxAttempts:       defaultMaxAttempts,
 
-	data, err := json.Marshal(obj)
-	if err != nil {
-		return err
+		pollInterval: defaultPollInterval,
+		retryDelay:   defaultRetryDelay,
 	}
+}
 
-	newData := strings.ReplaceAll(string(data), "},", "},\n") //便于查看
+// SetLockTimeout 设置等待跨进程文件锁的超时时间，<=0时一直等待
+func (q *FileQueue) SetLockTimeout(timeout time.Duration) {
+	q.lockTimeout = timeout
+}
 
-	err = ioutil.WriteFile(fileName, []byte(newData), 0766)
+// lockAll 依次获取进程内锁和跨进程文件锁
+func (q *FileQueue) lockAll() error {
+	q.lock.Lock()
+	err := q.fileLock.Lock(q.lockTimeout)
 	if err != nil {
+		q.lock.Unlock()
+		log.Errorf("FileQueue lock file err:%v fileName:%v", err, q.fileName)
 		return err
 	}
-
 	return nil
 }
 
-func readFile(fileName string) ([]json.RawMessage, error) {
+func (q *FileQueue) unlockAll() {
+	q.fileLock.Unlock()
+	q.lock.Unlock()
+}
 
-	if !fileutil.HasFile(fileName) {
-		return nil, nil
+// SetSegmentSize 设置单个segment文件的大小上限，超过后写入新的segment
+func (q *FileQueue) SetSegmentSize(size int64) {
+	if size <= 0 {
+		size = defaultSegmentSize
 	}
+	q.segmentSize = size
+}
 
-	allRows := make([]json.RawMessage, 0)
-
-	fileData, err := ioutil.ReadFile(fileName)
-	if err != nil {
-		log.Errorf("FileQueue.Push ioutil.ReadFile err:%v fileName:%v", err, fileName)
-		return nil, err
-	}
+func (q *FileQueue) Clean() {
 
-	if len(fileData) <= 0 {
-		return nil, nil
+	if err := q.lockAll(); err != nil {
+		return
 	}
+	defer q.unlockAll()
 
-	err = json.Unmarshal(fileData, &allRows)
+	segs, err := q.listSegments()
 	if err != nil {
-		log.Errorf("FileQueue.Push Unmarshal err:%v fileName:%v", err, fileName)
-		return nil, err
+		log.Errorf("FileQueue.Clean listSegments err:%v fileName:%v", err, q.fileName)
+	}
+	for _, seg := range segs {
+		os.Remove(q.segmentName(seg))
 	}
 
-	return allRows, nil
+	os.Remove(q.pendingName())
+	q.resetPending(nil)
 
+	os.Remove(q.fileName)
 }
 
-func (q *FileQueue) Clean() {
+// Compact 删除已读完的segment，Pop时会自动执行
+func (q *FileQueue) Compact() error {
 
-	q.lock.Lock()
-	defer q.lock.Unlock()
+	if err := q.lockAll(); err != nil {
+		return err
+	}
+	defer q.unlockAll()
 
-	os.Remove(q.fileName)
+	meta, err := q.loadMeta()
+	if err != nil {
+		log.Errorf("Compact loadMeta err:%v", err)
+		return err
+	}
+
+	old := *meta
+	_, next, err := q.readRecord(meta)
+	if err != nil && err != ErrEmpty {
+		log.Errorf("Compact readRecord err:%v", err)
+		return err
+	}
+
+	//只跳过空segment和坏记录，不消费数据
+	if err == nil {
+		next = meta
+	}
+
+	return q.commit(&old, next)
 }
 
 func (q *FileQueue) Push(obj interface{}) error {
 
-	q.lock.Lock()
-	defer q.lock.Unlock()
+	if err := q.lockAll(); err != nil {
+		return err
+	}
+	defer q.unlockAll()
 
-	rows, err := readFile(q.fileName)
+	meta, err := q.loadMeta()
 	if err != nil {
-		log.Errorf("Push readFile err:%v", err)
+		log.Errorf("Push loadMeta err:%v", err)
 		return err
 	}
 
@@ -109,11 +170,21 @@ func (q *FileQueue) Push(obj interface{}) error {
 		return err
 	}
 
-	rows = append(rows, newRow)
+	changed, err := q.appendRecord(meta, newRow)
+	if err != nil {
+		log.Errorf("Push appendRecord err:%v", err)
+		return err
+	}
 
-	err = saveToFile(q.fileName, rows)
+	q.wakeUp()
+
+	if !changed {
+		return nil
+	}
+
+	err = q.saveMeta(meta)
 	if err != nil {
-		log.Errorf("Push saveToFile err:%v", err)
+		log.Errorf("Push saveMeta err:%v", err)
 		return err
 	}
 
@@ -131,31 +202,66 @@ func (q *FileQueue) Pop(obj interface{}) error {
 
 func (q *FileQueue) MustPop(obj interface{}) error {
 
-	q.lock.Lock()
-	defer q.lock.Unlock()
+	if err := q.lockAll(); err != nil {
+		return err
+	}
+	defer q.unlockAll()
+
+	meta, err := q.loadMeta()
+	if err != nil {
+		log.Errorf("Pop loadMeta err:%v", err)
+		return err
+	}
 
-	rows, err := readFile(q.fileName)
+	err = q.syncPending()
 	if err != nil {
-		log.Errorf("Pop readFile err:%v", err)
+		log.Errorf("Pop syncPending err:%v", err)
 		return err
 	}
 
-	if len(rows) == 0 {
-		return ErrEmpty
+	item, next, err := q.takeReady(meta)
+	if err != nil {
+		if err == ErrEmpty {
+			if commitErr := q.commit(meta, next); commitErr != nil {
+				log.Errorf("Pop commit err:%v", commitErr)
+			}
+		}
+		return err
 	}
 
-	err = json.Unmarshal(rows[0], obj)
+	err = json.Unmarshal(item.Data, obj)
 	if err != nil {
 		log.Errorf("Pop Unmarshal err:%v", err)
 		return err
 	}
 
-	newRows := rows[1:]
-	err = saveToFile(q.fileName, newRows)
+	if _, ok := q.pending[item.ID]; ok {
+		err = q.writePending(&pendingRecord{Op: opDel, ID: item.ID})
+		if err != nil {
+			log.Errorf("Pop writePending err:%v", err)
+			return err
+		}
+	}
+
+	err = q.commit(meta, next)
 	if err != nil {
-		log.Errorf("Pop saveToFile err:%v", err)
+		log.Errorf("Pop commit err:%v", err)
 		return err
 	}
 
 	return nil
 }
+
+// commit 保存新的读取位置并清理读完的segment
+func (q *FileQueue) commit(old, meta *queueMeta) error {
+
+	if _, err := q.compact(old, meta); err != nil {
+		return err
+	}
+
+	if *old == *meta {
+		return nil
+	}
+
+	return q.saveMeta(meta)
+}
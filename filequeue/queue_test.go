@@ -1,9 +1,21 @@
 package filequeue_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/logxxx/utils/filequeue"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestGetFileQueue2(t *testing.T) {
@@ -99,3 +111,558 @@ func TestGetFileQueue(t *testing.T) {
 	}
 
 }
+
+func TestFileQueue_Segments(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "queue")
+
+	queue := filequeue.NewFileQueue(fileName)
+	queue.SetSegmentSize(64)
+
+	for i := 0; i < 100; i++ {
+		err := queue.Push(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segs, _ := filepath.Glob(fileName + ".*.seg")
+	assert.Greater(t, len(segs), 1)
+
+	//重新打开后从上次的位置继续读
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			queue = filequeue.NewFileQueue(fileName)
+		}
+		resp := -1
+		err := queue.MustPop(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, i, resp)
+	}
+
+	resp := -1
+	err := queue.MustPop(&resp)
+	assert.Equal(t, filequeue.ErrEmpty, err)
+
+	segs, _ = filepath.Glob(fileName + ".*.seg")
+	assert.Empty(t, segs)
+}
+
+func TestFileQueue_MigrateLegacy(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "queue")
+
+	err := ioutil.WriteFile(fileName, []byte("[{\"name\":\"a\"},\n{\"name\":\"b\"}]"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type Foo struct {
+		Name string `json:"name"`
+	}
+
+	queue := filequeue.NewFileQueue(fileName)
+
+	err = queue.Push(&Foo{Name: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"a", "b", "c"} {
+		resp := &Foo{}
+		err = queue.MustPop(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, resp.Name)
+	}
+
+	err = queue.MustPop(&Foo{})
+	assert.Equal(t, filequeue.ErrEmpty, err)
+}
+
+func TestFileQueue_BrokenRecord(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "queue")
+
+	queue := filequeue.NewFileQueue(fileName)
+
+	err := queue.Push(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//模拟写入中途崩溃留下的半行
+	f, err := os.OpenFile(fileName+".000001.seg", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{\"bro")
+	f.Close()
+
+	err = queue.Push(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []int{1, 2} {
+		resp := 0
+		err = queue.MustPop(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, resp)
+	}
+
+	err = queue.MustPop(new(int))
+	assert.Equal(t, filequeue.ErrEmpty, err)
+}
+
+// TestHelperProcess 在子进程中执行，用于测试多进程共用一个队列文件
+func TestHelperProcess(t *testing.T) {
+	action := os.Getenv("FILEQUEUE_HELPER")
+	if action == "" {
+		return
+	}
+
+	queue := filequeue.NewFileQueue(os.Getenv("FILEQUEUE_FILE"))
+	queue.SetSegmentSize(256)
+
+	switch action {
+	case "push":
+		id, _ := strconv.Atoi(os.Getenv("FILEQUEUE_ID"))
+		count, _ := strconv.Atoi(os.Getenv("FILEQUEUE_COUNT"))
+		for i := 0; i < count; i++ {
+			if err := queue.Push(id*count + i); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+	case "pop":
+		for {
+			resp := 0
+			err := queue.MustPop(&resp)
+			if err == filequeue.ErrEmpty {
+				break
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Println(resp)
+		}
+	}
+	os.Exit(0)
+}
+
+func runHelpers(t *testing.T, action string, procs int, env ...string) []string {
+	outputs := make([]string, procs)
+	wg := sync.WaitGroup{}
+	for i := 0; i < procs; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Env = append(cmd.Env, "FILEQUEUE_HELPER="+action, fmt.Sprintf("FILEQUEUE_ID=%v", i))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			output, err := cmd.Output()
+			if err != nil {
+				t.Errorf("helper %v %v err:%v", action, i, err)
+			}
+			outputs[i] = string(output)
+		}(i)
+	}
+	wg.Wait()
+	return outputs
+}
+
+func TestFileQueue_MultiProcess(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "queue")
+	procs, count := 4, 200
+
+	runHelpers(t, "push", procs, "FILEQUEUE_FILE="+fileName, fmt.Sprintf("FILEQUEUE_COUNT=%v", count))
+	outputs := runHelpers(t, "pop", procs, "FILEQUEUE_FILE="+fileName)
+
+	seen := make(map[int]bool)
+	for _, output := range outputs {
+		for _, line := range strings.Fields(output) {
+			v, err := strconv.Atoi(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen[v] {
+				t.Fatalf("pop twice:%v", v)
+			}
+			seen[v] = true
+		}
+	}
+	assert.Equal(t, procs*count, len(seen))
+}
+
+func TestFileQueue_Reserve(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "queue")
+
+	queue := filequeue.NewFileQueue(fileName)
+	queue.SetVisibilityTimeout(100 * time.Millisecond)
+
+	for i := 1; i <= 2; i++ {
+		if err := queue.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp := 0
+	receipt1, err := queue.Reserve(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, resp)
+
+	//重启后仍然记得1已被取出
+	queue = filequeue.NewFileQueue(fileName)
+	queue.SetVisibilityTimeout(100 * time.Millisecond)
+
+	receipt2, err := queue.Reserve(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, resp)
+
+	_, err = queue.Reserve(&resp)
+	assert.Equal(t, filequeue.ErrEmpty, err)
+
+	assert.Nil(t, queue.Ack(receipt2))
+	assert.Equal(t, filequeue.ErrInvalidReceipt, queue.Ack(receipt2))
+
+	//超时未Ack，重新投递
+	time.Sleep(150 * time.Millisecond)
+	receipt3, err := queue.Reserve(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, resp)
+	assert.Equal(t, filequeue.ErrInvalidReceipt, queue.Ack(receipt1))
+	assert.Nil(t, queue.Ack(receipt3))
+
+	_, err = queue.Reserve(&resp)
+	assert.Equal(t, filequeue.ErrEmpty, err)
+}
+
+func TestFileQueue_DeadLetter(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "queue")
+
+	queue := filequeue.NewFileQueue(fileName)
+	queue.SetMaxAttempts(3)
+
+	if err := queue.Push("poison"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp := ""
+		receipt, err := queue.Reserve(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "poison", resp)
+		assert.Nil(t, queue.Nack(receipt, 0))
+	}
+
+	resp := ""
+	_, err := queue.Reserve(&resp)
+	assert.Equal(t, filequeue.ErrEmpty, err)
+
+	err = queue.DeadLetterQueue().MustPop(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "poison", resp)
+}
+
+func TestFileQueue_PeekDoesNotDeadLetter(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "queue")
+
+	queue := filequeue.NewFileQueue(fileName)
+	queue.SetMaxAttempts(2)
+	queue.SetVisibilityTimeout(50 * time.Millisecond)
+
+	assert.Nil(t, queue.Push("poison"))
+
+	//超时未Ack，投递次数达到上限
+	resp := ""
+	for i := 0; i < 2; i++ {
+		_, err := queue.Reserve(&resp)
+		assert.Nil(t, err)
+		assert.Equal(t, "poison", resp)
+		time.Sleep(80 * time.Millisecond)
+	}
+
+	assert.Equal(t, filequeue.ErrEmpty, queue.Peek(&resp))
+	assert.Nil(t, queue.Push("next"))
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, queue.Peek(&resp))
+		assert.Equal(t, "next", resp)
+	}
+
+	//Peek不修改队列
+	count, err := queue.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	count, err = queue.DeadLetterQueue().Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	//由Reserve移入死信队列
+	_, err = queue.Reserve(&resp)
+	assert.Nil(t, err)
+	assert.Equal(t, "next", resp)
+	count, err = queue.DeadLetterQueue().Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestFileQueue_NackDelay(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "queue")
+
+	queue := filequeue.NewFileQueue(fileName)
+
+	for i := 1; i <= 2; i++ {
+		if err := queue.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp := 0
+	receipt, err := queue.Reserve(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, queue.Nack(receipt, 100*time.Millisecond))
+
+	//1还没到重试时间，先取到2
+	assert.Nil(t, queue.MustPop(&resp))
+	assert.Equal(t, 2, resp)
+	assert.Equal(t, filequeue.ErrEmpty, queue.MustPop(&resp))
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Nil(t, queue.MustPop(&resp))
+	assert.Equal(t, 1, resp)
+	assert.Equal(t, filequeue.ErrEmpty, queue.MustPop(&resp))
+}
+
+func TestFileQueue_CompactPending(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "queue")
+
+	queue := filequeue.NewFileQueue(fileName)
+
+	for i := 0; i < 200; i++ {
+		if err := queue.Push(i); err != nil {
+			t.Fatal(err)
+		}
+		resp := 0
+		receipt, err := queue.Reserve(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, i, resp)
+		if err = queue.Ack(receipt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(fileName + ".pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Less(t, strings.Count(string(data), "\n"), 100)
+}
+
+func TestFileQueue_PopWait(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "queue")
+
+	queue := filequeue.NewFileQueue(fileName)
+	queue.SetPollInterval(time.Minute)
+	defer queue.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	err := queue.PopWait(ctx, new(int))
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	//同进程Push直接唤醒
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		queue.Push(1)
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp := 0
+	err = queue.PopWait(ctx, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, resp)
+
+	//其他进程Push通过fsnotify唤醒
+	go runHelpers(t, "push", 1, "FILEQUEUE_FILE="+fileName, "FILEQUEUE_COUNT=1")
+
+	start := time.Now()
+	err = queue.PopWait(ctx, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, resp)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestFileQueue_WatchedFiles(t *testing.T) {
+
+	queue := filequeue.NewFileQueue(filepath.Join(t.TempDir(), "queue"))
+	defer queue.Close()
+
+	for name, expect := range map[string]bool{
+		"queue":                 true,
+		"queue.000001.seg":      true,
+		"queue.pending":         false,
+		"queue.dead":            false,
+		"queue.dead.000001.seg": false,
+		"queue.dead.pending":    false,
+		"queue.lock":            false,
+		"queue2.000001.seg":     false,
+	} {
+		assert.Equal(t, expect, queue.IsWatched(name), name)
+	}
+}
+
+func TestFileQueue_Consume(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "queue")
+
+	queue := filequeue.NewFileQueue(fileName)
+	queue.SetRetryDelay(10 * time.Millisecond)
+	queue.SetMaxAttempts(3)
+	defer queue.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := queue.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queue.Push(-1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	lock := sync.Mutex{}
+	done := make(map[int]int)
+	failed := make(map[int]bool)
+	panics := 0
+	consumeDone := make(chan bool)
+	go func() {
+		defer close(consumeDone)
+		err := queue.Consume(ctx, 4, func(data json.RawMessage) error {
+			v := 0
+			if err := json.Unmarshal(data, &v); err != nil {
+				return err
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			defer func() {
+				if len(done) == 20 && panics == 3 {
+					cancel()
+				}
+			}()
+
+			if v < 0 {
+				panics++
+				panic("poison")
+			}
+			//每条数据第一次处理都失败
+			if !failed[v] {
+				failed[v] = true
+				return errors.New("try again")
+			}
+			done[v]++
+			return nil
+		})
+		assert.Equal(t, context.Canceled, err)
+	}()
+
+	select {
+	case <-consumeDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("consume timeout")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, 1, done[i])
+	}
+
+	//panic的数据最终进入死信队列
+	resp := 0
+	err := queue.DeadLetterQueue().MustPop(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, -1, resp)
+}
+
+func TestFileQueue_PushWithOptions(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "queue")
+
+	queue := filequeue.NewFileQueue(fileName)
+
+	assert.Nil(t, queue.Push("normal1"))
+	assert.Nil(t, queue.PushWithOptions("low", filequeue.Priority(-1)))
+	assert.Nil(t, queue.PushWithOptions("delayed", filequeue.Delay(200*time.Millisecond), filequeue.Priority(10)))
+	assert.Nil(t, queue.PushWithOptions("high", filequeue.Priority(5)))
+	assert.Nil(t, queue.PushWithOptions("higher", filequeue.Priority(6)))
+	assert.Nil(t, queue.PushWithOptions("normal2"))
+	assert.Nil(t, queue.PushWithOptions("future", filequeue.NotBefore(time.Now().Add(time.Hour))))
+
+	count, err := queue.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 7, count)
+
+	items, err := queue.List(2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(items))
+	assert.Equal(t, `"delayed"`, string(items[0].Data))
+
+	resp := ""
+	assert.Nil(t, queue.Peek(&resp))
+	assert.Equal(t, "higher", resp)
+
+	//重启后优先级和延迟仍然有效
+	queue = filequeue.NewFileQueue(fileName)
+
+	for _, want := range []string{"higher", "high", "normal1", "normal2", "low"} {
+		assert.Nil(t, queue.MustPop(&resp))
+		assert.Equal(t, want, resp)
+	}
+	assert.Equal(t, filequeue.ErrEmpty, queue.MustPop(&resp))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, queue.PopWait(ctx, &resp))
+	assert.Equal(t, "delayed", resp)
+	queue.Close()
+
+	count, err = queue.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+}
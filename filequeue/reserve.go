@@ -0,0 +1,259 @@
+package filequeue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+var ErrInvalidReceipt = errors.New("invalid receipt")
+
+const (
+	defaultVisibilityTimeout = 30 * time.Second
+	defaultMaxAttempts       = 5
+)
+
+// Receipt Reserve返回的凭证，用于Ack/Nack。每次投递的凭证都不同，
+// 超时后被重新投递的数据不能再用旧的凭证确认
+type Receipt string
+
+func newReceipt(item *pendingItem) Receipt {
+	return Receipt(fmt.Sprintf("%v:%v", item.ID, item.Attempts))
+}
+
+func (r Receipt) parse() (id int64, attempts int, err error) {
+	_, err = fmt.Sscanf(string(r), "%d:%d", &id, &attempts)
+	if err != nil {
+		return 0, 0, ErrInvalidReceipt
+	}
+	return id, attempts, nil
+}
+
+// SetVisibilityTimeout 设置Reserve后多久未Ack会重新可见
+func (q *FileQueue) SetVisibilityTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultVisibilityTimeout
+	}
+	q.visibilityTimeout = timeout
+}
+
+// SetMaxAttempts 设置最多投递次数，超过后移入死信队列。<=0时不限制
+func (q *FileQueue) SetMaxAttempts(maxAttempts int) {
+	q.maxAttempts = maxAttempts
+}
+
+// DeadLetterQueue 返回死信队列，保存多次处理失败的数据，文件名为fileName.dead
+func (q *FileQueue) DeadLetterQueue() *FileQueue {
+	q.deadOnce.Do(func() {
+		q.deadQueue = NewFileQueue(q.fileName + ".dead")
+		q.deadQueue.SetLockTimeout(q.lockTimeout)
+		q.deadQueue.SetSegmentSize(q.segmentSize)
+	})
+	return q.deadQueue
+}
+
+// Reserve 取出队头的数据但不删除，处理完成后需要调用Ack，处理失败调用Nack。
+// 超过visibilityTimeout未Ack的数据会重新可见，被再次投递
+func (q *FileQueue) Reserve(obj interface{}) (Receipt, error) {
+
+	if err := q.lockAll(); err != nil {
+		return "", err
+	}
+	defer q.unlockAll()
+
+	meta, err := q.loadMeta()
+	if err != nil {
+		log.Errorf("Reserve loadMeta err:%v", err)
+		return "", err
+	}
+
+	err = q.syncPending()
+	if err != nil {
+		log.Errorf("Reserve syncPending err:%v", err)
+		return "", err
+	}
+
+	item, next, err := q.takeReady(meta)
+	if err != nil {
+		if err == ErrEmpty {
+			if commitErr := q.commit(meta, next); commitErr != nil {
+				log.Errorf("Reserve commit err:%v", commitErr)
+			}
+		}
+		return "", err
+	}
+
+	err = json.Unmarshal(item.Data, obj)
+	if err != nil {
+		log.Errorf("Reserve Unmarshal err:%v", err)
+		return "", err
+	}
+
+	reserved := *item
+	reserved.Attempts++
+	reserved.Reserved = true
+	reserved.VisibleAt = time.Now().Add(q.visibilityTimeout).UnixNano()
+
+	//先记录pending再移动读取位置，中途崩溃时数据最多被投递两次，不会丢失
+	err = q.writePending(&pendingRecord{Op: opPut, Item: &reserved})
+	if err != nil {
+		log.Errorf("Reserve writePending err:%v", err)
+		return "", err
+	}
+
+	err = q.commit(meta, next)
+	if err != nil {
+		log.Errorf("Reserve commit err:%v", err)
+		return "", err
+	}
+
+	return newReceipt(&reserved), nil
+}
+
+// Ack 确认数据已处理完成，从队列中删除
+func (q *FileQueue) Ack(receipt Receipt) error {
+
+	if err := q.lockAll(); err != nil {
+		return err
+	}
+	defer q.unlockAll()
+
+	item, err := q.findReserved(receipt)
+	if err != nil {
+		return err
+	}
+
+	err = q.writePending(&pendingRecord{Op: opDel, ID: item.ID})
+	if err != nil {
+		log.Errorf("Ack writePending err:%v", err)
+		return err
+	}
+
+	return nil
+}
+
+// Nack 处理失败，delay之后重新投递。投递次数达到上限时移入死信队列
+func (q *FileQueue) Nack(receipt Receipt, delay time.Duration) error {
+
+	if err := q.lockAll(); err != nil {
+		return err
+	}
+	defer q.unlockAll()
+
+	item, err := q.findReserved(receipt)
+	if err != nil {
+		return err
+	}
+
+	if q.exhausted(item) {
+		return q.deadLetter(item)
+	}
+
+	retry := *item
+	retry.Reserved = false
+	retry.VisibleAt = time.Now().Add(delay).UnixNano()
+
+	err = q.writePending(&pendingRecord{Op: opPut, Item: &retry})
+	if err != nil {
+		log.Errorf("Nack writePending err:%v", err)
+		return err
+	}
+
+	q.wakeUp()
+
+	return nil
+}
+
+func (q *FileQueue) findReserved(receipt Receipt) (*pendingItem, error) {
+
+	id, attempts, err := receipt.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	err = q.syncPending()
+	if err != nil {
+		log.Errorf("FileQueue.findReserved syncPending err:%v", err)
+		return nil, err
+	}
+
+	item := q.pending[id]
+	if item == nil || !item.Reserved || item.Attempts != attempts {
+		return nil, ErrInvalidReceipt
+	}
+
+	return item, nil
+}
+
+// takeReady 取出下一个可以投递的数据：在已到时间的pending数据和segment的队头之间，取优先级高的，
+// 优先级相同时先取pending(重试的数据比segment中的更早入队)。不修改传入的meta，返回读取后的meta
+func (q *FileQueue) takeReady(meta *queueMeta) (*pendingItem, *queueMeta, error) {
+
+	now := time.Now().UnixNano()
+
+	var item *pendingItem
+	for {
+		item = q.readyPending(now, nil)
+		if item == nil || !q.exhausted(item) {
+			break
+		}
+		if err := q.deadLetter(item); err != nil {
+			return nil, meta, err
+		}
+	}
+
+	if item != nil && item.Priority >= 0 {
+		return item, meta, nil
+	}
+
+	row, next, err := q.readRecord(meta)
+	if err == ErrEmpty && item != nil {
+		return item, next, nil
+	}
+	if err != nil {
+		return nil, next, err
+	}
+
+	next.NextID++
+	return &pendingItem{ID: next.NextID, Data: row}, next, nil
+}
+
+// peekReady 返回takeReady会取出的数据，不修改队列：超过投递次数的数据只跳过，由Pop/Reserve移入死信队列
+func (q *FileQueue) peekReady(meta *queueMeta) (*pendingItem, error) {
+
+	item := q.readyPending(time.Now().UnixNano(), q.exhausted)
+	if item != nil && item.Priority >= 0 {
+		return item, nil
+	}
+
+	row, _, err := q.readRecord(meta)
+	if err == ErrEmpty && item != nil {
+		return item, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pendingItem{Data: row}, nil
+}
+
+// exhausted 已达到最大投递次数，下次取出时移入死信队列
+func (q *FileQueue) exhausted(item *pendingItem) bool {
+	return q.maxAttempts > 0 && item.Attempts >= q.maxAttempts
+}
+
+// deadLetter 将数据移入死信队列
+func (q *FileQueue) deadLetter(item *pendingItem) error {
+
+	log.Warnf("FileQueue move to dead letter. fileName:%v id:%v attempts:%v", q.fileName, item.ID, item.Attempts)
+
+	err := q.DeadLetterQueue().Push(item.Data)
+	if err != nil {
+		log.Errorf("FileQueue.deadLetter Push err:%v", err)
+		return err
+	}
+
+	return q.writePending(&pendingRecord{Op: opDel, ID: item.ID})
+}
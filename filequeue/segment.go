@@ -0,0 +1,393 @@
+package filequeue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/logxxx/utils/fileutil"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 存储格式：
+//
+//	fileName              队列元信息(queueMeta)，json格式
+//	fileName.000001.seg   segment文件，每行一条记录，只追加不修改
+//	fileName.000002.seg
+//	...
+//
+// Push只追加到TailSeg，Pop只移动HeadSeg/HeadOffset，
+// 读完的segment直接删除，因此每次操作的开销与队列长度无关。
+
+const (
+	metaVersion = 2
+
+	defaultSegmentSize int64 = 4 * 1024 * 1024
+)
+
+// queueMeta 队列元信息，保存在fileName中
+type queueMeta struct {
+	Version    int   `json:"version"`
+	HeadSeg    int64 `json:"head_seg"`          // 正在读取的segment
+	HeadOffset int64 `json:"head_offset"`       // 在HeadSeg中已读取到的位置
+	TailSeg    int64 `json:"tail_seg"`          // 正在写入的segment
+	NextID     int64 `json:"next_id,omitempty"` // 下一个进入pending的数据的id
+}
+
+func newQueueMeta() *queueMeta {
+	return &queueMeta{
+		Version: metaVersion,
+		HeadSeg: 1,
+		TailSeg: 1,
+	}
+}
+
+func (q *FileQueue) segmentName(seg int64) string {
+	return fmt.Sprintf("%v.%06d.seg", q.fileName, seg)
+}
+
+// listSegments 返回磁盘上属于该队列的所有segment编号
+func (q *FileQueue) listSegments() ([]int64, error) {
+	dir := filepath.Dir(q.fileName)
+	prefix := filepath.Base(q.fileName) + "."
+
+	children, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	segs := make([]int64, 0)
+	for _, c := range children {
+		if c.IsDir() {
+			continue
+		}
+		seg, ok := parseSegmentName(prefix, c.Name())
+		if !ok {
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+// parseSegmentName 解析prefix<编号>.seg，其他文件(如.pending、.dead队列的文件)返回false
+func parseSegmentName(prefix, name string) (int64, bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".seg") {
+		return 0, false
+	}
+	seg, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".seg"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seg, true
+}
+
+func (q *FileQueue) loadMeta() (*queueMeta, error) {
+
+	if !fileutil.HasFile(q.fileName) {
+		return newQueueMeta(), nil
+	}
+
+	fileData, err := ioutil.ReadFile(q.fileName)
+	if err != nil {
+		log.Errorf("FileQueue.loadMeta ReadFile err:%v fileName:%v", err, q.fileName)
+		return nil, err
+	}
+
+	fileData = bytes.TrimSpace(fileData)
+	if len(fileData) <= 0 {
+		return newQueueMeta(), nil
+	}
+
+	//旧版本的队列文件是一个完整的json数组
+	if fileData[0] == '[' {
+		return q.migrateLegacy(fileData)
+	}
+
+	meta := &queueMeta{}
+	err = json.Unmarshal(fileData, meta)
+	if err != nil {
+		log.Errorf("FileQueue.loadMeta Unmarshal err:%v fileName:%v", err, q.fileName)
+		return nil, err
+	}
+
+	if meta.Version != metaVersion {
+		return nil, fmt.Errorf("unsupported queue version:%v fileName:%v", meta.Version, q.fileName)
+	}
+
+	return meta, nil
+}
+
+func (q *FileQueue) saveMeta(meta *queueMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteToFileAtomic(data, q.fileName, true)
+}
+
+// migrateLegacy 将旧版本的json数组文件一次性转换为segment格式
+// 先写segment再覆盖fileName，中途失败时旧文件仍在，下次会重新转换
+func (q *FileQueue) migrateLegacy(fileData []byte) (*queueMeta, error) {
+
+	rows := make([]json.RawMessage, 0)
+	err := json.Unmarshal(fileData, &rows)
+	if err != nil {
+		log.Errorf("FileQueue.migrateLegacy Unmarshal err:%v fileName:%v", err, q.fileName)
+		return nil, err
+	}
+
+	meta := newQueueMeta()
+
+	buf := &bytes.Buffer{}
+	for _, row := range rows {
+		_, err = appendLine(buf, row)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = fileutil.WriteToFileAtomic(buf.Bytes(), q.segmentName(meta.HeadSeg), true)
+	if err != nil {
+		log.Errorf("FileQueue.migrateLegacy write segment err:%v fileName:%v", err, q.fileName)
+		return nil, err
+	}
+
+	err = q.saveMeta(meta)
+	if err != nil {
+		log.Errorf("FileQueue.migrateLegacy saveMeta err:%v fileName:%v", err, q.fileName)
+		return nil, err
+	}
+
+	log.Infof("FileQueue.migrateLegacy done. fileName:%v rows:%v", q.fileName, len(rows))
+
+	return meta, nil
+}
+
+// appendLine 以紧凑格式写入一行记录，保证记录内不含换行
+func appendLine(w io.Writer, row []byte) (int, error) {
+	buf := &bytes.Buffer{}
+	err := json.Compact(buf, row)
+	if err != nil {
+		return 0, err
+	}
+	buf.WriteByte('\n')
+	return w.Write(buf.Bytes())
+}
+
+// appendRecord 追加一条记录到TailSeg，返回meta是否有变化
+func (q *FileQueue) appendRecord(meta *queueMeta, row []byte) (bool, error) {
+
+	size, err := appendLineToFile(q.segmentName(meta.TailSeg), row)
+	if err != nil {
+		return false, err
+	}
+
+	if size < q.segmentSize {
+		return false, nil
+	}
+
+	meta.TailSeg++
+	return true, nil
+}
+
+// appendLineToFile 追加一行记录到文件末尾，返回追加后的文件大小
+func appendLineToFile(fileName string, row []byte) (int64, error) {
+
+	err := os.MkdirAll(filepath.Dir(fileName), 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	size := stat.Size()
+
+	//上次写入中途崩溃时，末尾会留下不完整的一行，先补上换行使其成为独立的坏记录
+	if size > 0 {
+		last := make([]byte, 1)
+		_, err = f.ReadAt(last, size-1)
+		if err != nil {
+			return 0, err
+		}
+		if last[0] != '\n' {
+			_, err = f.Write([]byte{'\n'})
+			if err != nil {
+				return 0, err
+			}
+			size++
+		}
+	}
+
+	n, err := appendLine(f, row)
+	if err != nil {
+		return 0, err
+	}
+
+	return size + int64(n), nil
+}
+
+// readRecord 读取队头的一条记录，返回记录和读取后的meta，不修改传入的meta
+// 无记录时返回ErrEmpty，此时返回的meta可能因跳过坏记录/空segment而变化
+func (q *FileQueue) readRecord(meta *queueMeta) (json.RawMessage, *queueMeta, error) {
+
+	next := *meta
+
+	for {
+		row, n, err := readLineAt(q.segmentName(next.HeadSeg), next.HeadOffset)
+		if err != nil && err != io.EOF {
+			return nil, &next, err
+		}
+
+		if err == io.EOF {
+			//已经写完的segment，剩下的只可能是崩溃留下的残缺记录
+			if next.HeadSeg < next.TailSeg {
+				next.HeadSeg++
+				next.HeadOffset = 0
+				continue
+			}
+			return nil, &next, ErrEmpty
+		}
+
+		next.HeadOffset += n
+
+		row = bytes.TrimSpace(row)
+		if len(row) <= 0 {
+			continue
+		}
+		if !json.Valid(row) {
+			log.Errorf("FileQueue.readRecord skip broken record:%v fileName:%v", string(row), q.fileName)
+			continue
+		}
+
+		return row, &next, nil
+	}
+
+}
+
+// scanRecords 从队头开始顺序读取segment中的所有记录，fn返回false时停止
+func (q *FileQueue) scanRecords(meta *queueMeta, fn func(row json.RawMessage) bool) error {
+
+	offset := meta.HeadOffset
+	for seg := meta.HeadSeg; seg <= meta.TailSeg; seg++ {
+		stop, err := scanFile(q.segmentName(seg), offset, fn)
+		if err != nil {
+			return err
+		}
+		if stop {
+			return nil
+		}
+		offset = 0
+	}
+
+	return nil
+}
+
+func scanFile(fileName string, offset int64, fn func(row json.RawMessage) bool) (bool, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return false, nil
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) <= 0 || !json.Valid(line) {
+			continue
+		}
+		if !fn(line) {
+			return true, nil
+		}
+	}
+}
+
+// readLineAt 读取offset处的完整一行，返回内容和读取的字节数
+// 文件不存在或没有完整的一行时返回io.EOF
+func readLineAt(fileName string, offset int64) ([]byte, int64, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		//没有换行结尾的是未写完的记录
+		return nil, 0, io.EOF
+	}
+
+	return line, int64(len(line)), nil
+}
+
+// compact 删除已经读完的segment。队列读空时切换到新的segment，避免单个segment无限增长
+func (q *FileQueue) compact(old, meta *queueMeta) (bool, error) {
+
+	for seg := old.HeadSeg; seg < meta.HeadSeg; seg++ {
+		err := os.Remove(q.segmentName(seg))
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	if meta.HeadSeg != meta.TailSeg || meta.HeadOffset <= 0 {
+		return false, nil
+	}
+
+	stat, err := os.Stat(q.segmentName(meta.TailSeg))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil && stat.Size() > meta.HeadOffset {
+		return false, nil
+	}
+
+	err = os.Remove(q.segmentName(meta.TailSeg))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	meta.HeadSeg++
+	meta.TailSeg++
+	meta.HeadOffset = 0
+
+	return true, nil
+}
@@ -0,0 +1,243 @@
+package filequeue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"github.com/logxxx/utils/runutil"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollInterval = time.Second
+	defaultRetryDelay   = time.Second
+)
+
+// SetPollInterval 设置阻塞等待时的兜底轮询间隔。
+// 同进程的Push会立即唤醒，其他进程的Push依赖fsnotify，fsnotify不可用时依赖轮询
+func (q *FileQueue) SetPollInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	q.pollInterval = interval
+}
+
+// SetRetryDelay 设置Consume中handler返回错误后，第n次重试等待n*retryDelay
+func (q *FileQueue) SetRetryDelay(delay time.Duration) {
+	q.retryDelay = delay
+}
+
+// PopWait 阻塞直到取出一条数据或ctx结束
+func (q *FileQueue) PopWait(ctx context.Context, obj interface{}) error {
+	return q.wait(ctx, func() error {
+		return q.MustPop(obj)
+	})
+}
+
+// ReserveWait 阻塞直到Reserve到一条数据或ctx结束
+func (q *FileQueue) ReserveWait(ctx context.Context, obj interface{}) (Receipt, error) {
+	var receipt Receipt
+	err := q.wait(ctx, func() (err error) {
+		receipt, err = q.Reserve(obj)
+		return err
+	})
+	return receipt, err
+}
+
+// Consume 启动concurrency个worker消费队列，直到ctx结束。
+// handler返回nil时Ack，返回错误或panic时Nack，等待一段时间后重试，多次失败后进入死信队列
+func (q *FileQueue) Consume(ctx context.Context, concurrency int, handler func(data json.RawMessage) error) error {
+
+	if handler == nil {
+		return errors.New("handler empty")
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		runutil.GoRunSafe(func() {
+			defer wg.Done()
+			q.consumeLoop(ctx, handler)
+		})
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+func (q *FileQueue) consumeLoop(ctx context.Context, handler func(data json.RawMessage) error) {
+	for {
+		data := json.RawMessage{}
+		receipt, err := q.ReserveWait(ctx, &data)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Errorf("FileQueue.Consume ReserveWait err:%v fileName:%v", err, q.fileName)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(q.pollInterval):
+			}
+			continue
+		}
+
+		finished := false
+		err = runutil.RunSafe(func() error {
+			err := handler(data)
+			finished = true
+			return err
+		})
+		if err == nil && !finished {
+			err = errors.New("handler panic")
+		}
+
+		if err == nil {
+			if err = q.Ack(receipt); err != nil {
+				log.Errorf("FileQueue.Consume Ack err:%v fileName:%v receipt:%v", err, q.fileName, receipt)
+			}
+			continue
+		}
+
+		_, attempts, _ := receipt.parse()
+		log.Warnf("FileQueue.Consume handler err:%v fileName:%v receipt:%v", err, q.fileName, receipt)
+		if err = q.Nack(receipt, time.Duration(attempts)*q.retryDelay); err != nil {
+			log.Errorf("FileQueue.Consume Nack err:%v fileName:%v receipt:%v", err, q.fileName, receipt)
+		}
+	}
+}
+
+// wait 反复执行fn，直到fn返回的不是ErrEmpty
+func (q *FileQueue) wait(ctx context.Context, fn func() error) error {
+
+	q.startWatch()
+
+	for {
+		//先拿到唤醒信号再尝试，避免尝试和等待之间的Push被漏掉
+		wakeCh := q.wakeChan()
+
+		err := fn()
+		if err != ErrEmpty {
+			return err
+		}
+
+		timeout := q.pollInterval
+		q.lock.RLock()
+		nextVisibleAt := q.nextVisibleAt
+		q.lock.RUnlock()
+		if nextVisibleAt > 0 {
+			if d := time.Until(time.Unix(0, nextVisibleAt)); d < timeout {
+				timeout = d
+			}
+		}
+
+		timer := time.NewTimer(timeout)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-wakeCh:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (q *FileQueue) wakeChan() <-chan struct{} {
+	q.waitLock.Lock()
+	defer q.waitLock.Unlock()
+	if q.waitCh == nil {
+		q.waitCh = make(chan struct{})
+	}
+	return q.waitCh
+}
+
+// wakeUp 唤醒所有等待中的消费者
+func (q *FileQueue) wakeUp() {
+	q.waitLock.Lock()
+	defer q.waitLock.Unlock()
+	if q.waitCh != nil {
+		close(q.waitCh)
+		q.waitCh = nil
+	}
+}
+
+// startWatch 监听队列文件所在目录，其他进程写入时唤醒等待中的消费者
+func (q *FileQueue) startWatch() {
+	q.waitLock.Lock()
+	defer q.waitLock.Unlock()
+
+	if q.watcher != nil || q.isClosed {
+		return
+	}
+
+	dir := filepath.Dir(q.fileName)
+	os.MkdirAll(dir, 0755)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("FileQueue.startWatch NewWatcher err:%v fileName:%v", err, q.fileName)
+		return
+	}
+	err = watcher.Add(dir)
+	if err != nil {
+		log.Errorf("FileQueue.startWatch Add err:%v dir:%v", err, dir)
+		watcher.Close()
+		return
+	}
+	q.watcher = watcher
+
+	runutil.GoRunSafe(func() {
+		for {
+			select {
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if q.isWatched(filepath.Base(e.Name)) {
+					q.wakeUp()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("FileQueue watcher err:%v fileName:%v", err, q.fileName)
+			}
+		}
+	})
+}
+
+// isWatched 只有segment和元信息文件的写入会产生新数据，pending、dead队列的写入不唤醒
+func (q *FileQueue) isWatched(name string) bool {
+	base := filepath.Base(q.fileName)
+	if name == base {
+		return true
+	}
+	_, ok := parseSegmentName(base+".", name)
+	return ok
+}
+
+// Close 停止文件监听，等待中的PopWait退化为轮询
+func (q *FileQueue) Close() error {
+	q.waitLock.Lock()
+	defer q.waitLock.Unlock()
+
+	q.isClosed = true
+	if q.watcher == nil {
+		return nil
+	}
+	err := q.watcher.Close()
+	q.watcher = nil
+	return err
+}
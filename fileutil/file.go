@@ -13,6 +13,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"time"
 )
@@ -80,23 +81,83 @@ func AppendToFile(filePath string, content string) error {
 	return nil
 }
 
+// WriteToFile 原子地写入文件，写入失败时保留原文件内容
 func WriteToFile(data []byte, filePath string) error {
+	return WriteToFileAtomic(data, filePath, false)
+}
+
+// WriteToFileAtomic 先写入同目录下的临时文件，fsync后rename覆盖目标文件。
+// 任何一步失败(包括进程崩溃)都不会破坏原文件。
+// syncDir为true时同时fsync所在目录，保证rename本身也已落盘
+func WriteToFileAtomic(data []byte, filePath string, syncDir bool) error {
 	fileDir := filepath.Dir(filePath)
-	fileName := filepath.Base(filePath)
-	file, _, err := GetOrCreateFile(fileDir, fileName)
+
+	err := os.MkdirAll(fileDir, 0755)
 	if err != nil {
+		log.Errorf("WriteToFileAtomic MkdirAll err:%v dir:%v", err, fileDir)
 		return err
 	}
-	defer file.Close()
 
-	_, err = file.Write(data)
+	perm := os.FileMode(0644)
+	if stat, err := os.Stat(filePath); err == nil {
+		perm = stat.Mode().Perm()
+	}
+
+	tmpFile, err := os.CreateTemp(fileDir, filepath.Base(filePath)+".tmp*")
 	if err != nil {
+		log.Errorf("WriteToFileAtomic CreateTemp err:%v path:%v", err, filePath)
 		return err
 	}
+	tmpPath := tmpFile.Name()
+
+	err = writeAndSync(tmpFile, data, perm)
+	if err == nil {
+		err = atomicRename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		log.Errorf("WriteToFileAtomic err:%v path:%v", err, filePath)
+		return err
+	}
+
+	if syncDir {
+		return SyncDir(fileDir)
+	}
 
 	return nil
 }
 
+// atomicRename 测试时替换，用于模拟rename之前崩溃
+var atomicRename = os.Rename
+
+func writeAndSync(f *os.File, data []byte, perm os.FileMode) error {
+	_, err := f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// SyncDir fsync目录，使目录下的新建/rename操作落盘。windows不支持，直接忽略
+func SyncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 func GetOrCreateFile(fileDir, fileName string) (*os.File, int64, error) {
 
 	filePath := filepath.Join(fileDir, fileName)
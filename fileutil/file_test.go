@@ -1,6 +1,7 @@
 package fileutil
 
 import (
+	"errors"
 	"fmt"
 	"github.com/logxxx/utils"
 	log "github.com/sirupsen/logrus"
@@ -121,3 +122,119 @@ func TestAppendToFile(t *testing.T) {
 	}
 
 }
+
+func TestWriteToFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "kv.json")
+
+	err := WriteToFileAtomic([]byte("old content"), filePath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//模拟写到一半时崩溃：临时文件只写了一部分，rename没有执行
+	atomicRename = func(oldPath, newPath string) error {
+		os.Truncate(oldPath, 3)
+		return errors.New("crash before rename")
+	}
+	err = WriteToFileAtomic([]byte("new content"), filePath, true)
+	atomicRename = os.Rename
+	if err == nil {
+		t.Fatal("want err")
+	}
+
+	result, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "old content" {
+		t.Fatalf("result:%v want:old content", string(result))
+	}
+
+	children, _ := os.ReadDir(dir)
+	if len(children) != 1 {
+		t.Fatalf("temp file left behind:%v", children)
+	}
+
+	err = WriteToFile([]byte("new content"), filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, _ = os.ReadFile(filePath)
+	if string(result) != "new content" {
+		t.Fatalf("result:%v want:new content", string(result))
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "test.lock")
+
+	l1 := NewFileLock(lockPath)
+	l2 := NewFileLock(lockPath)
+
+	err := l1.Lock(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = l2.Lock(50 * time.Millisecond)
+	if err != ErrLockTimeout {
+		t.Fatalf("err:%v want:%v", err, ErrLockTimeout)
+	}
+
+	err = l1.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = l2.Lock(50 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2.Unlock()
+}
+
+func TestFileLock_Remove(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "test.lock")
+
+	l1 := NewFileLock(lockPath)
+	l2 := NewFileLock(lockPath)
+	l3 := NewFileLock(lockPath)
+
+	err := l1.Lock(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan error)
+	go func() {
+		locked <- l2.Lock(0)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	err = l1.Remove()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l1.Unlock()
+
+	err = <-locked
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//l2锁住的是重新创建的锁文件，其他FileLock仍然拿不到锁
+	if !utils.HasFile(lockPath) {
+		t.Fatalf("lock file not recreated")
+	}
+	err = l3.Lock(50 * time.Millisecond)
+	if err != ErrLockTimeout {
+		t.Fatalf("err:%v want:%v", err, ErrLockTimeout)
+	}
+	l2.Unlock()
+
+	err = NewFileLock(lockPath).Remove()
+	if err == nil {
+		t.Fatalf("remove without lock should fail")
+	}
+}
@@ -0,0 +1,128 @@
+package fileutil
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrLockTimeout = errors.New("lock timeout")
+
+// FileLock 基于flock(windows下为LockFileEx)的跨进程建议锁。
+// 只对同样使用FileLock的进程有效，不能防止其他程序直接修改文件
+type FileLock struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+}
+
+func NewFileLock(path string) *FileLock {
+	return &FileLock{
+		path: path,
+	}
+}
+
+// Lock 获取排他锁，timeout<=0时一直等待
+func (l *FileLock) Lock(timeout time.Duration) error {
+	return l.doLock(true, timeout)
+}
+
+// RLock 获取共享锁，timeout<=0时一直等待
+func (l *FileLock) RLock(timeout time.Duration) error {
+	return l.doLock(false, timeout)
+}
+
+func (l *FileLock) doLock(exclusive bool, timeout time.Duration) error {
+
+	//同一个FileLock在进程内也是互斥的
+	l.lock.Lock()
+
+	err := os.MkdirAll(filepath.Dir(l.path), 0755)
+	if err != nil {
+		l.lock.Unlock()
+		return err
+	}
+
+	for {
+		f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			l.lock.Unlock()
+			return err
+		}
+
+		if timeout <= 0 {
+			err = lockFile(f, exclusive, true)
+		} else {
+			err = tryLockFile(f, exclusive, timeout)
+		}
+		if err != nil {
+			f.Close()
+			l.lock.Unlock()
+			return err
+		}
+
+		//等待期间锁文件被持有者Remove了，锁住的是已删除的文件，需要重新打开
+		if !sameFile(f, l.path) {
+			unlockFile(f)
+			f.Close()
+			continue
+		}
+
+		l.file = f
+		return nil
+	}
+}
+
+func sameFile(f *os.File, path string) bool {
+	fi1, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	fi2, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi1, fi2)
+}
+
+func tryLockFile(f *os.File, exclusive bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	wait := time.Millisecond
+	for {
+		err := lockFile(f, exclusive, false)
+		if err == nil {
+			return nil
+		}
+		if err != errWouldBlock {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return ErrLockTimeout
+		}
+		time.Sleep(wait)
+		if wait < 50*time.Millisecond {
+			wait *= 2
+		}
+	}
+}
+
+// Remove 持有锁时删除锁文件，正在等待的FileLock会重新创建锁文件
+func (l *FileLock) Remove() error {
+	if l.file == nil {
+		return errors.New("lock is not held")
+	}
+	return os.Remove(l.path)
+}
+
+func (l *FileLock) Unlock() error {
+	if l.file == nil {
+		return nil
+	}
+	err := unlockFile(l.file)
+	l.file.Close()
+	l.file = nil
+	l.lock.Unlock()
+	return err
+}
@@ -0,0 +1,51 @@
+// 检查matcher规则文件(yaml/json)，用法：
+//
+//	go run ./matcher/cmd [-strict] rules.yaml ...
+//
+// 每个问题输出一行：file:line:column: severity: path: msg。
+// 有error时退出码为1，使用-strict时warning也会返回1
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/logxxx/utils/matcher"
+)
+
+func main() {
+	strict := flag.Bool("strict", false, "exit with 1 on warnings")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-strict] file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, file := range flag.Args() {
+		issues, err := matcher.ValidateFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			failed = true
+			continue
+		}
+		for _, issue := range issues {
+			fmt.Printf("%s:%d:%d: %v: ", file, issue.Line, issue.Column, issue.Severity)
+			if issue.Path != "" {
+				fmt.Printf("%s: ", issue.Path)
+			}
+			fmt.Println(issue.Msg)
+			if issue.Severity == matcher.SeverityError || *strict {
+				failed = true
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
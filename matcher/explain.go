@@ -0,0 +1,261 @@
+package matcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Explanation Filter执行过程中的一个节点，用于排查规则为什么没有生效。
+// 节点的组织与Filter一致：filter节点下按执行顺序依次是match、notMatch、matchAll、matchAny，
+// 与Filter一样遇到不通过的条件就返回，之后的节点Skipped为true，没有执行
+type Explanation struct {
+	Kind        string `json:"kind"`           // filter、match、notMatch、matchAll、matchAny
+	Description string `json:"desc,omitempty"` // Filter.Description
+
+	// match节点
+	Expression string      `json:"expr,omitempty"`    // 表达式，与Filter.String格式一致
+	Matcher    string      `json:"matcher,omitempty"` // Matcher.Description()
+	Key        string      `json:"key,omitempty"`
+	Value      interface{} `json:"value"`           // 取到的值，""、0、false也保留
+	Found      bool        `json:"found,omitempty"` // 数据中是否有Key
+
+	Result  bool   `json:"result"`
+	Skipped bool   `json:"skipped,omitempty"` // 被短路，没有执行
+	Error   string `json:"error,omitempty"`   // ExplainValue的数据无法解析时的错误，此时没有子节点
+
+	// Response filter节点合并的返回值(ResponseAlways、ResponseOnMatch、ResponseOnNotMatch)，
+	// 值为合并后的结果，nil表示被删除
+	Response map[string]interface{} `json:"response,omitempty"`
+
+	Children []*Explanation `json:"children,omitempty"`
+}
+
+// Explain 执行Filter并返回执行过程，结果与FilterWithResponse一致
+func (f *Filter) Explain(data map[string]string) *Explanation {
+	if data == nil {
+		data = map[string]string{}
+	}
+	return f.explainData(stringMap(data))
+}
+
+// ExplainValue 同Explain，data可以是任意类型，见FilterValue
+func (f *Filter) ExplainValue(data interface{}) *Explanation {
+	ds, err := newTypedData(data)
+	if err != nil {
+		//与FilterValue一致，不通过
+		node := &Explanation{Kind: "filter", Error: err.Error()}
+		if f != nil {
+			node.Description = f.Description
+		}
+		return node
+	}
+	return f.explainData(ds)
+}
+
+func (f *Filter) explainData(data dataSource) *Explanation {
+	if f == nil {
+		return &Explanation{Kind: "filter"}
+	}
+	return f.explain(data, make(map[string]interface{}), f.MergeResponseRecursively)
+}
+
+// explain 与doFilter的执行顺序保持一致
+func (f *Filter) explain(data dataSource, resp map[string]interface{}, mergeValueRecursively bool) *Explanation {
+	node := &Explanation{Kind: "filter", Description: f.Description}
+	node.merge(resp, f.ResponseAlways, data, mergeValueRecursively)
+
+	pass := true
+
+	if f.Match != nil {
+		if !pass {
+			node.Children = append(node.Children, f.Match.skipped())
+		} else {
+			child := f.Match.explain(data)
+			node.Children = append(node.Children, child)
+			pass = child.Result
+		}
+	}
+
+	if f.NotMatch != nil {
+		if !pass {
+			node.Children = append(node.Children, &Explanation{Kind: "notMatch", Skipped: true, Children: []*Explanation{f.NotMatch.skipped()}})
+		} else {
+			sub := f.NotMatch.explain(data, resp, mergeValueRecursively)
+			node.Children = append(node.Children, &Explanation{Kind: "notMatch", Result: !sub.Result, Children: []*Explanation{sub}})
+			pass = !sub.Result
+		}
+	}
+
+	if len(f.MatchAll) > 0 {
+		all := &Explanation{Kind: "matchAll", Skipped: !pass, Result: pass}
+		for _, sub := range f.MatchAll {
+			if sub == nil {
+				continue
+			}
+			if all.Skipped || !all.Result {
+				all.Children = append(all.Children, sub.skipped())
+				continue
+			}
+			child := sub.explain(data, resp, mergeValueRecursively)
+			all.Children = append(all.Children, child)
+			all.Result = child.Result
+		}
+		node.Children = append(node.Children, all)
+		pass = pass && all.Result
+	}
+
+	if len(f.MatchAny) > 0 {
+		any := &Explanation{Kind: "matchAny", Skipped: !pass}
+		for _, sub := range f.MatchAny {
+			if sub == nil {
+				continue
+			}
+			if any.Skipped || any.Result {
+				any.Children = append(any.Children, sub.skipped())
+				continue
+			}
+			child := sub.explain(data, resp, mergeValueRecursively)
+			any.Children = append(any.Children, child)
+			any.Result = child.Result
+		}
+		node.Children = append(node.Children, any)
+		pass = pass && any.Result
+	}
+
+	node.Result = pass
+	if pass {
+		node.merge(resp, f.ResponseOnMatch, data, mergeValueRecursively)
+	} else {
+		node.merge(resp, f.ResponseOnNotMatch, data, mergeValueRecursively)
+	}
+	return node
+}
+
+// merge 执行mergeValue，并记录from中的key合并后的值
+func (e *Explanation) merge(resp map[string]interface{}, from map[string]interface{}, data dataSource, recursively bool) {
+	if len(from) == 0 {
+		return
+	}
+	mergeValue(resp, from, data, recursively)
+	if e.Response == nil {
+		e.Response = make(map[string]interface{}, len(from))
+	}
+	for k := range from {
+		e.Response[k] = resp[k]
+	}
+}
+
+// skipped 没有执行的Filter，只保留结构
+func (f *Filter) skipped() *Explanation {
+	node := &Explanation{Kind: "filter", Description: f.Description, Skipped: true}
+	if f.Match != nil {
+		node.Children = append(node.Children, f.Match.skipped())
+	}
+	if f.NotMatch != nil {
+		node.Children = append(node.Children, &Explanation{Kind: "notMatch", Skipped: true, Children: []*Explanation{f.NotMatch.skipped()}})
+	}
+	if len(f.MatchAll) > 0 {
+		all := &Explanation{Kind: "matchAll", Skipped: true}
+		for _, sub := range f.MatchAll {
+			if sub != nil {
+				all.Children = append(all.Children, sub.skipped())
+			}
+		}
+		node.Children = append(node.Children, all)
+	}
+	if len(f.MatchAny) > 0 {
+		any := &Explanation{Kind: "matchAny", Skipped: true}
+		for _, sub := range f.MatchAny {
+			if sub != nil {
+				any.Children = append(any.Children, sub.skipped())
+			}
+		}
+		node.Children = append(node.Children, any)
+	}
+	return node
+}
+
+func (exp *Expression) explain(data dataSource) *Explanation {
+	node := exp.skipped()
+	node.Skipped = false
+	node.Value, node.Found = data.lookup(exp.key)
+	node.Result = exp.matchData(data)
+	return node
+}
+
+func (exp *Expression) skipped() *Explanation {
+	return &Explanation{
+		Kind:       "match",
+		Expression: exp.text(),
+		Matcher:    exp.matcher.Description(),
+		Key:        exp.key,
+		Skipped:    true,
+	}
+}
+
+// String 缩进的文本报告，例如：
+//
+//	[FAIL] filter: vip rule
+//	  [PASS] version >= 1.2.0  (version not less than, version="1.3.0")
+//	  [FAIL] matchAny
+//	    [FAIL] channel in [a, b]  (in, channel="c")
+//	    [FAIL] size > 10  (greater than, size=<missing>)
+//	  response: {"vip":false}
+func (e *Explanation) String() string {
+	buf := &bytes.Buffer{}
+	e.writeText(buf, 0)
+	return buf.String()
+}
+
+func (e *Explanation) writeText(buf *bytes.Buffer, depth int) {
+	//没有描述和返回值的filter节点只有一个子节点时不单独占一行
+	if e.Kind == "filter" && e.Description == "" && e.Error == "" && len(e.Response) == 0 && len(e.Children) == 1 {
+		e.Children[0].writeText(buf, depth)
+		return
+	}
+
+	indent := strings.Repeat("  ", depth)
+	status := "[FAIL]"
+	if e.Skipped {
+		status = "[SKIP]"
+	} else if e.Result {
+		status = "[PASS]"
+	}
+	buf.WriteString(indent + status + " ")
+
+	switch e.Kind {
+	case "match":
+		buf.WriteString(e.Expression + "  (" + e.Matcher)
+		if !e.Skipped {
+			value := "<missing>"
+			if e.Found {
+				value = fmt.Sprintf("%q", toString(e.Value))
+			}
+			buf.WriteString(", " + e.Key + "=" + value)
+		}
+		buf.WriteString(")")
+	case "filter":
+		buf.WriteString("filter")
+		if e.Description != "" {
+			buf.WriteString(": " + e.Description)
+		}
+		if e.Error != "" {
+			buf.WriteString("  (" + e.Error + ")")
+		}
+	default:
+		buf.WriteString(e.Kind)
+	}
+	buf.WriteString("\n")
+
+	for _, child := range e.Children {
+		child.writeText(buf, depth+1)
+	}
+
+	if len(e.Response) > 0 {
+		//json.Marshal按key排序
+		bs, _ := json.Marshal(e.Response)
+		buf.WriteString(indent + "  response: " + string(bs) + "\n")
+	}
+}
@@ -0,0 +1,159 @@
+package matcher
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestFilter_Explain(t *testing.T) {
+	f := new(Filter)
+	err := yaml.Unmarshal([]byte(`
+desc: vip rule
+responseAlways:
+  vip: false
+responseOnMatch:
+  vip: true
+  channel: "{{channel}}"
+responseOnNotMatch:
+  reason: not vip
+matchAll:
+- match: [version, ">=", 1.2.0]
+- matchAny:
+  - match: [channel, in, a, b]
+  - notMatch:
+      match: [size, ">", 10]
+  - match: [user, "==", admin]
+`), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := f.Explain(map[string]string{"version": "1.3.0", "channel": "c", "size": "50"})
+	assert.False(t, e.Result)
+	assert.Equal(t, map[string]interface{}{"vip": false, "reason": "not vip"}, e.Response)
+	assert.Equal(t, `[FAIL] filter: vip rule
+  [FAIL] matchAll
+    [PASS] version >= 1.2.0  (version not less than, version="1.3.0")
+    [FAIL] matchAny
+      [FAIL] channel in [a, b]  (in, channel="c")
+      [FAIL] notMatch
+        [PASS] size > 10  (greater than, size="50")
+      [FAIL] user == admin  (in, user=<missing>)
+  response: {"reason":"not vip","vip":false}
+`, e.String())
+
+	//matchAny第一个通过后，后面的被短路
+	e = f.Explain(map[string]string{"version": "1.3.0", "channel": "a"})
+	assert.True(t, e.Result)
+	assert.Equal(t, map[string]interface{}{"vip": true, "channel": "a"}, e.Response)
+	assert.Equal(t, `[PASS] filter: vip rule
+  [PASS] matchAll
+    [PASS] version >= 1.2.0  (version not less than, version="1.3.0")
+    [PASS] matchAny
+      [PASS] channel in [a, b]  (in, channel="a")
+      [SKIP] notMatch
+        [SKIP] size > 10  (greater than)
+      [SKIP] user == admin  (in)
+  response: {"channel":"a","vip":true}
+`, e.String())
+
+	//matchAll第一个不通过后，后面的被短路
+	e = f.Explain(map[string]string{"version": "1.0.0", "channel": "a"})
+	assert.False(t, e.Result)
+	all := e.Children[0]
+	assert.False(t, all.Children[0].Result)
+	assert.True(t, all.Children[1].Skipped)
+	for _, child := range all.Children[1].Children {
+		assert.True(t, child.Skipped)
+	}
+
+	bs, err := json.Marshal(e)
+	assert.Nil(t, err)
+	m := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(bs, &m))
+	assert.Equal(t, "vip rule", m["desc"])
+	//filter -> matchAll -> filter -> match
+	version := m["children"].([]interface{})[0].(map[string]interface{})["children"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "filter", version["kind"])
+	version = version["children"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "match", version["kind"])
+	assert.Equal(t, "version >= 1.2.0", version["expr"])
+	assert.Equal(t, "1.0.0", version["value"])
+	assert.Equal(t, false, version["result"])
+
+	//取到的空值也输出
+	for _, v := range []interface{}{"", 0, false} {
+		bs, err = json.Marshal(MustParseFilter(`v == 1`).ExplainValue(map[string]interface{}{"v": v}))
+		assert.Nil(t, err)
+		m = map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal(bs, &m))
+		match := m["children"].([]interface{})[0].(map[string]interface{})
+		value, ok := match["value"]
+		assert.True(t, ok, string(bs))
+		assert.EqualValues(t, v, value, string(bs))
+		assert.Equal(t, true, match["found"])
+	}
+}
+
+func TestFilter_ExplainConsistent(t *testing.T) {
+	rules := []string{
+		`a == 1`,
+		`!a == 1`,
+		`a == 1 && b == 2`,
+		`a == 1 || b == 2`,
+		`(a == 1 || b == 2) && !(c > 3 && d < 1)`,
+		`true`,
+		`false`,
+		`a in [1, 2] && (b hasPrefix x || c == "" || !d != 5)`,
+	}
+	datas := []map[string]string{
+		{},
+		{"a": "1"},
+		{"a": "1", "b": "2"},
+		{"b": "2", "c": "4", "d": "0"},
+		{"a": "2", "b": "xy", "d": "5"},
+		{"a": "1", "c": "x", "d": "4"},
+	}
+
+	for _, rule := range rules {
+		f := MustParseFilter(rule)
+		f.MatchAny = append(f.MatchAny, nil)
+		for _, data := range datas {
+			e := f.Explain(data)
+			assert.Equal(t, f.Filter(data), e.Result, "%v %v\n%v", rule, data, e)
+			assert.Equal(t, f.FilterValue(data), f.ExplainValue(data).Result, "%v %v", rule, data)
+		}
+	}
+
+	var nilFilter *Filter
+	assert.False(t, nilFilter.Explain(nil).Result)
+}
+
+func TestFilter_ExplainValue(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int `json:"age"`
+	}
+	data := map[string]interface{}{"user": user{Name: "tom", Age: 20}}
+
+	f := MustParseFilter(`user.age > 18 && user.name == jerry`)
+	e := f.ExplainValue(data)
+	assert.False(t, e.Result)
+	assert.Equal(t, `[FAIL] matchAll
+  [PASS] user.age > 18  (greater than, user.age="20")
+  [FAIL] user.name == jerry  (in, user.name="tom")
+`, e.String())
+	ok, _ := f.FilterValueWithResponse(data)
+	assert.Equal(t, ok, e.Result)
+
+	//json格式错误时不通过，并给出错误
+	e = MustParseFilter(`!channel == a`).ExplainValue([]byte("{bad json"))
+	assert.False(t, e.Result)
+	assert.NotEmpty(t, e.Error)
+	assert.Empty(t, e.Children)
+	assert.True(t, strings.HasPrefix(e.String(), "[FAIL] filter  ("), e.String())
+}
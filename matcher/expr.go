@@ -47,6 +47,23 @@ func (exp *Expression) Match(data map[string]string) bool {
 	return exp.matcher.Match(src)
 }
 
+// MatchValue same as Match, data can be any type, see Filter.FilterValue.
+func (exp *Expression) MatchValue(data interface{}) bool {
+	ds, err := newTypedData(data)
+	if err != nil {
+		return false
+	}
+	return exp.matchData(ds)
+}
+
+func (exp *Expression) matchData(data dataSource) bool {
+	if m, ok := data.(stringMap); ok {
+		return exp.matcher.Match(m[exp.key])
+	}
+	v, _ := data.lookup(exp.key)
+	return matchValue(exp.matcher, v)
+}
+
 // String implements the Stringer interface, return json format string.
 func (exp *Expression) String() string {
 	bs, _ := exp.MarshalJSON()
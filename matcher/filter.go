@@ -1,7 +1,6 @@
 package matcher
 
 import (
-	"encoding/json"
 	"fmt"
 	"strings"
 )
@@ -63,13 +62,41 @@ func (f *Filter) FilterWithResponse(data map[string]string) (bool, map[string]in
 	}
 
 	resp := make(map[string]interface{})
-	ok := f.doFilter(data, resp, f.MergeResponseRecursively)
+	ok := f.doFilter(stringMap(data), resp, f.MergeResponseRecursively)
 	if !ok {
 		//resp = nil
 	}
 	return ok, resp
 }
 
+// FilterValueWithResponse 同FilterWithResponse，data可以是任意类型，见FilterValue
+func (f *Filter) FilterValueWithResponse(data interface{}) (bool, map[string]interface{}) {
+	if f == nil {
+		return false, map[string]interface{}{}
+	}
+
+	ds, err := newTypedData(data)
+	if err != nil {
+		//json格式错误时不通过，与Expression.MatchValue一致，否则!a == 1这样的规则会通过
+		return false, map[string]interface{}{}
+	}
+
+	resp := make(map[string]interface{})
+	ok := f.doFilter(ds, resp, f.MergeResponseRecursively)
+	return ok, resp
+}
+
+// FilterValue 同Filter，data可以是struct、map、slice及其指针，[]byte和json.RawMessage按json解析。
+// key支持路径，如 user.name、user.tags[0]、$.user["first name"]，struct字段按json tag或字段名查找。
+// 数字等类型的值直接参与比较，不会先转换为字符串
+func (f *Filter) FilterValue(data interface{}) bool {
+	if f == nil {
+		return false
+	}
+	ok, _ := f.FilterValueWithResponse(data)
+	return ok
+}
+
 // Walk 和Filter功能不同, 使用Walk时, matchAny和matchAll会走完所有子选项, 遇到false也不会立即返回
 // 目的是将所有能匹配的分支中的responseOnMatch都返回出来
 // 如:
@@ -96,11 +123,11 @@ func (f *Filter) Walk(data map[string]string) (bool, map[string]interface{}) {
 	}
 
 	resp := make(map[string]interface{})
-	ok := f.walkFilter(data, resp, f.MergeResponseRecursively)
+	ok := f.walkFilter(stringMap(data), resp, f.MergeResponseRecursively)
 	return ok, resp
 }
 
-func (f *Filter) walkFilter(data map[string]string, resp map[string]interface{}, mergeValueRecursively bool) (result bool) {
+func (f *Filter) walkFilter(data dataSource, resp map[string]interface{}, mergeValueRecursively bool) (result bool) {
 	res := -1
 	mergeValue(resp, f.ResponseAlways, data, mergeValueRecursively)
 	defer func() {
@@ -148,7 +175,7 @@ func (f *Filter) walkFilter(data map[string]string, resp map[string]interface{},
 		if res == 0 {
 			return false
 		}
-		return f.Match.Match(data)
+		return f.Match.matchData(data)
 	}
 
 	return res == 1
@@ -164,14 +191,18 @@ func (f *Filter) Filter(data map[string]string) bool {
 	return ok
 }
 
-func getValue(data map[string]string, key string) string {
+func getValue(data dataSource, key string) interface{} {
 	if strings.HasPrefix(key, "{{") && strings.HasSuffix(key, "}}") {
-		return data[key[2:len(key)-2]]
+		v, ok := data.lookup(key[2 : len(key)-2])
+		if !ok {
+			return ""
+		}
+		return v
 	}
 	return key
 }
 
-func mergeValue(target map[string]interface{}, from map[string]interface{}, data map[string]string, recursively bool) {
+func mergeValue(target map[string]interface{}, from map[string]interface{}, data dataSource, recursively bool) {
 	if len(from) == 0 {
 		return
 	}
@@ -219,7 +250,7 @@ func mergeValue(target map[string]interface{}, from map[string]interface{}, data
 	}
 }
 
-func copySliceForMerge(slice []interface{}, data map[string]string, recursively bool) []interface{} {
+func copySliceForMerge(slice []interface{}, data dataSource, recursively bool) []interface{} {
 	if len(slice) == 0 {
 		return slice
 	}
@@ -300,7 +331,7 @@ func findFunction(s string) (function Function, arg string, found bool) {
 	return
 }
 
-func (f *Filter) doFilter(data map[string]string, resp map[string]interface{}, mergeValueRecursively bool) (result bool) {
+func (f *Filter) doFilter(data dataSource, resp map[string]interface{}, mergeValueRecursively bool) (result bool) {
 	mergeValue(resp, f.ResponseAlways, data, mergeValueRecursively)
 	defer func() {
 		if !result {
@@ -309,7 +340,7 @@ func (f *Filter) doFilter(data map[string]string, resp map[string]interface{}, m
 	}()
 
 	if f.Match != nil {
-		if !f.Match.Match(data) {
+		if !f.Match.matchData(data) {
 			return false
 		}
 	}
@@ -351,13 +382,11 @@ func (f *Filter) doFilter(data map[string]string, resp map[string]interface{}, m
 	return true
 }
 
-// String 返回json格式字符串
+// String 返回中缀表达式，可以用ParseFilter解析回来。
+// 只包含匹配条件，Description和Response需要用json/yaml序列化
 func (f *Filter) String() string {
-	bs, err := json.Marshal(f)
-	if err != nil {
-		fmt.Printf("filter:%#v, json.Marshal err:%v\n", f, err)
-	}
-	return string(bs)
+	s, _ := f.text()
+	return s
 }
 
 // ModifyValues 修改底层Expr中的参数, 一次性修改之后都可以使用
@@ -922,7 +922,7 @@ map:
 		t.Logf("\n---from:%s", mapToStr(from))
 		t.Logf("\n---expect:%s", mapToStr(expectM))
 
-		mergeValue(target, from, v.data, true)
+		mergeValue(target, from, stringMap(v.data), true)
 
 		expect := mapToStr(expectM)
 		got := mapToStr(target)
@@ -1,9 +1,12 @@
 package matcher
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -14,6 +17,20 @@ type Matcher interface {
 	Match(src string) bool
 }
 
+// ValueMatcher is an optional interface for Matcher, used by Filter.FilterValue
+// to match typed values (numbers, bools...) without converting them to string first.
+type ValueMatcher interface {
+	MatchValue(v interface{}) bool
+}
+
+// matchValue use m.MatchValue if m implements ValueMatcher, otherwise match v as string.
+func matchValue(m Matcher, v interface{}) bool {
+	if vm, ok := m.(ValueMatcher); ok {
+		return vm.MatchValue(v)
+	}
+	return m.Match(toString(v))
+}
+
 type newMatcherFunc func(args []string, datadataSource ...func(string) interface{}) (Matcher, error)
 
 var registeredMatchers = new(sync.Map)
@@ -59,6 +76,11 @@ var internalMatcherFunctions = map[string]newMatcherFunc{
 	"sizeNotLessThan":    newFileSizeMatcherFunc("string not less than", func(src, dst FileSize) bool { return src >= dst }),
 	"sizeGreaterThan":    newFileSizeMatcherFunc("string greater than", func(src, dst FileSize) bool { return src > dst }),
 	"sizeNotGreaterThan": newFileSizeMatcherFunc("string not greater than", func(src, dst FileSize) bool { return src <= dst }),
+
+	"bytesLessThan":       newBytesMatcherFunc("bytes less than", func(src, dst float64) bool { return src < dst }),
+	"bytesNotLessThan":    newBytesMatcherFunc("bytes not less than", func(src, dst float64) bool { return src >= dst }),
+	"bytesGreaterThan":    newBytesMatcherFunc("bytes greater than", func(src, dst float64) bool { return src > dst }),
+	"bytesNotGreaterThan": newBytesMatcherFunc("bytes not greater than", func(src, dst float64) bool { return src <= dst }),
 }
 
 func init() {
@@ -107,6 +129,10 @@ func (n notMatcher) Match(src string) bool {
 	return !n.Matcher.Match(src)
 }
 
+func (n notMatcher) MatchValue(v interface{}) bool {
+	return !matchValue(n.Matcher, v)
+}
+
 // ------in------
 
 func newIn(args []string, dataSource ...func(string) interface{}) (Matcher, error) {
@@ -141,6 +167,18 @@ func (m *in) Match(src string) bool {
 	return ok
 }
 
+func (m *in) MatchValue(v interface{}) bool {
+	if m.Match(toString(v)) {
+		return true
+	}
+	//数字按数值比较，如1.0和1
+	switch v.(type) {
+	case json.Number, float64, float32, int, int64, int32, uint, uint64, uint32:
+		return m.Match(strconv.FormatFloat(toFloat(v), 'f', -1, 64))
+	}
+	return false
+}
+
 // ------lessThan------
 
 func newLessThan(args []string, dataSource ...func(string) interface{}) (Matcher, error) {
@@ -163,6 +201,10 @@ func (m *lessThan) Match(src string) bool {
 	return toNumber(src) < m.data
 }
 
+func (m *lessThan) MatchValue(v interface{}) bool {
+	return toFloat(v) < m.data
+}
+
 // ------greaterThan------
 
 func newGreaterThan(args []string, dataSource ...func(string) interface{}) (Matcher, error) {
@@ -185,6 +227,10 @@ func (m *greaterThan) Match(src string) bool {
 	return toNumber(src) > m.data
 }
 
+func (m *greaterThan) MatchValue(v interface{}) bool {
+	return toFloat(v) > m.data
+}
+
 // ------versionLessThan------
 
 func newVersionLessThan(args []string, dataSource ...func(string) interface{}) (Matcher, error) {
@@ -386,3 +432,79 @@ func NewFileSize(path string) (FileSize, error) {
 	}
 	return FileSize(stat.Size()), nil
 }
+
+// ------bytesMatcher------
+
+var bytesPattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([a-zA-Z]*)$`)
+
+var byteUnits = map[string]float64{
+	"":   1,
+	"b":  1,
+	"kb": 1 << 10,
+	"mb": 1 << 20,
+	"gb": 1 << 30,
+	"tb": 1 << 40,
+}
+
+// parseBytes parses sizes like 512, 10MB, 1.5gb into bytes, units are KB/MB/GB/TB (1024 based, case insensitive).
+func parseBytes(s string) (float64, bool) {
+	match := bytesPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0, false
+	}
+	unit, ok := byteUnits[strings.ToLower(match[2])]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return n * unit, true
+}
+
+// isBytesLiteral reports whether s is a size with a unit, such as 10MB.
+func isBytesLiteral(s string) bool {
+	match := bytesPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil || match[2] == "" {
+		return false
+	}
+	_, ok := parseBytes(s)
+	return ok
+}
+
+type bytesMatcher struct {
+	dst         float64
+	description string
+	matchFunc   func(src, dst float64) bool
+}
+
+func (m *bytesMatcher) Description() string {
+	return m.description
+}
+
+// Match src that is not a size never matches.
+func (m *bytesMatcher) Match(src string) bool {
+	size, ok := parseBytes(src)
+	if !ok {
+		return false
+	}
+	return m.matchFunc(size, m.dst)
+}
+
+func newBytesMatcherFunc(desc string, matchFunc func(src, dst float64) bool) newMatcherFunc {
+	return func(args []string, dataSource ...func(string) interface{}) (Matcher, error) {
+		if len(args) != 1 {
+			return nil, ErrArgsSize
+		}
+		dst, ok := parseBytes(args[0])
+		if !ok {
+			return nil, fmt.Errorf("invalid size:%q", args[0])
+		}
+		return &bytesMatcher{
+			dst:         dst,
+			description: desc,
+			matchFunc:   matchFunc,
+		}, nil
+	}
+}
@@ -0,0 +1,476 @@
+package matcher
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ParseFilter 把中缀表达式编译为Filter，例如：
+//
+//	version >= "1.2.0" && (channel in ["a","b"] || !(size > 10MB))
+//
+// 语法：
+//
+//	expr       = or
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" expr ")" | "true" | "false" | comparison
+//	comparison = key operator value
+//	key        = word | string
+//	operator   = "==" | "!=" | ">" | ">=" | "<" | "<=" | 已注册的matcher名(in、notIn、hasPrefix...)
+//	value      = word | string | "[" [ value { "," value } ] "]"
+//
+// word为不含空白和 ()[],!&|=<>"' 的连续字符，如 key、user.tags[0]、10MB、1.2.0、-5；
+// >、>=、<、<= 的值为带单位的大小(KB、MB、GB、TB，按1024进位)时按字节数比较，key的值也按大小解析，如 9MB、11000000；
+// string为单引号或双引号字符串，双引号支持Go的转义。
+// a && b 编译为matchAll，a || b 编译为matchAny，!a 编译为notMatch，true为空Filter。
+func ParseFilter(s string) (*Filter, error) {
+	p := &parser{src: s}
+	err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf(p.tok.pos, "unexpected %v", p.tok)
+	}
+	return f, nil
+}
+
+// MustParseFilter 同ParseFilter，出错时panic，用于初始化固定的规则
+func MustParseFilter(s string) *Filter {
+	f, err := ParseFilter(s)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// SyntaxError 表达式错误，Line、Column从1开始
+type SyntaxError struct {
+	Line   int
+	Column int
+	Msg    string
+	Err    error // 编译matcher时的错误，如ErrUnknownOperator、ErrArgsSize
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at line %d column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokOp     // == != > >= < <=
+	tokAnd    // &&
+	tokOr     // ||
+	tokNot    // !
+	tokLParen // (
+	tokRParen // )
+	tokLBrack // [
+	tokRBrack // ]
+	tokComma  // ,
+)
+
+type token struct {
+	kind tokenKind
+	text string // 字符串为去掉引号、处理转义后的内容
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+type parser struct {
+	src string
+	pos int
+	tok token
+}
+
+func (p *parser) errorf(pos int, format string, args ...interface{}) *SyntaxError {
+	line, col := 1, 1
+	for _, c := range p.src[:pos] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return &SyntaxError{Line: line, Column: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func isWordChar(c byte) bool {
+	switch c {
+	case ' ', '\t', '\r', '\n', '(', ')', '[', ']', ',', '!', '&', '|', '=', '<', '>', '"', '\'':
+		return false
+	}
+	return true
+}
+
+// next 读取下一个token到p.tok
+func (p *parser) next() error {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = token{kind: tokEOF, pos: start}
+		return nil
+	}
+
+	rest := p.src[p.pos:]
+	for _, op := range []struct {
+		text string
+		kind tokenKind
+	}{
+		{"&&", tokAnd}, {"||", tokOr},
+		{"==", tokOp}, {"!=", tokOp}, {">=", tokOp}, {"<=", tokOp}, {">", tokOp}, {"<", tokOp},
+		{"!", tokNot}, {"(", tokLParen}, {")", tokRParen}, {"[", tokLBrack}, {"]", tokRBrack}, {",", tokComma},
+	} {
+		if strings.HasPrefix(rest, op.text) {
+			p.pos += len(op.text)
+			p.tok = token{kind: op.kind, text: op.text, pos: start}
+			return nil
+		}
+	}
+
+	switch c := p.src[p.pos]; {
+	case c == '"':
+		end := p.pos + 1
+		for end < len(p.src) && p.src[end] != '"' {
+			if p.src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(p.src) {
+			return p.errorf(start, "unterminated string")
+		}
+		s, err := strconv.Unquote(p.src[p.pos : end+1])
+		if err != nil {
+			return p.errorf(start, "invalid string %v", p.src[p.pos:end+1])
+		}
+		p.pos = end + 1
+		p.tok = token{kind: tokString, text: s, pos: start}
+	case c == '\'':
+		end := strings.IndexByte(p.src[p.pos+1:], '\'')
+		if end < 0 {
+			return p.errorf(start, "unterminated string")
+		}
+		p.tok = token{kind: tokString, text: p.src[p.pos+1 : p.pos+1+end], pos: start}
+		p.pos += end + 2
+	case c == '&' || c == '|' || c == '=':
+		return p.errorf(start, "unexpected %q, did you mean %q", c, strings.Repeat(string(c), 2))
+	default:
+		for p.pos < len(p.src) {
+			if isWordChar(p.src[p.pos]) {
+				p.pos++
+				continue
+			}
+			//key中的下标，如 user.tags[0]
+			if p.src[p.pos] == '[' && p.pos > start {
+				end := strings.IndexByte(p.src[p.pos:], ']')
+				if end > 1 && !strings.ContainsAny(p.src[p.pos+1:p.pos+end], " \t\r\n,[") {
+					p.pos += end + 1
+					continue
+				}
+			}
+			break
+		}
+		p.tok = token{kind: tokWord, text: p.src[start:p.pos], pos: start}
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (*Filter, error) {
+	f, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokOr {
+		return f, nil
+	}
+	any := []*Filter{f}
+	for p.tok.kind == tokOr {
+		if err = p.next(); err != nil {
+			return nil, err
+		}
+		f, err = p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		any = append(any, f)
+	}
+	return &Filter{MatchAny: any}, nil
+}
+
+func (p *parser) parseAnd() (*Filter, error) {
+	f, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokAnd {
+		return f, nil
+	}
+	all := []*Filter{f}
+	for p.tok.kind == tokAnd {
+		if err = p.next(); err != nil {
+			return nil, err
+		}
+		f, err = p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, f)
+	}
+	return &Filter{MatchAll: all}, nil
+}
+
+func (p *parser) parseUnary() (*Filter, error) {
+	switch p.tok.kind {
+	case tokNot:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		f, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Filter{NotMatch: f}, nil
+	case tokLParen:
+		pos := p.tok.pos
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			open := p.errorf(pos, "")
+			return nil, p.errorf(p.tok.pos, "expect \")\" to close \"(\" at line %d column %d, got %v", open.Line, open.Column, p.tok)
+		}
+		return f, p.next()
+	case tokWord:
+		//true、false后面跟着运算符时视为key
+		if p.tok.text == "true" || p.tok.text == "false" {
+			text := p.tok.text
+			save := *p
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if p.tok.kind == tokEOF || p.tok.kind == tokAnd || p.tok.kind == tokOr || p.tok.kind == tokRParen {
+				if text == "true" {
+					return &Filter{}, nil
+				}
+				return &Filter{NotMatch: &Filter{}}, nil
+			}
+			*p = save
+		}
+		return p.parseComparison()
+	case tokString:
+		return p.parseComparison()
+	}
+	return nil, p.errorf(p.tok.pos, "expect condition, got %v", p.tok)
+}
+
+var bytesOperators = map[string]string{
+	">":  "bytesGreaterThan",
+	">=": "bytesNotLessThan",
+	"<":  "bytesLessThan",
+	"<=": "bytesNotGreaterThan",
+}
+
+func (p *parser) parseComparison() (*Filter, error) {
+	key := p.tok.text
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	opTok := p.tok
+	switch opTok.kind {
+	case tokOp:
+	case tokWord:
+		if f, _ := registeredMatchers.Load(strings.ToLower(opTok.text)); f == nil {
+			e := p.errorf(opTok.pos, "unknown operator %q", opTok.text)
+			e.Err = ErrUnknownOperator
+			return nil, e
+		}
+	default:
+		return nil, p.errorf(opTok.pos, "expect operator after key %q, got %v", key, opTok)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	values, err := p.parseValues()
+	if err != nil {
+		return nil, err
+	}
+
+	//10MB这样带单位的大小按字节数比较，不按字符串比较
+	op := opTok.text
+	if bytesOp, ok := bytesOperators[op]; ok && len(values) == 1 && isBytesLiteral(values[0]) {
+		op = bytesOp
+	}
+
+	exp, err := NewExpression(key, op, values)
+	if err != nil {
+		e := p.errorf(opTok.pos, "invalid expression %v %v %v: %v", key, opTok.text, values, err)
+		e.Err = err
+		return nil, e
+	}
+	return &Filter{Match: exp}, nil
+}
+
+func (p *parser) parseValues() ([]string, error) {
+	switch p.tok.kind {
+	case tokWord, tokString:
+		v := p.tok.text
+		return []string{v}, p.next()
+	case tokLBrack:
+		values := make([]string, 0)
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for p.tok.kind != tokRBrack {
+			if p.tok.kind != tokWord && p.tok.kind != tokString {
+				return nil, p.errorf(p.tok.pos, "expect value in list, got %v", p.tok)
+			}
+			values = append(values, p.tok.text)
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if p.tok.kind == tokComma {
+				if err := p.next(); err != nil {
+					return nil, err
+				}
+			} else if p.tok.kind != tokRBrack {
+				return nil, p.errorf(p.tok.pos, "expect \",\" or \"]\" in list, got %v", p.tok)
+			}
+		}
+		return values, p.next()
+	}
+	return nil, p.errorf(p.tok.pos, "expect value, got %v", p.tok)
+}
+
+// ------text------
+
+const (
+	precOr = iota + 1
+	precAnd
+	precUnary
+)
+
+var plainWord = regexp.MustCompile(`^[A-Za-z0-9_.$\-]+(\[[^\s,\[\]]+\])*[A-Za-z0-9_.$\-]*$`)
+
+func quoteWord(s string) string {
+	if plainWord.MatchString(s) && s != "true" && s != "false" {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// text 转换为ParseFilter能解析的表达式，返回表达式和其最外层运算的优先级
+func (f *Filter) text() (string, int) {
+	if f == nil {
+		return "false", precUnary
+	}
+
+	type part struct {
+		s    string
+		prec int
+	}
+	parts := make([]part, 0)
+
+	if f.Match != nil {
+		parts = append(parts, part{f.Match.text(), precUnary})
+	}
+	if f.NotMatch != nil {
+		if f.NotMatch.isEmpty() {
+			parts = append(parts, part{"false", precUnary})
+		} else {
+			s, prec := f.NotMatch.text()
+			if prec < precUnary {
+				s = "(" + s + ")"
+			}
+			parts = append(parts, part{"!" + s, precUnary})
+		}
+	}
+	for _, sub := range f.MatchAll {
+		if sub == nil {
+			continue
+		}
+		s, prec := sub.text()
+		parts = append(parts, part{s, prec})
+	}
+	any := make([]string, 0, len(f.MatchAny))
+	for _, sub := range f.MatchAny {
+		if sub == nil {
+			continue
+		}
+		s, _ := sub.text()
+		any = append(any, s)
+	}
+	if len(any) == 1 {
+		parts = append(parts, part{any[0], precOr})
+	} else if len(any) > 1 {
+		parts = append(parts, part{strings.Join(any, " || "), precOr})
+	} else if len(f.MatchAny) > 0 {
+		//matchAny中全是nil时不会通过
+		parts = append(parts, part{"false", precUnary})
+	}
+
+	if len(parts) == 0 {
+		return "true", precUnary
+	}
+	if len(parts) == 1 {
+		return parts[0].s, parts[0].prec
+	}
+	ss := make([]string, 0, len(parts))
+	for _, pt := range parts {
+		if pt.prec < precAnd {
+			pt.s = "(" + pt.s + ")"
+		}
+		ss = append(ss, pt.s)
+	}
+	return strings.Join(ss, " && "), precAnd
+}
+
+func (f *Filter) isEmpty() bool {
+	return f.Match == nil && f.NotMatch == nil && len(f.MatchAll) == 0 && len(f.MatchAny) == 0
+}
+
+func (exp *Expression) text() string {
+	values := ""
+	if len(exp.values) == 1 {
+		values = quoteWord(exp.values[0])
+	} else {
+		vs := make([]string, 0, len(exp.values))
+		for _, v := range exp.values {
+			vs = append(vs, quoteWord(v))
+		}
+		values = "[" + strings.Join(vs, ", ") + "]"
+	}
+	return quoteWord(exp.key) + " " + exp.operator + " " + values
+}
@@ -0,0 +1,155 @@
+package matcher
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseFilter(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		data   map[string]string
+		expect bool
+	}{
+		{`version >= "1.2.0" && (channel in ["a","b"] || !(size > 10MB))`, map[string]string{"version": "1.3.0", "channel": "c", "size": "5"}, true},
+		{`version >= "1.2.0" && (channel in ["a","b"] || !(size > 10MB))`, map[string]string{"version": "1.3.0", "channel": "c", "size": "9MB"}, true},
+		{`version >= "1.2.0" && (channel in ["a","b"] || !(size > 10MB))`, map[string]string{"version": "1.3.0", "channel": "c", "size": "11000000"}, false},
+		{`version >= "1.2.0" && (channel in ["a","b"] || !(size > 10MB))`, map[string]string{"version": "1.1.9", "channel": "a"}, false},
+		{`!(size > 10MB)`, map[string]string{"size": "5"}, true},
+		{`!(size > 10MB)`, map[string]string{"size": "9MB"}, true},
+		{`!(size > 10MB)`, map[string]string{"size": "11000000"}, false},
+		{`size <= 1.5gb`, map[string]string{"size": "1536MB"}, true},
+		{`size < 1KB`, map[string]string{"size": "abc"}, false},
+		{`a == 1 || b == 2 && c == 3`, map[string]string{"a": "1"}, true},
+		{`a == 1 || b == 2 && c == 3`, map[string]string{"b": "2"}, false},
+		{`(a == 1 || b == 2) && c == 3`, map[string]string{"a": "1"}, false},
+		{`!a == 1`, map[string]string{"a": "2"}, true},
+		{`!!a == 1`, map[string]string{"a": "1"}, true},
+		{`name hasPrefix 'ab' && name NotIn [abc, "ab d"]`, map[string]string{"name": "abd"}, true},
+		{`name hasPrefix 'ab' && name NotIn [abc, "ab d"]`, map[string]string{"name": "ab d"}, false},
+		{`user.tags[0] == vip`, map[string]string{"user.tags[0]": "vip"}, true},
+		{`"key with space" != ""`, map[string]string{"key with space": "x"}, true},
+		{`n < -5`, map[string]string{"n": "-6"}, true},
+		{`channel in []`, map[string]string{"channel": ""}, false},
+		{`true`, nil, true},
+		{`false`, nil, false},
+		{`false || true`, nil, true},
+		{`true == true`, map[string]string{"true": "true"}, true},
+		{"a == 1 &&\n\tb == 2", map[string]string{"a": "1", "b": "2"}, true},
+	}
+
+	for _, tc := range testCases {
+		f, err := ParseFilter(tc.expr)
+		if !assert.Nil(t, err, tc.expr) {
+			continue
+		}
+		assert.Equal(t, tc.expect, f.Filter(tc.data), tc.expr)
+
+		//String能解析回等价的Filter
+		text := f.String()
+		f2, err := ParseFilter(text)
+		if assert.Nil(t, err, text) {
+			assert.Equal(t, text, f2.String(), tc.expr)
+			assert.Equal(t, tc.expect, f2.Filter(tc.data), text)
+		}
+	}
+}
+
+func TestParseFilter_Structure(t *testing.T) {
+	f := MustParseFilter(`a == 1 && b in [x, y] && !(c > 2 || d < 1)`)
+	assert.Nil(t, f.Match)
+	if assert.Equal(t, 3, len(f.MatchAll)) {
+		assert.Equal(t, "==", f.MatchAll[0].Match.operator)
+		assert.Equal(t, []string{"x", "y"}, f.MatchAll[1].Match.values)
+		assert.Equal(t, 2, len(f.MatchAll[2].NotMatch.MatchAny))
+	}
+	assert.Equal(t, `a == 1 && b in [x, y] && !(c > 2 || d < 1)`, f.String())
+}
+
+func TestParseFilter_Error(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		line   int
+		column int
+		err    error
+	}{
+		{`a == 1 &&`, 1, 10, nil},
+		{`a == 1 & b == 2`, 1, 8, nil},
+		{`a = 1`, 1, 3, nil},
+		{`(a == 1 || b == 2`, 1, 18, nil},
+		{`a == 1)`, 1, 7, nil},
+		{`a == "1`, 1, 6, nil},
+		{`a in [1, 2`, 1, 11, nil},
+		{`a == `, 1, 6, nil},
+		{`a`, 1, 2, nil},
+		{"a == 1 &&\n  b like 2", 2, 5, ErrUnknownOperator},
+		{`a > [1, 2]`, 1, 3, ErrArgsSize},
+		{`a regexMatch "("`, 1, 3, nil},
+	}
+
+	for _, tc := range testCases {
+		_, err := ParseFilter(tc.expr)
+		syntaxErr := &SyntaxError{}
+		if !assert.True(t, errors.As(err, &syntaxErr), "%v: %v", tc.expr, err) {
+			continue
+		}
+		t.Logf("%v => %v", tc.expr, err)
+		assert.Equal(t, tc.line, syntaxErr.Line, tc.expr)
+		assert.Equal(t, tc.column, syntaxErr.Column, tc.expr)
+		if tc.err != nil {
+			assert.True(t, errors.Is(err, tc.err), tc.expr)
+		}
+	}
+}
+
+func TestFilter_String(t *testing.T) {
+	f := new(Filter)
+	err := yaml.Unmarshal([]byte(`
+match: [key1, in, 1, "a b"]
+notMatch:
+  matchAny:
+  - match: [key2, ">", 5]
+  - match: [key3, "!=", x]
+matchAll:
+- match: [key4, hasSuffix, z]
+- matchAny:
+  - match: [key5, "==", 1]
+  - match: [key6, "==", 2]
+matchAny:
+- match: [key7, "==", 1]
+- notMatch:
+    match: [key8, "==", 1]
+`), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := f.String()
+	assert.Equal(t, `key1 in [1, "a b"] && !(key2 > 5 || key3 != x) && key4 hasSuffix z && (key5 == 1 || key6 == 2) && (key7 == 1 || !key8 == 1)`, text)
+
+	f2 := MustParseFilter(text)
+	for _, data := range []map[string]string{
+		{"key1": "1", "key4": "xz", "key5": "1", "key7": "1"},
+		{"key1": "a b", "key3": "x", "key4": "z", "key6": "2"},
+		{"key1": "1", "key2": "6", "key4": "z", "key6": "2", "key7": "1"},
+		{"key1": "2"},
+	} {
+		assert.Equal(t, f.Filter(data), f2.Filter(data), data)
+	}
+
+	assert.Equal(t, "true", new(Filter).String())
+}
+
+func TestParseFilter_Bytes(t *testing.T) {
+	f, err := ParseFilter(`!(size > 10MB)`)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "bytesGreaterThan", f.NotMatch.Match.operator)
+	assert.Empty(t, Validate(f))
+	assert.True(t, f.Filter(map[string]string{"size": "10MB"}))
+	assert.False(t, f.Filter(map[string]string{"size": "10.5MB"}))
+}
@@ -0,0 +1,177 @@
+package matcher
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+)
+
+// RuleSet 一组编译好的Filter，Match返回所有通过的Filter及其Response，结果与逐个执行FilterWithResponse一致。
+//
+// 每个Filter通过时必须满足的 ==、in 条件会按key建立索引(如 channel == a && ...、channel in [a, b] || ...)，
+// 执行时先用data中对应key的值找出候选的Filter，只对候选执行完整的判断，
+// 没有这类条件的Filter每次都会执行。
+//
+// RuleSet创建后只读，可以并发使用；修改了Filter(如ModifyValues)后需要重新创建
+type RuleSet struct {
+	filters []*Filter
+	keys    []string                    // 建立了索引的key
+	index   map[string]map[string][]int // key -> 值 -> Filter下标(升序)
+	others  []int                       // 无法建立索引的Filter
+}
+
+// RuleMatch 通过的Filter
+type RuleMatch struct {
+	Index    int // 在NewRuleSet的filters中的下标
+	Filter   *Filter
+	Response map[string]interface{}
+}
+
+// NewRuleSet filters中的nil永远不会通过
+func NewRuleSet(filters []*Filter) *RuleSet {
+	rs := &RuleSet{
+		filters: filters,
+		index:   make(map[string]map[string][]int),
+		others:  make([]int, 0),
+	}
+	for i, f := range filters {
+		if f == nil {
+			continue
+		}
+		r := requirementOf(f)
+		if r == nil {
+			rs.others = append(rs.others, i)
+			continue
+		}
+		bucket, ok := rs.index[r.key]
+		if !ok {
+			bucket = make(map[string][]int)
+			rs.index[r.key] = bucket
+			rs.keys = append(rs.keys, r.key)
+		}
+		for value := range r.values {
+			bucket[value] = append(bucket[value], i)
+		}
+	}
+	return rs
+}
+
+// Len Filter的个数
+func (rs *RuleSet) Len() int {
+	return len(rs.filters)
+}
+
+// Match 返回所有通过的Filter，按在filters中的顺序排列
+func (rs *RuleSet) Match(data map[string]string) []*RuleMatch {
+	if data == nil {
+		data = map[string]string{}
+	}
+	return rs.match(stringMap(data))
+}
+
+// MatchValue 同Match，data可以是任意类型，见Filter.FilterValue。json格式错误时没有通过的Filter
+func (rs *RuleSet) MatchValue(data interface{}) []*RuleMatch {
+	ds, err := newTypedData(data)
+	if err != nil {
+		return make([]*RuleMatch, 0)
+	}
+	return rs.match(ds)
+}
+
+func (rs *RuleSet) match(data dataSource) []*RuleMatch {
+	matches := make([]*RuleMatch, 0)
+	for _, i := range rs.candidates(data) {
+		f := rs.filters[i]
+		resp := make(map[string]interface{})
+		if f.doFilter(data, resp, f.MergeResponseRecursively) {
+			matches = append(matches, &RuleMatch{Index: i, Filter: f, Response: resp})
+		}
+	}
+	return matches
+}
+
+// candidates 可能通过的Filter下标，升序
+func (rs *RuleSet) candidates(data dataSource) []int {
+	ids := make([]int, 0, len(rs.others)+8)
+	ids = append(ids, rs.others...)
+	for _, key := range rs.keys {
+		bucket := rs.index[key]
+		if m, ok := data.(stringMap); ok {
+			ids = append(ids, bucket[m[key]]...)
+			continue
+		}
+
+		//与in.MatchValue一致：按字符串取，数字再按数值取
+		v, _ := data.lookup(key)
+		s := toString(v)
+		ids = append(ids, bucket[s]...)
+		switch v.(type) {
+		case json.Number, float64, float32, int, int64, int32, uint, uint64, uint32:
+			if n := strconv.FormatFloat(toFloat(v), 'f', -1, 64); n != s {
+				ids = append(ids, bucket[n]...)
+			}
+		}
+	}
+
+	sort.Ints(ids)
+	n := 0
+	for i, id := range ids {
+		if i == 0 || id != ids[n-1] {
+			ids[n] = id
+			n++
+		}
+	}
+	return ids[:n]
+}
+
+// requirement Filter通过时key的值必须是values中的一个
+type requirement struct {
+	key    string
+	values map[string]struct{}
+}
+
+// requirementOf 从Filter必须满足的条件中选出值最少的一个，没有时返回nil：
+// match、matchAll中每个Filter的条件都必须满足；matchAny中每个Filter都限制了同一个key时，取并集
+func requirementOf(f *Filter) *requirement {
+	var best *requirement
+	consider := func(r *requirement) {
+		if r != nil && (best == nil || len(r.values) < len(best.values)) {
+			best = r
+		}
+	}
+
+	if f.Match != nil {
+		if p, ok := classify(f.Match); ok && p.kind == predIn {
+			consider(&requirement{key: f.Match.key, values: p.set})
+		}
+	}
+	for _, sub := range f.MatchAll {
+		if sub != nil {
+			consider(requirementOf(sub))
+		}
+	}
+	if len(f.MatchAny) > 0 {
+		consider(anyRequirement(f.MatchAny))
+	}
+	return best
+}
+
+func anyRequirement(filters []*Filter) *requirement {
+	var union *requirement
+	for _, sub := range filters {
+		if sub == nil {
+			continue
+		}
+		r := requirementOf(sub)
+		if r == nil || (union != nil && r.key != union.key) {
+			return nil
+		}
+		if union == nil {
+			union = &requirement{key: r.key, values: make(map[string]struct{}, len(r.values))}
+		}
+		for value := range r.values {
+			union.values[value] = struct{}{}
+		}
+	}
+	return union
+}
@@ -0,0 +1,173 @@
+package matcher
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleSet_Match(t *testing.T) {
+	filters := []*Filter{
+		MustParseFilter(`channel == a && version >= 1.2.0`),
+		MustParseFilter(`channel in [a, b, c] && (city == bj || city == sh)`),
+		MustParseFilter(`size > 10`),
+		nil,
+		MustParseFilter(`channel == b || channel == c`),
+		MustParseFilter(`!channel == a`),
+		MustParseFilter(`channel in []`),
+	}
+	filters[0].ResponseOnMatch = map[string]interface{}{"rule": "a", "city": "{{city}}"}
+
+	rs := NewRuleSet(filters)
+	assert.Equal(t, 7, rs.Len())
+	//city的条件更少
+	assert.Equal(t, []string{"channel", "city"}, rs.keys)
+	assert.Equal(t, []int{2, 5}, rs.others)
+
+	matches := rs.Match(map[string]string{"channel": "a", "version": "1.3.0", "city": "bj"})
+	assert.Len(t, matches, 2)
+	assert.Equal(t, 0, matches[0].Index)
+	assert.Equal(t, filters[0], matches[0].Filter)
+	assert.Equal(t, map[string]interface{}{"rule": "a", "city": "bj"}, matches[0].Response)
+	assert.Equal(t, 1, matches[1].Index)
+
+	indexes := func(matches []*RuleMatch) []int {
+		ids := make([]int, 0, len(matches))
+		for _, m := range matches {
+			ids = append(ids, m.Index)
+		}
+		return ids
+	}
+	assert.Equal(t, []int{2, 4, 5}, indexes(rs.Match(map[string]string{"channel": "c", "size": "11"})))
+	assert.Equal(t, []int{5}, indexes(rs.Match(nil)))
+
+	//数字按数值比较
+	rs = NewRuleSet([]*Filter{MustParseFilter(`id in [1, 2.5]`), MustParseFilter(`id == 1.0`)})
+	assert.Equal(t, []int{0}, indexes(rs.MatchValue(map[string]interface{}{"id": 1})))
+	assert.Equal(t, []int{0, 1}, indexes(rs.MatchValue([]byte(`{"id": 1.0}`))))
+	assert.Equal(t, []int{0}, indexes(rs.MatchValue(map[string]interface{}{"id": 2.5})))
+	assert.Equal(t, []int{}, indexes(rs.MatchValue([]byte(`{`))))
+	rs = NewRuleSet([]*Filter{MustParseFilter(`!channel == a`)})
+	assert.Equal(t, []int{}, indexes(rs.MatchValue([]byte(`{`))))
+}
+
+// 与逐个执行FilterWithResponse的结果一致
+func TestRuleSet_Consistent(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	values := []string{"", "1", "2", "1.0", "a", "b"}
+	keys := []string{"k1", "k2", "k3"}
+	randExpr := func() string {
+		key := keys[r.Intn(len(keys))]
+		switch r.Intn(5) {
+		case 0:
+			return fmt.Sprintf("%s in [%q, %q]", key, values[r.Intn(len(values))], values[r.Intn(len(values))])
+		case 1:
+			return fmt.Sprintf("%s != %q", key, values[r.Intn(len(values))])
+		case 2:
+			return fmt.Sprintf("%s > 1", key)
+		}
+		return fmt.Sprintf("%s == %q", key, values[r.Intn(len(values))])
+	}
+	var randRule func(depth int) string
+	randRule = func(depth int) string {
+		if depth > 2 {
+			return randExpr()
+		}
+		switch r.Intn(4) {
+		case 0:
+			return "(" + randRule(depth+1) + " && " + randRule(depth+1) + ")"
+		case 1:
+			return "(" + randRule(depth+1) + " || " + randRule(depth+1) + ")"
+		case 2:
+			return "!" + randRule(depth+1)
+		}
+		return randExpr()
+	}
+
+	filters := make([]*Filter, 0)
+	for i := 0; i < 300; i++ {
+		f := MustParseFilter(randRule(0))
+		f.ResponseOnMatch = map[string]interface{}{"k1": "{{k1}}", "i": i}
+		filters = append(filters, f)
+	}
+	rs := NewRuleSet(filters)
+	assert.NotEmpty(t, rs.keys)
+
+	for i := 0; i < 300; i++ {
+		data := map[string]string{}
+		typed := map[string]interface{}{}
+		for _, key := range keys {
+			if r.Intn(4) == 0 {
+				continue
+			}
+			v := values[r.Intn(len(values))]
+			data[key] = v
+			typed[key] = v
+			if n, ok := map[string]int{"1": 1, "2": 2}[v]; ok && r.Intn(2) == 0 {
+				typed[key] = n
+			}
+		}
+
+		expect := make([]*RuleMatch, 0)
+		expectValue := make([]*RuleMatch, 0)
+		for j, f := range filters {
+			if ok, resp := f.FilterWithResponse(data); ok {
+				expect = append(expect, &RuleMatch{Index: j, Filter: f, Response: resp})
+			}
+			if ok, resp := f.FilterValueWithResponse(typed); ok {
+				expectValue = append(expectValue, &RuleMatch{Index: j, Filter: f, Response: resp})
+			}
+		}
+		assert.Equal(t, expect, rs.Match(data), "%v", data)
+		assert.Equal(t, expectValue, rs.MatchValue(typed), "%v", typed)
+	}
+}
+
+func benchmarkRules(n int) ([]*Filter, map[string]string) {
+	filters := make([]*Filter, 0, n)
+	for i := 0; i < n; i++ {
+		var rule string
+		switch i % 3 {
+		case 0:
+			rule = fmt.Sprintf(`channel == c%d && version >= 1.2.0`, i)
+		case 1:
+			rule = fmt.Sprintf(`city in [x%d, y%d] && (uid hasSuffix 7 || vip == true)`, i, i)
+		default:
+			rule = fmt.Sprintf(`app == a%d || app == b%d`, i%50, i%50)
+		}
+		f := MustParseFilter(rule)
+		f.ResponseOnMatch = map[string]interface{}{"rule": i}
+		filters = append(filters, f)
+	}
+	data := map[string]string{"channel": "c30", "version": "1.3.0", "city": "y31", "uid": "1007", "app": "b2"}
+	return filters, data
+}
+
+func Benchmark_RuleSet(b *testing.B) {
+	filters, data := benchmarkRules(1000)
+	rs := NewRuleSet(filters)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(rs.Match(data)) == 0 {
+			b.Fatal("not match")
+		}
+	}
+}
+
+func Benchmark_RuleSetLoop(b *testing.B) {
+	filters, data := benchmarkRules(1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matches := make([]*RuleMatch, 0)
+		for j, f := range filters {
+			if ok, resp := f.FilterWithResponse(data); ok {
+				matches = append(matches, &RuleMatch{Index: j, Filter: f, Response: resp})
+			}
+		}
+		if len(matches) == 0 {
+			b.Fatal("not match")
+		}
+	}
+}
@@ -0,0 +1,563 @@
+package matcher
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Severity Issue的级别
+type Severity int
+
+const (
+	SeverityError   Severity = iota // 规则无法加载
+	SeverityWarning                 // 规则可以加载，但结果可能不符合预期
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Issue 规则检查发现的问题
+type Issue struct {
+	Severity Severity
+	Path     string // 出问题的节点，如 matchAll[1].match、responseOnMatch.vip，为空表示根节点
+	Line     int    // 从1开始，0表示没有位置信息(Validate检查的是已经编译的Filter)
+	Column   int
+	Msg      string
+	Err      error // 编译matcher时的错误，如ErrUnknownOperator、ErrArgsSize
+}
+
+func (i *Issue) Error() string {
+	s := ""
+	if i.Line > 0 {
+		s = fmt.Sprintf("line %d column %d: ", i.Line, i.Column)
+	}
+	if i.Path != "" {
+		s += i.Path + ": "
+	}
+	return s + i.Msg
+}
+
+func (i *Issue) Unwrap() error {
+	return i.Err
+}
+
+// Validate 检查已经编译的Filter，返回的都是不影响执行的问题：
+//
+//	恒为true/false的子树，以及因此永远不会执行的分支和永远不会返回的response
+//	同一个key上互相矛盾的条件，如 a == 1 && a == 2、a > 5 && a < 3
+//	response中未注册的函数，如 apend({{key}})，会被当做普通字符串返回
+//	response中转换为字符串后重复的key，如yaml中的 1 和 "1"
+//
+// 未知的操作符、参数个数错误等在加载时就会失败，检查规则文件请使用ValidateYAML
+func Validate(f *Filter) []*Issue {
+	if f == nil {
+		return nil
+	}
+	v := &validator{consts: make(map[*Filter]*constant)}
+	v.checkFilter(f, "", false)
+	return v.issues
+}
+
+// constant 恒定的结果，reason为原因，path为原因所在的节点(相对路径)
+type constant struct {
+	result bool
+	reason string
+	path   string
+}
+
+func (c *constant) at(path string) *constant {
+	return &constant{result: c.result, reason: c.reason, path: joinPath(path, c.path)}
+}
+
+// message base为c.path的起点，原因就在issuePath上时不再重复
+func (c *constant) message(base string, issuePath string) string {
+	s := fmt.Sprintf("always %v: %s", c.result, c.reason)
+	if path := joinPath(base, c.path); path != issuePath {
+		s += " (at " + path + ")"
+	}
+	return s
+}
+
+type validator struct {
+	issues []*Issue
+	consts map[*Filter]*constant
+}
+
+func (v *validator) add(severity Severity, path string, format string, args ...interface{}) {
+	v.issues = append(v.issues, &Issue{Severity: severity, Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+// checkFilter covered为true时上层已经报告过恒定的结果，不再重复报告
+func (v *validator) checkFilter(f *Filter, path string, covered bool) {
+	c := v.filterConst(f)
+	if c != nil && !covered && (path != "" || !f.isEmpty()) {
+		v.add(SeverityWarning, path, "%s", c.message(path, path))
+	}
+	covered = covered || c != nil
+
+	if c != nil && !c.result && len(f.ResponseOnMatch) > 0 {
+		v.add(SeverityWarning, joinPath(path, "responseOnMatch"), "never returned, filter is always false")
+	}
+	if c != nil && c.result && len(f.ResponseOnNotMatch) > 0 {
+		v.add(SeverityWarning, joinPath(path, "responseOnNotMatch"), "never returned, filter is always true")
+	}
+	v.checkResponse(f.ResponseAlways, joinPath(path, "responseAlways"))
+	v.checkResponse(f.ResponseOnMatch, joinPath(path, "responseOnMatch"))
+	v.checkResponse(f.ResponseOnNotMatch, joinPath(path, "responseOnNotMatch"))
+
+	if f.Match != nil && f.Match.matcher == nil {
+		v.add(SeverityError, joinPath(path, "match"), "empty expression")
+	}
+	if f.NotMatch != nil {
+		v.checkFilter(f.NotMatch, joinPath(path, "notMatch"), covered)
+	}
+	v.checkGroup(f.MatchAll, path, "matchAll", covered)
+	v.checkGroup(f.MatchAny, path, "matchAny", covered)
+}
+
+func (v *validator) checkGroup(filters []*Filter, parent string, name string, covered bool) {
+	if len(filters) == 0 {
+		return
+	}
+	var c *constant
+	if name == "matchAll" {
+		c = v.allConst(filters)
+	} else {
+		c = v.anyConst(filters)
+	}
+	path := joinPath(parent, name)
+	if c != nil && !covered {
+		v.add(SeverityWarning, path, "%s", c.message(parent, path))
+	}
+	for i, sub := range filters {
+		if sub != nil {
+			v.checkFilter(sub, fmt.Sprintf("%s[%d]", path, i), covered || c != nil)
+		}
+	}
+}
+
+// ------constant------
+
+// filterConst 推断Filter的结果，与数据有关时返回nil
+func (v *validator) filterConst(f *Filter) *constant {
+	if c, ok := v.consts[f]; ok {
+		return c
+	}
+
+	parts := make([]*constant, 0, 4)
+	known := true
+	add := func(c *constant) {
+		if c == nil {
+			known = false
+			return
+		}
+		parts = append(parts, c)
+	}
+	if f.Match != nil {
+		add(exprConst(f.Match, "match"))
+	}
+	if f.NotMatch != nil {
+		if c := v.filterConst(f.NotMatch); c != nil {
+			add(&constant{result: !c.result, reason: c.reason, path: joinPath("notMatch", c.path)})
+		} else {
+			add(nil)
+		}
+	}
+	if len(f.MatchAll) > 0 {
+		add(v.allConst(f.MatchAll))
+	}
+	if len(f.MatchAny) > 0 {
+		add(v.anyConst(f.MatchAny))
+	}
+
+	var c *constant
+	for _, part := range parts {
+		if !part.result {
+			c = part
+			break
+		}
+	}
+	if c == nil && known {
+		if len(parts) > 0 {
+			c = parts[0]
+		} else {
+			c = &constant{result: true, reason: "no conditions"}
+		}
+	}
+	if c == nil {
+		c = contradiction(f.conjuncts())
+	}
+
+	v.consts[f] = c
+	return c
+}
+
+func (v *validator) allConst(filters []*Filter) *constant {
+	var first *constant
+	known := true
+	for i, sub := range filters {
+		if sub == nil {
+			continue
+		}
+		c := v.filterConst(sub)
+		if c == nil {
+			known = false
+		} else if !c.result {
+			return c.at(fmt.Sprintf("matchAll[%d]", i))
+		} else if first == nil {
+			first = c.at(fmt.Sprintf("matchAll[%d]", i))
+		}
+	}
+	if !known {
+		return nil
+	}
+	if first == nil {
+		return &constant{result: true, reason: "no conditions", path: "matchAll"}
+	}
+	return first
+}
+
+func (v *validator) anyConst(filters []*Filter) *constant {
+	var first *constant
+	known := true
+	for i, sub := range filters {
+		if sub == nil {
+			continue
+		}
+		c := v.filterConst(sub)
+		if c == nil {
+			known = false
+		} else if c.result {
+			return c.at(fmt.Sprintf("matchAny[%d]", i))
+		} else if first == nil {
+			first = c.at(fmt.Sprintf("matchAny[%d]", i))
+		}
+	}
+	if known {
+		if first == nil {
+			return &constant{result: false, reason: "no filters", path: "matchAny"}
+		}
+		return first
+	}
+
+	exps := make([]*Expression, 0, len(filters))
+	for _, sub := range filters {
+		if sub != nil && sub.isSimple() {
+			exps = append(exps, sub.Match)
+		}
+	}
+	c := tautology(exps)
+	if c != nil {
+		c.path = "matchAny"
+	}
+	return c
+}
+
+func exprConst(exp *Expression, path string) *constant {
+	p, ok := classify(exp)
+	if !ok || len(p.set) > 0 {
+		return nil
+	}
+	switch p.kind {
+	case predIn:
+		return &constant{result: false, reason: exp.text() + " matches nothing", path: path}
+	case predNotIn:
+		return &constant{result: true, reason: exp.text() + " matches everything", path: path}
+	}
+	return nil
+}
+
+// isSimple 只有match条件
+func (f *Filter) isSimple() bool {
+	return f.Match != nil && f.NotMatch == nil && len(f.MatchAll) == 0 && len(f.MatchAny) == 0
+}
+
+// conjuncts 必须同时满足的表达式：match以及matchAll中只有match的子Filter
+func (f *Filter) conjuncts() []*Expression {
+	exps := make([]*Expression, 0)
+	if f.Match != nil {
+		exps = append(exps, f.Match)
+	}
+	for _, sub := range f.MatchAll {
+		if sub != nil && sub.isSimple() {
+			exps = append(exps, sub.Match)
+		}
+	}
+	return exps
+}
+
+const (
+	predIn    = iota // 值在set中
+	predNotIn        // 值不在set中
+	predLower        // 值大于(等于)bound
+	predUpper        // 值小于(等于)bound
+)
+
+type predicate struct {
+	kind      int
+	set       map[string]struct{}
+	bound     float64
+	inclusive bool
+}
+
+// classify 按编译后的matcher分类，==、!=、>等智能操作符也会落到in、lessThan、greaterThan上。
+// 使用了ModifyDataSource的in无法静态判断
+func classify(exp *Expression) (predicate, bool) {
+	m := exp.matcher
+	negative := false
+	if n, ok := m.(notMatcher); ok {
+		m = n.Matcher
+		negative = true
+	}
+
+	switch m := m.(type) {
+	case *in:
+		if len(m.dataSource) > 0 {
+			return predicate{}, false
+		}
+		if negative {
+			return predicate{kind: predNotIn, set: m.data}, true
+		}
+		return predicate{kind: predIn, set: m.data}, true
+	case *greaterThan:
+		if negative {
+			return predicate{kind: predUpper, bound: m.data, inclusive: true}, true
+		}
+		return predicate{kind: predLower, bound: m.data}, true
+	case *lessThan:
+		if negative {
+			return predicate{kind: predLower, bound: m.data, inclusive: true}, true
+		}
+		return predicate{kind: predUpper, bound: m.data}, true
+	}
+	return predicate{}, false
+}
+
+type keyConditions struct {
+	exps  []*Expression
+	preds []predicate
+}
+
+func groupByKey(exps []*Expression) ([]string, map[string]*keyConditions) {
+	keys := make([]string, 0)
+	m := make(map[string]*keyConditions)
+	for _, exp := range exps {
+		p, ok := classify(exp)
+		if !ok {
+			continue
+		}
+		kc := m[exp.key]
+		if kc == nil {
+			kc = &keyConditions{}
+			m[exp.key] = kc
+			keys = append(keys, exp.key)
+		}
+		kc.exps = append(kc.exps, exp)
+		kc.preds = append(kc.preds, p)
+	}
+	return keys, m
+}
+
+// canonical 数字按数值比较，与in.MatchValue一致
+func canonical(s string) string {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return s
+}
+
+// contradiction 同一个key上不可能同时满足的条件
+func contradiction(exps []*Expression) *constant {
+	keys, m := groupByKey(exps)
+	for _, key := range keys {
+		kc := m[key]
+		if len(kc.exps) < 2 {
+			continue
+		}
+
+		lo, hi := -1, -1
+		var inSet map[string]struct{}
+		for i, p := range kc.preds {
+			switch p.kind {
+			case predLower:
+				if lo < 0 || p.bound > kc.preds[lo].bound || (p.bound == kc.preds[lo].bound && !p.inclusive) {
+					lo = i
+				}
+			case predUpper:
+				if hi < 0 || p.bound < kc.preds[hi].bound || (p.bound == kc.preds[hi].bound && !p.inclusive) {
+					hi = i
+				}
+			case predIn:
+				if inSet == nil {
+					inSet = p.set
+				}
+			}
+		}
+
+		if lo >= 0 && hi >= 0 && emptyRange(kc.preds[lo], kc.preds[hi]) {
+			return conflict(kc.exps[lo], kc.exps[hi])
+		}
+		if inSet == nil {
+			continue
+		}
+
+		//第一个in中的值必须满足其他所有条件
+		candidates := 0
+		for value := range inSet {
+			if satisfies(value, kc.preds) {
+				candidates++
+			}
+		}
+		if candidates == 0 {
+			return conflict(kc.exps...)
+		}
+	}
+	return nil
+}
+
+func satisfies(value string, preds []predicate) bool {
+	for _, p := range preds {
+		switch p.kind {
+		case predIn:
+			found := false
+			for s := range p.set {
+				if canonical(s) == canonical(value) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		case predNotIn:
+			if _, ok := p.set[value]; ok {
+				return false
+			}
+		case predLower, predUpper:
+			f, err := strconv.ParseFloat(value, 64)
+			if err == nil && !inRange(f, p) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// inRange f是否满足上界或下界p
+func inRange(f float64, p predicate) bool {
+	switch {
+	case p.kind == predLower && p.inclusive:
+		return f >= p.bound
+	case p.kind == predLower:
+		return f > p.bound
+	case p.kind == predUpper && p.inclusive:
+		return f <= p.bound
+	}
+	return f < p.bound
+}
+
+// emptyRange 没有数同时满足下界lo和上界hi
+func emptyRange(lo, hi predicate) bool {
+	return lo.bound > hi.bound || (lo.bound == hi.bound && !(lo.inclusive && hi.inclusive))
+}
+
+func conflict(exps ...*Expression) *constant {
+	texts := make([]string, 0, len(exps))
+	for _, exp := range exps {
+		texts = append(texts, exp.text())
+	}
+	return &constant{result: false, reason: strings.Join(texts, " && ") + " can never match"}
+}
+
+// tautology matchAny中同一个key上必然满足其中一个的条件，如 a in [1, 2] || a notIn [1]、a > 5 || a <= 5
+func tautology(exps []*Expression) *constant {
+	keys, m := groupByKey(exps)
+	for _, key := range keys {
+		kc := m[key]
+		for i, p := range kc.preds {
+			for j, q := range kc.preds {
+				if i == j {
+					continue
+				}
+				covered := false
+				switch {
+				case p.kind == predIn && q.kind == predNotIn:
+					covered = true
+					for s := range q.set {
+						if _, ok := p.set[s]; !ok {
+							covered = false
+							break
+						}
+					}
+				case p.kind == predLower && q.kind == predUpper:
+					covered = q.bound > p.bound || (q.bound == p.bound && (p.inclusive || q.inclusive))
+				}
+				if covered {
+					return &constant{result: true, reason: kc.exps[i].text() + " || " + kc.exps[j].text() + " always matches"}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ------response------
+
+var functionCall = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\(.*\)$`)
+
+func (v *validator) checkResponse(value interface{}, path string) {
+	switch value := value.(type) {
+	case string:
+		match := functionCall.FindStringSubmatch(value)
+		if match == nil {
+			return
+		}
+		if _, ok := registeredFunctions[strings.ToLower(match[1])]; !ok {
+			v.add(SeverityWarning, path, "unknown function %q, the value will be returned as a plain string", match[1])
+		}
+	case []interface{}:
+		for i, sub := range value {
+			v.checkResponse(sub, fmt.Sprintf("%s[%d]", path, i))
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v.checkResponse(value[k], joinPath(path, k))
+		}
+	case map[interface{}]interface{}:
+		//yaml.v2解析出的key转换为字符串后可能重复，合并时哪个生效是随机的
+		m := make(map[string]interface{}, len(value))
+		for k, sub := range value {
+			s := fmt.Sprint(k)
+			if _, ok := m[s]; ok {
+				v.add(SeverityWarning, path, "duplicate key %q", s)
+			}
+			m[s] = sub
+		}
+		v.checkResponse(m, path)
+	}
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	if name == "" {
+		return path
+	}
+	if strings.HasPrefix(name, "[") {
+		return path + name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,275 @@
+package matcher
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidateFile 检查规则文件，见ValidateYAML
+func ValidateFile(path string) ([]*Issue, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ValidateYAML(data), nil
+}
+
+// ValidateYAML 检查yaml或json(json也是合法的yaml)格式的规则，内容可以是一个Filter，也可以是Filter数组。
+// 除了Validate的检查外，还会带行号报告加载时才会出现的错误：
+//
+//	yaml、json语法错误
+//	未知的操作符、matcher参数个数或格式错误，如 [a, ">", 1, 2]
+//	重复的key，如responseOnMatch中写了两次同一个key
+//	未知的字段，如把matchAll写成了matchall，加载时会被忽略
+//
+// 有SeverityError时不再执行Validate的检查
+func ValidateYAML(data []byte) []*Issue {
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return []*Issue{syntaxIssue(err)}
+	}
+	if len(doc.Content) == 0 {
+		return []*Issue{{Severity: SeverityError, Msg: "empty rule file"}}
+	}
+
+	c := &fileChecker{nodes: make(map[string]*yaml.Node)}
+	root := resolve(doc.Content[0])
+	c.checkDuplicateKeys(root)
+
+	//[]Filter或者Filter
+	nodes := []*yaml.Node{root}
+	paths := []string{""}
+	if root.Kind == yaml.SequenceNode {
+		nodes = root.Content
+		paths = make([]string, len(nodes))
+		for i := range nodes {
+			paths[i] = fmt.Sprintf("[%d]", i)
+		}
+	}
+	for i, n := range nodes {
+		c.checkFilter(n, paths[i])
+	}
+
+	if !c.hasError() {
+		for i, n := range nodes {
+			path := paths[i]
+			f := new(Filter)
+			err = n.Decode(f)
+			if err != nil {
+				c.add(SeverityError, n, path, err.Error())
+				continue
+			}
+			for _, issue := range Validate(f) {
+				issue.Path = joinPath(path, issue.Path)
+				if n := c.lookup(issue.Path); n != nil {
+					issue.Line, issue.Column = n.Line, n.Column
+				}
+				c.issues = append(c.issues, issue)
+			}
+		}
+	}
+
+	sort.SliceStable(c.issues, func(i, j int) bool {
+		if c.issues[i].Line != c.issues[j].Line {
+			return c.issues[i].Line < c.issues[j].Line
+		}
+		return c.issues[i].Column < c.issues[j].Column
+	})
+	return c.issues
+}
+
+var errorLine = regexp.MustCompile(`line (\d+)`)
+
+func syntaxIssue(err error) *Issue {
+	issue := &Issue{Severity: SeverityError, Msg: err.Error(), Err: err}
+	if match := errorLine.FindStringSubmatch(err.Error()); match != nil {
+		issue.Line, _ = strconv.Atoi(match[1])
+	}
+	return issue
+}
+
+// resolve 展开yaml的锚点引用
+func resolve(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+func isNull(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.Tag == "!!null"
+}
+
+type fileChecker struct {
+	issues []*Issue
+	nodes  map[string]*yaml.Node // path -> 节点，用于给Validate的结果加上行号
+}
+
+func (c *fileChecker) add(severity Severity, n *yaml.Node, path string, msg string) *Issue {
+	issue := &Issue{Severity: severity, Path: path, Line: n.Line, Column: n.Column, Msg: msg}
+	c.issues = append(c.issues, issue)
+	return issue
+}
+
+func (c *fileChecker) hasError() bool {
+	for _, issue := range c.issues {
+		if issue.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup 没有记录path时使用最近的上层节点
+func (c *fileChecker) lookup(path string) *yaml.Node {
+	for {
+		if n, ok := c.nodes[path]; ok {
+			return n
+		}
+		if path == "" {
+			return nil
+		}
+		path = parentPath(path)
+	}
+}
+
+func parentPath(path string) string {
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i] == '.' || path[i] == '[' {
+			return path[:i]
+		}
+	}
+	return ""
+}
+
+func (c *fileChecker) checkDuplicateKeys(n *yaml.Node) {
+	n = resolve(n)
+	if n.Kind == yaml.MappingNode {
+		lines := make(map[string]int, len(n.Content)/2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := n.Content[i]
+			if line, ok := lines[k.Value]; ok {
+				c.add(SeverityError, k, "", fmt.Sprintf("duplicate key %q, first defined at line %d", k.Value, line))
+				continue
+			}
+			lines[k.Value] = k.Line
+		}
+	}
+	for _, sub := range n.Content {
+		c.checkDuplicateKeys(sub)
+	}
+}
+
+func (c *fileChecker) checkFilter(n *yaml.Node, path string) {
+	n = resolve(n)
+	c.nodes[path] = n
+	if isNull(n) {
+		return
+	}
+	if n.Kind != yaml.MappingNode {
+		c.add(SeverityError, n, path, "filter must be a mapping")
+		return
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], resolve(n.Content[i+1])
+		p := joinPath(path, k.Value)
+		c.nodes[p] = k
+
+		switch k.Value {
+		case "desc":
+			if v.Kind != yaml.ScalarNode {
+				c.add(SeverityError, v, p, "desc must be a string")
+			}
+		case "mergeResponseRecursively":
+			b := false
+			if v.Decode(&b) != nil {
+				c.add(SeverityError, v, p, "mergeResponseRecursively must be true or false")
+			}
+		case "responseAlways", "responseOnMatch", "responseOnNotMatch":
+			if v.Kind != yaml.MappingNode && !isNull(v) {
+				c.add(SeverityError, v, p, k.Value+" must be a mapping")
+				continue
+			}
+			c.recordResponse(v, p)
+		case "match":
+			c.checkMatch(v, p)
+		case "notMatch":
+			c.checkFilter(v, p)
+		case "matchAll", "matchAny":
+			if isNull(v) {
+				continue
+			}
+			if v.Kind != yaml.SequenceNode {
+				c.add(SeverityError, v, p, k.Value+" must be an array of filters")
+				continue
+			}
+			for j, sub := range v.Content {
+				c.checkFilter(sub, fmt.Sprintf("%s[%d]", p, j))
+			}
+		default:
+			c.add(SeverityWarning, k, p, fmt.Sprintf("unknown field %q, it will be ignored", k.Value))
+		}
+	}
+}
+
+// checkMatch 与Expression.unmarshal一致，编译matcher
+func (c *fileChecker) checkMatch(n *yaml.Node, path string) {
+	if n.Kind != yaml.SequenceNode {
+		c.add(SeverityError, n, path, "match must be an array, format: [key, operator, values...]")
+		return
+	}
+	args := make([]string, 0, len(n.Content))
+	for _, sub := range n.Content {
+		sub = resolve(sub)
+		if sub.Kind != yaml.ScalarNode {
+			c.add(SeverityError, sub, path, "match values must be strings or numbers")
+			return
+		}
+		args = append(args, sub.Value)
+	}
+	if len(args) < 2 {
+		c.add(SeverityError, n, path, "array size must greater than 1, format: [key, operator, values...]")
+		return
+	}
+
+	_, err := NewExpression(args[0], args[1], args[2:])
+	if err == nil {
+		return
+	}
+	var issue *Issue
+	switch {
+	case errors.Is(err, ErrUnknownOperator):
+		issue = c.add(SeverityError, n.Content[1], path, fmt.Sprintf("unknown operator %q", args[1]))
+	case errors.Is(err, ErrArgsSize):
+		issue = c.add(SeverityError, n, path, fmt.Sprintf("wrong number of values for %q: %d", args[1], len(args)-2))
+	default:
+		issue = c.add(SeverityError, n, path, fmt.Sprintf("invalid match %v: %v", args, err))
+	}
+	issue.Err = err
+}
+
+// recordResponse 记录response中每个key的位置
+func (c *fileChecker) recordResponse(n *yaml.Node, path string) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			p := joinPath(path, n.Content[i].Value)
+			c.nodes[p] = n.Content[i]
+			c.recordResponse(resolve(n.Content[i+1]), p)
+		}
+	case yaml.SequenceNode:
+		for i, sub := range n.Content {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			c.nodes[p] = sub
+			c.recordResponse(resolve(sub), p)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package matcher
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func issueTexts(issues []*Issue) []string {
+	texts := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		texts = append(texts, issue.Severity.String()+": "+issue.Error())
+	}
+	return texts
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		rule   string
+		issues []string
+	}{
+		{`a == 1 && b > 2`, []string{}},
+		{`true`, []string{}},
+		{`a == 1 && a == 2`, []string{`warning: always false: a == 1 && a == 2 can never match`}},
+		{`a in [1, 2] && a != 1 && a != 2`, []string{`warning: always false: a in [1, 2] && a != 1 && a != 2 can never match`}},
+		{`a == 1.0 && a in [1, 3]`, []string{}},
+		{`a > 5 && a < 3`, []string{`warning: always false: a > 5 && a < 3 can never match`}},
+		{`a > 3 && a < 5`, []string{}},
+		{`a >= 3 && a <= 3`, []string{}},
+		{`a > 3 && a <= 3`, []string{`warning: always false: a > 3 && a <= 3 can never match`}},
+		{`a in [1, 7] && a > 5`, []string{}},
+		{`a in [1, 2] && a > 5`, []string{`warning: always false: a in [1, 2] && a > 5 can never match`}},
+		{`b == 1 && (a in [1, 2] || a != 1)`, []string{`warning: matchAll[1]: always true: a in [1, 2] || a != 1 always matches (at matchAll[1].matchAny)`}},
+		{`b == 1 && (a > 5 || a <= 5)`, []string{`warning: matchAll[1]: always true: a > 5 || a <= 5 always matches (at matchAll[1].matchAny)`}},
+		{`b == 1 || (c == 2 && false)`, []string{`warning: matchAny[1]: always false: no conditions (at matchAny[1].matchAll[1].notMatch)`}},
+		{`b == 1 && true`, []string{`warning: matchAll[1]: always true: no conditions`}},
+		{`false`, []string{`warning: always false: no conditions (at notMatch)`}},
+		//上层已经报告过的不再重复报告
+		{`a == 1 && (b == 2 || true) && false`, []string{`warning: always false: no conditions (at matchAll[2].notMatch)`}},
+	}
+	for _, tt := range tests {
+		f := MustParseFilter(tt.rule)
+		assert.Equal(t, tt.issues, issueTexts(Validate(f)), tt.rule)
+	}
+
+	assert.Nil(t, Validate(nil))
+}
+
+func TestValidate_Response(t *testing.T) {
+	f := new(Filter)
+	err := yaml.Unmarshal([]byte(`
+responseAlways:
+  a: append({{a}})
+  b: apend({{b}})
+  c: ["'x'", "tostring({{c}})", "ToNumbr({{c}})"]
+  d: "hello (world)"
+  e:
+    1: x
+    "1": y
+responseOnMatch:
+  vip: true
+responseOnNotMatch:
+  vip: false
+matchAll:
+- match: [a, ==, 1]
+- match: [a, ==, 2]
+`), f)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		`warning: always false: a == 1 && a == 2 can never match`,
+		`warning: responseOnMatch: never returned, filter is always false`,
+		`warning: responseAlways.b: unknown function "apend", the value will be returned as a plain string`,
+		`warning: responseAlways.c[2]: unknown function "ToNumbr", the value will be returned as a plain string`,
+		`warning: responseAlways.e: duplicate key "1"`,
+	}, issueTexts(Validate(f)))
+}
+
+func TestValidateYAML(t *testing.T) {
+	issues := ValidateYAML([]byte(`desc: test
+matchAll:
+- match: [a, ==, 1]
+- match: [b, "=~", 1]
+- match: [c, ">", 1, 2]
+- match: [d]
+- matchany:
+  - match: [e, lessThan, abc]
+responseOnMatch:
+  x: 1
+  x: 2
+`))
+	assert.Equal(t, []string{
+		`error: line 4 column 14: matchAll[1].match: unknown operator "=~"`,
+		`error: line 5 column 10: matchAll[2].match: wrong number of values for ">": 2`,
+		`error: line 6 column 10: matchAll[3].match: array size must greater than 1, format: [key, operator, values...]`,
+		`warning: line 7 column 3: matchAll[4].matchany: unknown field "matchany", it will be ignored`,
+		`error: line 11 column 3: duplicate key "x", first defined at line 10`,
+	}, issueTexts(issues))
+	assert.True(t, errors.Is(issues[0], ErrUnknownOperator))
+	assert.True(t, errors.Is(issues[1], ErrArgsSize))
+
+	//没有加载错误时执行Validate，并加上行号
+	issues = ValidateYAML([]byte(`
+- match: [a, ==, 1]
+- matchAny:
+  - match: [a, ==, 1]
+  - matchAll:
+    - match: [b, ">", 5]
+    - match: [b, "<", 3]
+    responseOnMatch:
+      y: apend(1)
+`))
+	assert.Equal(t, []string{
+		`warning: line 5 column 5: [1].matchAny[1]: always false: b > 5 && b < 3 can never match`,
+		`warning: line 8 column 5: [1].matchAny[1].responseOnMatch: never returned, filter is always false`,
+		`warning: line 9 column 7: [1].matchAny[1].responseOnMatch.y: unknown function "apend", the value will be returned as a plain string`,
+	}, issueTexts(issues))
+
+	//json
+	issues = ValidateYAML([]byte(`{
+	"matchAny": [
+		{"match": ["a", "in", "1", "2"]},
+		{"match": ["a", "notIn", "1"]}
+	],
+	"responseOnNotMatch": {"x": 1}
+}`))
+	assert.Equal(t, []string{
+		`warning: line 1 column 1: always true: a in [1, 2] || a notIn 1 always matches (at matchAny)`,
+		`warning: line 6 column 2: responseOnNotMatch: never returned, filter is always true`,
+	}, issueTexts(issues))
+
+	issues = ValidateYAML([]byte("match: [a, ==\nb: 1"))
+	assert.Len(t, issues, 1)
+	assert.Equal(t, SeverityError, issues[0].Severity)
+	assert.Equal(t, 1, issues[0].Line)
+
+	assert.Equal(t, []string{"error: empty rule file"}, issueTexts(ValidateYAML([]byte(""))))
+	assert.Equal(t, []string{"error: line 1 column 1: filter must be a mapping"}, issueTexts(ValidateYAML([]byte("abc"))))
+}
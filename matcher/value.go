@@ -0,0 +1,330 @@
+package matcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// dataSource Filter取值的数据来源
+type dataSource interface {
+	// lookup 按key取值，不存在时返回nil, false
+	lookup(key string) (interface{}, bool)
+}
+
+// stringMap 原有的map[string]string数据，key不做路径解析
+type stringMap map[string]string
+
+func (m stringMap) lookup(key string) (interface{}, bool) {
+	v, ok := m[key]
+	return v, ok
+}
+
+// typedData 任意类型的数据，key支持路径：user.name、user.tags[0]、$.user["first name"]
+type typedData struct {
+	root interface{}
+}
+
+// newTypedData []byte和json.RawMessage按json解析，数字保留为json.Number
+func newTypedData(data interface{}) (dataSource, error) {
+	switch v := data.(type) {
+	case map[string]string:
+		return stringMap(v), nil
+	case []byte:
+		return newJSONData(v)
+	case json.RawMessage:
+		return newJSONData(v)
+	}
+	return &typedData{root: data}, nil
+}
+
+func newJSONData(bs []byte) (dataSource, error) {
+	var root interface{}
+	d := json.NewDecoder(bytes.NewReader(bs))
+	d.UseNumber()
+	err := d.Decode(&root)
+	if err != nil {
+		return nil, err
+	}
+	return &typedData{root: root}, nil
+}
+
+func (d *typedData) lookup(key string) (interface{}, bool) {
+	//key本身是顶层map的一个key时直接返回，兼容带点号的扁平key
+	if v, ok := index(d.root, key); ok {
+		return v, true
+	}
+
+	path, err := parsePath(key)
+	if err != nil {
+		return nil, false
+	}
+	cur := d.root
+	for _, seg := range path {
+		var ok bool
+		if seg.isIndex {
+			cur, ok = elem(cur, seg.index)
+		} else {
+			cur, ok = index(cur, seg.name)
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+type pathSegment struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+// pathCache key -> []pathSegment，同一个规则的key会被反复解析
+var pathCache = new(sync.Map)
+
+// parsePath 解析 a.b[0]["c.d"]，可以以$或$.开头
+func parsePath(key string) ([]pathSegment, error) {
+	if v, ok := pathCache.Load(key); ok {
+		return v.([]pathSegment), nil
+	}
+
+	s := strings.TrimPrefix(key, "$")
+	s = strings.TrimPrefix(s, ".")
+	path := make([]pathSegment, 0)
+	for len(s) > 0 {
+		switch s[0] {
+		case '.':
+			s = s[1:]
+		case '[':
+			if len(s) > 1 && (s[1] == '"' || s[1] == '\'') {
+				//引号中可以有.和]
+				end := strings.IndexByte(s[2:], s[1]) + 2
+				if end < 2 || end+1 >= len(s) || s[end+1] != ']' {
+					return nil, fmt.Errorf("invalid path:%v", key)
+				}
+				path = append(path, pathSegment{name: s[2:end]})
+				s = s[end+2:]
+				continue
+			}
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path:%v", key)
+			}
+			i, err := strconv.Atoi(s[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid index %v in path:%v", s[1:end], key)
+			}
+			path = append(path, pathSegment{index: i, isIndex: true})
+			s = s[end+1:]
+		default:
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			path = append(path, pathSegment{name: s[:end]})
+			s = s[end:]
+		}
+	}
+
+	pathCache.Store(key, path)
+	return path, nil
+}
+
+func deref(v interface{}) reflect.Value {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return reflect.Value{}
+		}
+		rv = rv.Elem()
+	}
+	return rv
+}
+
+// index 取map的key或者struct的字段
+func index(v interface{}, name string) (interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		r, ok := m[name]
+		return r, ok
+	case map[string]string:
+		r, ok := m[name]
+		return r, ok
+	case map[interface{}]interface{}:
+		r, ok := m[name]
+		return r, ok
+	case nil:
+		return nil, false
+	}
+
+	rv := deref(v)
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		r := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+		if !r.IsValid() {
+			return nil, false
+		}
+		return r.Interface(), true
+	case reflect.Struct:
+		i, ok := fieldIndex(rv.Type(), name)
+		if !ok {
+			return nil, false
+		}
+		f := rv.Field(i)
+		if !f.CanInterface() {
+			return nil, false
+		}
+		return f.Interface(), true
+	}
+	return nil, false
+}
+
+// elem 取slice、array的下标，负数从后往前数
+func elem(v interface{}, i int) (interface{}, bool) {
+	if a, ok := v.([]interface{}); ok {
+		if i < 0 {
+			i += len(a)
+		}
+		if i < 0 || i >= len(a) {
+			return nil, false
+		}
+		return a[i], true
+	}
+
+	rv := deref(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	if i < 0 {
+		i += rv.Len()
+	}
+	if i < 0 || i >= rv.Len() {
+		return nil, false
+	}
+	return rv.Index(i).Interface(), true
+}
+
+type fieldKey struct {
+	t    reflect.Type
+	name string
+}
+
+// fieldCache fieldKey -> int(字段下标，-1为不存在)
+var fieldCache = new(sync.Map)
+
+// fieldIndex 按json tag、字段名、不区分大小写的字段名的顺序查找导出的字段
+func fieldIndex(t reflect.Type, name string) (int, bool) {
+	key := fieldKey{t: t, name: name}
+	if v, ok := fieldCache.Load(key); ok {
+		i := v.(int)
+		return i, i >= 0
+	}
+
+	found := -1
+	fold := -1
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if tag == name || (tag == "" && f.Name == name) {
+			found = i
+			break
+		}
+		if f.Name == name && found < 0 {
+			found = i
+		}
+		if fold < 0 && strings.EqualFold(f.Name, name) {
+			fold = i
+		}
+	}
+	if found < 0 {
+		found = fold
+	}
+
+	fieldCache.Store(key, found)
+	return found, found >= 0
+}
+
+// toString 把取到的值转换为字符串，给只支持字符串的Matcher使用
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	rv := deref(v)
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return ""
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return strconv.FormatBool(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(rv.Uint(), 10)
+	case reflect.Float32:
+		return strconv.FormatFloat(rv.Float(), 'f', -1, 32)
+	case reflect.Float64:
+		return strconv.FormatFloat(rv.Float(), 'f', -1, 64)
+	}
+	return toJSON(v)
+}
+
+// toFloat 数字类型直接转换，字符串按toNumber解析
+func toFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case string:
+		return toNumber(v)
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	}
+
+	rv := deref(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	}
+	return toNumber(toString(v))
+}
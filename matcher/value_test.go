@@ -0,0 +1,178 @@
+package matcher
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testUser struct {
+	Name    string            `json:"name"`
+	Age     int               `json:"age"`
+	Score   float64           `json:"score"`
+	VIP     bool              `json:"vip"`
+	Tags    []string          `json:"tags"`
+	Extra   map[string]string `json:"extra"`
+	Friend  *testUser         `json:"friend,omitempty"`
+	Country string
+	secret  string
+}
+
+func TestFilter_FilterValue(t *testing.T) {
+	user := &testUser{
+		Name:    "tom",
+		Age:     18,
+		Score:   99.5,
+		VIP:     true,
+		Tags:    []string{"a", "b"},
+		Extra:   map[string]string{"from": "ad", "x.y": "dot"},
+		Friend:  &testUser{Name: "jerry", Age: 3},
+		Country: "cn",
+		secret:  "s",
+	}
+	jsonData, _ := json.Marshal(map[string]interface{}{"user": user, "big": 9007199254740993, "flat.key": "flat"})
+	var generic interface{}
+	_ = json.Unmarshal(jsonData, &generic)
+
+	testCases := []struct {
+		expr   string
+		expect bool
+	}{
+		{`user.name == tom`, true},
+		{`user.age >= 18 && user.age < 19`, true},
+		{`user.score > 99.4`, true},
+		{`user.vip == true`, true},
+		{`user.tags[0] == a && user.tags[-1] == b`, true},
+		{`user.tags[2] == ""`, true},
+		{`user.extra.from in [ad, seo]`, true},
+		{`user.extra["x.y"] == dot`, true},
+		{`$.user.friend.name == jerry`, true},
+		{`user.friend.friend.name == ""`, true},
+		{`user.Country == cn`, true},
+		{`user.secret == ""`, true},
+		{`user.missing.deep == ""`, true},
+		{`user.age in [18, 20]`, true},
+		{`user.score notIn [99.5]`, false},
+		{`user.name hasPrefix t`, true},
+	}
+
+	for _, data := range []interface{}{
+		map[string]interface{}{"user": user},
+		struct{ User *testUser }{User: user},
+		jsonData,
+		generic,
+	} {
+		for _, tc := range testCases {
+			f := MustParseFilter(tc.expr)
+			assert.Equal(t, tc.expect, f.FilterValue(data), "%v %T", tc.expr, data)
+		}
+	}
+
+	//struct字段名不区分大小写，map的key区分
+	assert.True(t, MustParseFilter(`user.country == cn`).FilterValue(map[string]interface{}{"user": user}))
+	assert.False(t, MustParseFilter(`user.country == cn`).FilterValue(jsonData))
+
+	//json的大整数不丢精度，扁平的key优先
+	assert.True(t, MustParseFilter(`big == 9007199254740993`).FilterValue(jsonData))
+	assert.True(t, MustParseFilter(`flat.key == flat`).FilterValue(jsonData))
+	assert.False(t, MustParseFilter(`a == 1`).FilterValue([]byte("{bad json")))
+	//格式错误的json不按空数据处理，否定的规则也不通过
+	ok, resp := MustParseFilter(`!channel == a`).FilterValueWithResponse([]byte("{bad json"))
+	assert.False(t, ok)
+	assert.Empty(t, resp)
+	assert.True(t, MustParseFilter(`a == ""`).FilterValue(nil))
+}
+
+func TestFilter_FilterValueStringMap(t *testing.T) {
+	//map[string]string不做路径解析，与Filter一致
+	data := map[string]string{"user.name": "tom", "user": "x"}
+	f := MustParseFilter(`user.name == tom`)
+	assert.True(t, f.FilterValue(data))
+	assert.True(t, f.Filter(data))
+	assert.True(t, MustParseFilter(`user.name.x == ""`).FilterValue(data))
+}
+
+func TestFilter_FilterValueWithResponse(t *testing.T) {
+	f := MustParseFilter(`user.age > 10`)
+	f.ResponseOnMatch = map[string]interface{}{
+		"name": "{{user.name}}",
+		"age":  "{{user.age}}",
+		"tag":  "toString({{user.tags[1]}})",
+	}
+
+	ok, resp := f.FilterValueWithResponse(map[string]interface{}{
+		"user": testUser{Name: "tom", Age: 18, Tags: []string{"a", "b"}},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, map[string]interface{}{"name": "tom", "age": 18, "tag": "b"}, resp)
+}
+
+func TestExpression_MatchValue(t *testing.T) {
+	exp, err := NewExpression("n", "lessThan", []string{"10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, exp.MatchValue(map[string]interface{}{"n": 9}))
+	assert.True(t, exp.MatchValue(map[string]interface{}{"n": uint8(9)}))
+	assert.True(t, exp.MatchValue(map[string]interface{}{"n": json.Number("9.99")}))
+	assert.False(t, exp.MatchValue(map[string]interface{}{"n": int64(10)}))
+	assert.True(t, exp.MatchValue(map[string]interface{}{"n": "9"}))
+
+	exp, err = NewExpression("n", "notLessThan", []string{"10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, exp.MatchValue(map[string]interface{}{"n": 10.0}))
+
+	exp, err = NewExpression("n", "==", []string{"1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, exp.MatchValue([]byte(`{"n": 1.0}`)))
+}
+
+func TestParsePath(t *testing.T) {
+	testCases := []struct {
+		key    string
+		expect []pathSegment
+		err    bool
+	}{
+		{"a", []pathSegment{{name: "a"}}, false},
+		{"$.a.b", []pathSegment{{name: "a"}, {name: "b"}}, false},
+		{"a[0][-1].b", []pathSegment{{name: "a"}, {index: 0, isIndex: true}, {index: -1, isIndex: true}, {name: "b"}}, false},
+		{`a["b.c]"]['d']`, []pathSegment{{name: "a"}, {name: "b.c]"}, {name: "d"}}, false},
+		{"a[x]", nil, true},
+		{"a[0", nil, true},
+		{`a["b]`, nil, true},
+	}
+	for _, tc := range testCases {
+		path, err := parsePath(tc.key)
+		if tc.err {
+			assert.NotNil(t, err, tc.key)
+			continue
+		}
+		assert.Nil(t, err, tc.key)
+		assert.Equal(t, tc.expect, path, tc.key)
+	}
+}
+
+func Benchmark_FilterValue(b *testing.B) {
+	f := MustParseFilter(`user.age >= 18 && user.tags[0] in [a, c] && user.name hasPrefix t`)
+	data := map[string]interface{}{"user": &testUser{Name: "tom", Age: 18, Tags: []string{"a"}}}
+	for i := 0; i < b.N; i++ {
+		if !f.FilterValue(data) {
+			b.Fatal("not match")
+		}
+	}
+}
+
+func Benchmark_FilterStringMap(b *testing.B) {
+	f := MustParseFilter(`user.age >= 18 && user.tags[0] in [a, c] && user.name hasPrefix t`)
+	data := map[string]string{"user.age": "18", "user.tags[0]": "a", "user.name": "tom"}
+	for i := 0; i < b.N; i++ {
+		if !f.Filter(data) {
+			b.Fatal("not match")
+		}
+	}
+}